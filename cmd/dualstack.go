@@ -0,0 +1,464 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dual stack states of a target
+const (
+	dualOK         = "OK"
+	dualIPv6Broken = "IPV6-BROKEN"
+	dualIPv4Broken = "IPV4-BROKEN"
+	dualIPv4Only   = "IPV4-ONLY"
+	dualIPv6Only   = "IPV6-ONLY"
+	dualDown       = "DOWN"
+)
+
+// dual stack checks
+const (
+	checkTCP  = "tcp"
+	checkTLS  = "tls"
+	checkHTTP = "http"
+)
+
+const (
+	familyIPv4 = "IPv4"
+	familyIPv6 = "IPv6"
+)
+
+var (
+	dualstackCmd = &cobra.Command{
+		Use:   "dualstack [host[:port]|url ...]",
+		Short: "Compare IPv4 and IPv6 reachability",
+		Long: `Race the IPv6 and IPv4 addresses of the targets following Happy Eyeballs (RFC 8305) and run
+the tcp, tls and http checks on the first address of each family.
+Hosts whose IPv6 path is broken while IPv4 works are reported as IPV6-BROKEN.`,
+		Example:      `tcping2 dualstack www.example.com https://api.example.com/health mail.example.com:25 --checks tcp`,
+		RunE:         runDualStack,
+		SilenceUsage: true,
+	}
+	dualPort         = 443
+	dualChecks       = []string{checkTCP, checkTLS, checkHTTP}
+	dualAttemptDelay = 250 * time.Millisecond
+	dualRootCA       string
+)
+
+// DualStack is the dual stack report of a target
+type DualStack struct {
+	Target        string         `json:"target" yaml:"target"`
+	Host          string         `json:"host" yaml:"host"`
+	Port          int            `json:"port" yaml:"port"`
+	Winner        string         `json:"winner,omitempty" yaml:"winner,omitempty"`
+	WinnerAddress string         `json:"winner_address,omitempty" yaml:"winner_address,omitempty"`
+	RaceTime      float64        `json:"race_ms" yaml:"race_ms"`
+	RaceError     string         `json:"race_error,omitempty" yaml:"race_error,omitempty"`
+	Families      []FamilyResult `json:"families" yaml:"families"`
+	Status        string         `json:"status" yaml:"status"`
+	url           string
+	checks        []string
+	pool          *x509.CertPool
+}
+
+// FamilyResult holds the checks of the first address of an IP family, Address is empty if the
+// host has no address of the family
+type FamilyResult struct {
+	Family  string        `json:"family" yaml:"family"`
+	Address string        `json:"address,omitempty" yaml:"address,omitempty"`
+	OK      bool          `json:"ok" yaml:"ok"`
+	Checks  []CheckResult `json:"checks,omitempty" yaml:"checks,omitempty"`
+}
+
+// CheckResult is the outcome of a single check, Status is the HTTP status code
+type CheckResult struct {
+	Check  string  `json:"check" yaml:"check"`
+	OK     bool    `json:"ok" yaml:"ok"`
+	RTT    float64 `json:"rtt_ms" yaml:"rtt_ms"`
+	Status int     `json:"status,omitempty" yaml:"status,omitempty"`
+	Msg    string  `json:"message,omitempty" yaml:"message,omitempty"`
+	Error  string  `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func init() {
+	dualstackCmd.Flags().StringVarP(&queryAddress, "address", "a", "", "host or URL to check")
+	dualstackCmd.Flags().IntVarP(&dualPort, "port", "p", dualPort, "port of targets without port")
+	dualstackCmd.Flags().IntVarP(&pingTimeout, "timeout", "t", pingTimeout, "timeout of each check in sec")
+	dualstackCmd.Flags().StringSliceVar(&dualChecks, "checks", dualChecks, "checks run on each family: tcp, tls, http")
+	dualstackCmd.Flags().DurationVar(&dualAttemptDelay, "attempt-delay", dualAttemptDelay, "Happy Eyeballs connection attempt delay")
+	dualstackCmd.Flags().StringVarP(&dualRootCA, "rootca", "r", "", "root CA of the tls and https checks: PEM file, directory, JKS, PKCS12 or Oracle Wallet")
+	addTargetFlags(dualstackCmd)
+	RootCmd.AddCommand(dualstackCmd)
+}
+
+func runDualStack(_ *cobra.Command, args []string) error {
+	if relayHost() != "" {
+		return errors.New("dualstack needs direct connections, --proxy and --ssh-jump are not supported")
+	}
+	if dnsIPv4Only {
+		return errors.New("dualstack can not be used with --dnsIPv4")
+	}
+	for _, c := range dualChecks {
+		if c != checkTCP && c != checkTLS && c != checkHTTP {
+			return fmt.Errorf("invalid check %s, use tcp, tls or http", c)
+		}
+	}
+	targets, err := collectTargets(args)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("please specify a host to check")
+	}
+	pool, err := buildCertPool(dualRootCA)
+	if err != nil {
+		return err
+	}
+	if textOutput() {
+		logDualStackHeader(dualChecks)
+	}
+	err = runTargets("dualstack", targets, func(j *targetJob) {
+		d, e := newDualStack(j.target, pool)
+		if e != nil {
+			j.err = e
+			return
+		}
+		ips, e := lookupProbeHost(d.Host)
+		if e != nil {
+			log.Debugf("dualstack resolve %s failed: %v", d.Host, e)
+			j.err = e
+			return
+		}
+		d.Run(context.Background(), ips)
+		j.emit(d.Record(), d.Log)
+	})
+	log.Debugf("dualstack done")
+	return err
+}
+
+// newDualStack parses a host[:port] or http(s) URL target. The http check uses the URL, for other
+// targets https://host:port/ or http://host/ for port 80. The tls check is skipped for http URLs.
+func newDualStack(target string, pool *x509.CertPool) (*DualStack, error) {
+	d := &DualStack{Target: target, pool: pool, checks: dualChecks}
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != schemeHTTP && u.Scheme != schemeHTTPS) || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid URL %s, only http and https allowed", target)
+		}
+		d.Host, d.url = u.Hostname(), target
+		d.Port = 443
+		if u.Scheme == schemeHTTP {
+			d.Port = 80
+		}
+		if p := u.Port(); p != "" {
+			d.Port, _ = strconv.Atoi(p)
+		}
+	} else {
+		host, port, err := splitProbeTarget(target, dualPort)
+		if err != nil {
+			return nil, err
+		}
+		d.Host, d.Port = host, port
+		scheme := schemeHTTPS
+		if port == 80 {
+			scheme = schemeHTTP
+		}
+		d.url = scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/"
+	}
+	if strings.HasPrefix(d.url, schemeHTTP+"://") {
+		var checks []string
+		for _, c := range d.checks {
+			if c != checkTLS {
+				checks = append(checks, c)
+			}
+		}
+		d.checks = checks
+	}
+	return d, nil
+}
+
+// Run races the addresses and runs the checks on the first address of each family concurrently
+func (d *DualStack) Run(ctx context.Context, ips []net.IP) {
+	port := strconv.Itoa(d.Port)
+	timeout := time.Duration(pingTimeout) * time.Second
+	ip, rtt, err := happyEyeballs(ctx, ips, port, dualAttemptDelay, timeout)
+	d.RaceTime = durationMS(rtt)
+	if err != nil {
+		d.RaceError = err.Error()
+	} else {
+		d.Winner, d.WinnerAddress = ipFamily(ip), ip.String()
+	}
+	log.Debugf("dualstack race %s: winner %s %s in %.1f ms, error %v", d.Target, d.Winner, d.WinnerAddress, d.RaceTime, err)
+
+	d.Families = []FamilyResult{{Family: familyIPv6}, {Family: familyIPv4}}
+	runParallel(len(d.Families), func(i int) {
+		f := &d.Families[i]
+		for _, a := range ips {
+			if ipFamily(a) == f.Family {
+				d.runChecks(ctx, f, a)
+				break
+			}
+		}
+	})
+	d.Status = dualStatus(d.Families[1], d.Families[0])
+}
+
+// runChecks runs the checks in order on the address of a family
+func (d *DualStack) runChecks(ctx context.Context, f *FamilyResult, ip net.IP) {
+	f.Address = ip.String()
+	f.OK = true
+	addr := net.JoinHostPort(f.Address, strconv.Itoa(d.Port))
+	for _, c := range d.checks {
+		r := CheckResult{Check: c}
+		switch c {
+		case checkTCP:
+			t := new(TCPing)
+			_ = t.RunContext(ctx, addr)
+			r.OK, r.RTT, r.Msg = t.Code == tcpCodeOpen, t.RTT, t.Msg
+			if !r.OK {
+				r.Error = t.Record().Error
+			}
+		case checkTLS:
+			res := &TLSResult{Address: addr, Host: d.Host}
+			start := time.Now()
+			err := tlsDialAddr(ctx, res, addr, d.Host, d.pool, "", time.Duration(pingTimeout)*time.Second)
+			r.RTT = durationMS(time.Since(start))
+			r.OK = err == nil
+			if err != nil {
+				r.Error = err.Error()
+			}
+		case checkHTTP:
+			h := &HTTPing{connectIP: ip}
+			err := h.RunContext(ctx, d.url)
+			r.RTT, r.Status = durationMS(time.Duration(h.Total)), h.Status
+			switch {
+			case err != nil:
+				r.Error = err.Error()
+			case h.Status >= 400:
+				r.Error = fmt.Sprintf("HTTP status %d", h.Status)
+			default:
+				r.OK = true
+			}
+		}
+		log.Debugf("dualstack %s %s %s ok %v %s", d.Target, f.Family, c, r.OK, r.Error)
+		f.OK = f.OK && r.OK
+		f.Checks = append(f.Checks, r)
+	}
+}
+
+// dualStatus rates a target by the results of both families
+func dualStatus(v4, v6 FamilyResult) string {
+	has4, has6 := v4.Address != "", v6.Address != ""
+	switch {
+	case has4 && has6 && v4.OK && v6.OK:
+		return dualOK
+	case has4 && has6 && v4.OK:
+		return dualIPv6Broken
+	case has4 && has6 && v6.OK:
+		return dualIPv4Broken
+	case has4 && !has6 && v4.OK:
+		return dualIPv4Only
+	case has6 && !has4 && v6.OK:
+		return dualIPv6Only
+	}
+	return dualDown
+}
+
+// happyEyeballs connects to the addresses in the order of RFC 8305: the families are interleaved starting
+// with IPv6 and a new attempt starts after delay or as soon as the previous attempt failed.
+// It returns the address of the first established connection and the time since the start.
+func happyEyeballs(ctx context.Context, ips []net.IP, port string, delay, timeout time.Duration) (net.IP, time.Duration, error) {
+	addrs := interleaveFamilies(ips)
+	if len(addrs) == 0 {
+		return nil, 0, errors.New("no addresses")
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type attempt struct {
+		ip   net.IP
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(addrs))
+	start := time.Now()
+	next, running := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var lastErr error
+	for {
+		var startNext <-chan time.Time
+		if next < len(addrs) {
+			startNext = timer.C
+		}
+		select {
+		case <-startNext:
+			ip := addrs[next]
+			next++
+			running++
+			log.Debugf("happy eyeballs attempt %s after %v", ip, time.Since(start))
+			go func() {
+				conn, err := newDialer(0).DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+				results <- attempt{ip, conn, err}
+			}()
+			timer.Reset(delay)
+		case a := <-results:
+			running--
+			if a.err == nil {
+				elapsed := time.Since(start)
+				_ = a.conn.Close()
+				cancel()
+				// close the connections of attempts still running
+				go func() {
+					for ; running > 0; running-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}()
+				return a.ip, elapsed, nil
+			}
+			lastErr = a.err
+			if next < len(addrs) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			} else if running == 0 {
+				return nil, time.Since(start), lastErr
+			}
+		}
+	}
+}
+
+// interleaveFamilies orders the addresses alternating IPv6 and IPv4 starting with IPv6, the order
+// within a family is kept
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	list := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			list = append(list, v6[i])
+		}
+		if i < len(v4) {
+			list = append(list, v4[i])
+		}
+	}
+	return list
+}
+
+// ipFamily returns IPv4 or IPv6
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// Record returns the serializable result of the target, broken families are reported as error
+func (d *DualStack) Record() Result {
+	var errs []string
+	for _, f := range d.Families {
+		for _, c := range f.Checks {
+			if !c.OK {
+				errs = append(errs, fmt.Sprintf("%s %s: %s", f.Family, c.Check, c.Error))
+			}
+		}
+	}
+	var err error
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	return newResult("dualstack", d.Target, d.Status, err, d)
+}
+
+// logDualStackHeader prints the column titles of the matrix
+func logDualStackHeader(checks []string) {
+	line := cyan("%-13s", "STATUS") + cyan("%-31s", "TARGET") + cyan("%-6s", "IP") + cyan("%-28s", "ADDRESS")
+	for _, c := range checks {
+		line += cyan("%-16s", strings.ToUpper(c))
+	}
+	fmt.Println(line + cyan("%s", "RACE"))
+}
+
+// Log prints a row per family, the winner of the race is marked with *
+func (d *DualStack) Log() {
+	for i, f := range d.Families {
+		status, target := "", ""
+		if i == 0 {
+			status, target = d.Status, d.Target
+		}
+		line := colorDualStatus(status) + fmt.Sprintf("%-31s%-6s", target, strings.TrimPrefix(f.Family, "IP"))
+		if f.Address == "" {
+			fmt.Println(line + yellow("%s", "no address"))
+			continue
+		}
+		line += fmt.Sprintf("%-28s", f.Address)
+		cells := map[string]CheckResult{}
+		for _, c := range f.Checks {
+			cells[c.Check] = c
+		}
+		for _, name := range dualChecks {
+			c, ok := cells[name]
+			switch {
+			case !ok:
+				line += fmt.Sprintf("%-16s", "-")
+			case c.OK && c.Status > 0:
+				line += green("%-16s", fmt.Sprintf("%d %.1f ms", c.Status, c.RTT))
+			case c.OK:
+				line += green("%-16s", fmt.Sprintf("%.1f ms", c.RTT))
+			case c.Msg != "":
+				line += red("%-16s", c.Msg)
+			case c.Status > 0:
+				line += red("%-16s", strconv.Itoa(c.Status))
+			default:
+				line += red("%-16s", "FAIL")
+			}
+		}
+		if d.WinnerAddress == f.Address {
+			line += fmt.Sprintf("* %.1f ms", d.RaceTime)
+		}
+		fmt.Println(line)
+	}
+	for _, f := range d.Families {
+		for _, c := range f.Checks {
+			if !c.OK {
+				fmt.Printf("%-13s%s %s: %s\n", "", f.Family, c.Check, c.Error)
+			}
+		}
+	}
+}
+
+// colorDualStatus colors the status column, broken families are red
+func colorDualStatus(s string) string {
+	switch s {
+	case dualOK:
+		return green("%-13s", s)
+	case dualIPv4Only, dualIPv6Only, "":
+		return yellow("%-13s", s)
+	}
+	return red("%-13s", s)
+}
@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+var (
+	loopback4 = net.ParseIP("127.0.0.1")
+	loopback6 = net.ParseIP("::1")
+)
+
+// listenLoopback6 listens on [::1] or skips the test without IPv6
+func listenLoopback6(t *testing.T, port int) net.Listener {
+	l, err := net.Listen("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	a4, b4 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	a6, b6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	assert.Equal(t, []net.IP{a6, a4, b6, b4}, interleaveFamilies([]net.IP{a4, b4, a6, b6}))
+	assert.Equal(t, []net.IP{a6, a4, b4}, interleaveFamilies([]net.IP{a4, b4, a6}))
+	assert.Empty(t, interleaveFamilies(nil))
+}
+
+func TestDualStatus(t *testing.T) {
+	ok := func(a string) FamilyResult { return FamilyResult{Address: a, OK: true} }
+	fail := func(a string) FamilyResult { return FamilyResult{Address: a} }
+	none := FamilyResult{}
+	for _, c := range []struct {
+		v4, v6 FamilyResult
+		status string
+	}{
+		{ok("192.0.2.1"), ok("2001:db8::1"), dualOK},
+		{ok("192.0.2.1"), fail("2001:db8::1"), dualIPv6Broken},
+		{fail("192.0.2.1"), ok("2001:db8::1"), dualIPv4Broken},
+		{ok("192.0.2.1"), none, dualIPv4Only},
+		{none, ok("2001:db8::1"), dualIPv6Only},
+		{fail("192.0.2.1"), fail("2001:db8::1"), dualDown},
+		{fail("192.0.2.1"), none, dualDown},
+	} {
+		assert.Equal(t, c.status, dualStatus(c.v4, c.v6), "%+v %+v", c.v4, c.v6)
+	}
+}
+
+func TestNewDualStack(t *testing.T) {
+	for _, c := range []struct {
+		target string
+		host   string
+		port   int
+		url    string
+		checks []string
+	}{
+		{"www.example.com", "www.example.com", 443, "https://www.example.com:443/", dualChecks},
+		{"www.example.com:80", "www.example.com", 80, "http://www.example.com:80/", []string{checkTCP, checkHTTP}},
+		{"2001:db8::1", "2001:db8::1", 443, "https://[2001:db8::1]:443/", dualChecks},
+		{"https://api.example.com/health", "api.example.com", 443, "https://api.example.com/health", dualChecks},
+		{"http://api.example.com:8080/", "api.example.com", 8080, "http://api.example.com:8080/", []string{checkTCP, checkHTTP}},
+	} {
+		d, err := newDualStack(c.target, nil)
+		require.NoError(t, err, c.target)
+		assert.Equal(t, c.host, d.Host, c.target)
+		assert.Equal(t, c.port, d.Port, c.target)
+		assert.Equal(t, c.url, d.url, c.target)
+		assert.Equal(t, c.checks, d.checks, c.target)
+	}
+	_, err := newDualStack("ftp://files.example.com", nil)
+	assert.Error(t, err)
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	l4, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l4.Close() }()
+	port := l4.Addr().(*net.TCPAddr).Port
+	ctx := context.Background()
+
+	t.Run("fallback to IPv4", func(t *testing.T) {
+		ip, rtt, err := happyEyeballs(ctx, []net.IP{loopback4, loopback6}, strconv.Itoa(port), time.Second, 2*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, loopback4, ip)
+		assert.Less(t, rtt, time.Second, "refused IPv6 attempt starts the next attempt at once")
+	})
+	t.Run("IPv6 wins", func(t *testing.T) {
+		listenLoopback6(t, port)
+		ip, _, err := happyEyeballs(ctx, []net.IP{loopback4, loopback6}, strconv.Itoa(port), time.Second, 2*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, loopback6, ip)
+	})
+	t.Run("all refused", func(t *testing.T) {
+		closed := strconv.Itoa(freePort(t))
+		_, _, err := happyEyeballs(ctx, []net.IP{loopback4, loopback6}, closed, 50*time.Millisecond, 2*time.Second)
+		assert.Error(t, err)
+	})
+}
+
+func TestDualStackRun(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer web.Close()
+	port := web.Listener.Addr().(*net.TCPAddr).Port
+	target := "http://localhost:" + strconv.Itoa(port) + "/health"
+
+	t.Run("IPv6 broken", func(t *testing.T) {
+		d, err := newDualStack(target, nil)
+		require.NoError(t, err)
+		d.Run(context.Background(), []net.IP{loopback6, loopback4})
+		assert.Equal(t, dualIPv6Broken, d.Status)
+		assert.Equal(t, familyIPv4, d.Winner)
+		require.Len(t, d.Families, 2)
+		assert.False(t, d.Families[0].OK)
+		require.Len(t, d.Families[1].Checks, 2)
+		assert.Equal(t, http.StatusOK, d.Families[1].Checks[1].Status)
+		r := d.Record()
+		assert.Contains(t, r.Error, "IPv6 tcp: REFUSED")
+	})
+	t.Run("both families", func(t *testing.T) {
+		srv := &http.Server{Handler: web.Config.Handler, ReadHeaderTimeout: time.Second}
+		go func() { _ = srv.Serve(listenLoopback6(t, port)) }()
+		defer func() { _ = srv.Close() }()
+		d, err := newDualStack(target, nil)
+		require.NoError(t, err)
+		d.Run(context.Background(), []net.IP{loopback4, loopback6})
+		assert.Equal(t, dualOK, d.Status)
+		assert.True(t, d.Families[0].OK)
+		assert.True(t, d.Families[1].OK)
+	})
+}
+
+func TestDualStackCmd(t *testing.T) {
+	resetTargets(t)
+	web := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer web.Close()
+	t.Cleanup(func() {
+		dualChecks = []string{checkTCP, checkTLS, checkHTTP}
+		pingTimeout = 3
+	})
+	t.Run("CMD dualstack", func(t *testing.T) {
+		args := []string{
+			"dualstack",
+			web.URL + "/",
+			"--checks", "tcp,http",
+			"-t", "2",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record dualstack "+web.URL+"/ "+dualIPv4Only)
+	})
+	t.Run("CMD dualstack invalid check", func(t *testing.T) {
+		args := []string{
+			"dualstack",
+			web.URL,
+			"--checks", "udp",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "invalid check udp")
+	})
+}
@@ -195,7 +195,6 @@ func handleServerConnection(conn net.Conn, ch chan echoResult) {
 }
 
 func runClient() (err error) {
-	var d net.Dialer
 	// obtain the server address and port via program arguments
 	log.Debugf("try Echo to %s:%s", queryAddress, queryPort)
 	ips, err := normalizeAddress()
@@ -212,8 +211,6 @@ func runClient() (err error) {
 	}
 	// get the first IP address and create an address string
 	ip := ips[0].String()
-	version := GetVersion(false)
-	servername := common.GetHostname()
 	addr := net.JoinHostPort(ip, queryPort)
 
 	// create a context with a timeout
@@ -223,13 +220,21 @@ func runClient() (err error) {
 
 	// create a tcp connection to the server
 	log.Debugf("connecting to %s", addr)
-	conn, err := d.DialContext(ctx, "tcp", addr)
+	conn, err := dialTCP(ctx, addr, 0)
 	if err != nil {
 		log.Infof("failed to connect :%s", err)
+		if relayHost() != "" {
+			err = fmt.Errorf("failed to connect to server %s: %w", addr, err)
+			return
+		}
 		err = fmt.Errorf("failed to connect to server %s", addr)
 		return
 	}
-	log.Infof("connected to %s", conn.RemoteAddr())
+	if relayHost() != "" {
+		log.Infof("connected to %s via %s from %s", addr, relayHost(), conn.LocalAddr())
+	} else {
+		log.Infof("connected to %s from %s", conn.RemoteAddr(), conn.LocalAddr())
+	}
 	defer func(conn net.Conn) {
 		_ = conn.Close()
 	}(conn)
@@ -239,6 +244,20 @@ func runClient() (err error) {
 	log.Debugf("double connection timeout to %d seconds", dl)
 	_ = conn.SetDeadline(time.Now().Add(time.Duration(dl) * time.Second))
 
+	answer, err := echoExchange(conn, true)
+	if err != nil {
+		return
+	}
+	// print the final response
+	emitEchoReply(addr, localSource(conn), answer)
+	return
+}
+
+// echoExchange sends the version greeting to an echo server and returns its answer. An empty answer
+// means the server is connected but no tcping2 server. With quit a tcping2 server is asked to terminate.
+func echoExchange(conn net.Conn, quit bool) (answer string, err error) {
+	version := GetVersion(false)
+	servername := common.GetHostname()
 	// send the TCPING message to the server
 	log.Infof("send %s version to server", echoPrefix)
 	msg := fmt.Sprintf("%s , client %s %s\n", echoPrefix, servername, version)
@@ -259,7 +278,6 @@ func runClient() (err error) {
 		if err == io.EOF {
 			log.Infof("No Data from server, but connected")
 			err = nil
-			fmt.Printf("connection to %s successful tested\n", addr)
 			return
 		}
 		err = fmt.Errorf("failed to read data from server, err:%s", err)
@@ -270,13 +288,32 @@ func runClient() (err error) {
 
 	// check if the server response is a TCPING message
 	if strings.HasPrefix(msg, echoPrefix) {
-		log.Debugf("is %s, send terminate to server", echoPrefix)
 		log.Infof("answer: %s", msg)
-		_, _ = conn.Write([]byte(echoQuit + "\n"))
+		answer = msg
+		if quit {
+			log.Debugf("is %s, send terminate to server", echoPrefix)
+			_, _ = conn.Write([]byte(echoQuit + "\n"))
+		}
 	} else {
 		log.Infof("not %s, but connected", echoPrefix)
 	}
-	// print the final response
-	fmt.Printf("connection to %s successful tested\n", addr)
 	return
 }
+
+// EchoReply is the serializable result of an echo client run
+type EchoReply struct {
+	Address string `json:"address" yaml:"address"`
+	Source  string `json:"source,omitempty" yaml:"source,omitempty"`
+	Answer  string `json:"answer,omitempty" yaml:"answer,omitempty"`
+}
+
+// emitEchoReply reports a successful echo client connection from source to addr
+func emitEchoReply(addr, source, answer string) {
+	emit(newResult("echo", addr, "OK", nil, EchoReply{Address: addr, Source: source, Answer: answer}), func() {
+		if sourceSet() && source != "" {
+			fmt.Printf("connection to %s from %s successful tested\n", addr, source)
+			return
+		}
+		fmt.Printf("connection to %s successful tested\n", addr)
+	})
+}
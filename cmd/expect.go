@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// expect script step actions
+const (
+	actionSend      = "send"
+	actionSendHex   = "send_hex"
+	actionExpect    = "expect"
+	actionExpectHex = "expect_hex"
+)
+
+// expectBufferSize limits the received data an expect step waits in for its match
+const expectBufferSize = 64 << 10
+
+var (
+	expectSend   string
+	expectRegexp string
+	expectFile   string
+	// expectScript is the conversation run after a successful connect, nil to close the connection at once
+	expectScript *ExpectScript
+)
+
+// ExpectScript is a conversation of send and expect steps, Timeout is the default timeout of a step
+type ExpectScript struct {
+	Timeout time.Duration `yaml:"timeout"`
+	Steps   []ExpectStep  `yaml:"steps"`
+}
+
+// ExpectStep sends data or waits for data matching a regular expression or hex bytes.
+// Exactly one of the actions must be set.
+type ExpectStep struct {
+	Send      string        `yaml:"send"`
+	SendHex   string        `yaml:"send_hex"`
+	Expect    string        `yaml:"expect"`
+	ExpectHex string        `yaml:"expect_hex"`
+	Timeout   time.Duration `yaml:"timeout"`
+
+	action string
+	arg    string
+	data   []byte
+	re     *regexp.Regexp
+}
+
+// StepResult is the outcome of a script step, RTT is the time the step took
+type StepResult struct {
+	Step   int     `json:"step" yaml:"step"`
+	Action string  `json:"action" yaml:"action"`
+	Arg    string  `json:"arg" yaml:"arg"`
+	RTT    float64 `json:"rtt_ms" yaml:"rtt_ms"`
+	Match  string  `json:"match,omitempty" yaml:"match,omitempty"`
+	Error  string  `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// loadExpectScript builds the script of --script or of --send and --expect, nil if none is given
+func loadExpectScript() (*ExpectScript, error) {
+	var s *ExpectScript
+	switch {
+	case expectFile != "" && (expectSend != "" || expectRegexp != ""):
+		return nil, errors.New("--script can not be combined with --send or --expect")
+	case expectFile != "":
+		content, err := os.ReadFile(expectFile)
+		if err != nil {
+			return nil, fmt.Errorf("read script: %w", err)
+		}
+		s = new(ExpectScript)
+		if err = yaml.Unmarshal(content, s); err != nil {
+			return nil, fmt.Errorf("parse script %s: %w", expectFile, err)
+		}
+	case expectSend != "" || expectRegexp != "":
+		s = new(ExpectScript)
+		if expectSend != "" {
+			send, err := unescape(expectSend)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --send %s: %w", expectSend, err)
+			}
+			s.Steps = append(s.Steps, ExpectStep{Send: send})
+		}
+		if expectRegexp != "" {
+			s.Steps = append(s.Steps, ExpectStep{Expect: expectRegexp})
+		}
+	default:
+		return nil, nil
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = time.Duration(pingTimeout) * time.Second
+	}
+	return s, s.compile()
+}
+
+// unescape interprets the Go escapes like \r\n, \x00 and \" in s, plain quotes need no escape
+func unescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(s[i])
+		case c == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return strconv.Unquote(`"` + b.String() + `"`)
+}
+
+// compile checks the steps and prepares the payloads and regular expressions.
+// Expressions match in multi line mode, so ^ and $ match at line boundaries.
+func (s *ExpectScript) compile() error {
+	if len(s.Steps) == 0 {
+		return errors.New("script has no steps")
+	}
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		n := 0
+		for _, a := range []struct{ action, arg string }{
+			{actionSend, st.Send},
+			{actionSendHex, st.SendHex},
+			{actionExpect, st.Expect},
+			{actionExpectHex, st.ExpectHex},
+		} {
+			if a.arg != "" {
+				st.action, st.arg = a.action, a.arg
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("step %d: exactly one of send, send_hex, expect or expect_hex is required", i+1)
+		}
+		var err error
+		switch st.action {
+		case actionSend:
+			st.data = []byte(st.Send)
+		case actionSendHex, actionExpectHex:
+			st.data, err = parseHex(st.arg)
+		case actionExpect:
+			st.re, err = regexp.Compile("(?m)" + st.Expect)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d: %s: %w", i+1, st.action, err)
+		}
+		if st.Timeout <= 0 {
+			st.Timeout = s.Timeout
+		}
+	}
+	return nil
+}
+
+// parseHex decodes hex bytes, spaces and colons between the bytes are ignored
+func parseHex(s string) ([]byte, error) {
+	s = strings.NewReplacer(" ", "", ":", "", "0x", "").Replace(s)
+	return hex.DecodeString(s)
+}
+
+// Run executes the steps on conn with the send and read helpers of STARTTLS and returns the results
+// up to the first failed step. Received data not consumed by a match is kept for the next expect step.
+func (s *ExpectScript) Run(conn net.Conn) ([]StepResult, error) {
+	var results []StepResult
+	rw := bufio.NewReadWriter(bufio.NewReaderSize(conn, expectBufferSize), bufio.NewWriter(conn))
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		r := StepResult{Step: i + 1, Action: st.action, Arg: st.arg}
+		start := time.Now()
+		_ = conn.SetDeadline(start.Add(st.Timeout))
+		var err error
+		switch st.action {
+		case actionSend, actionSendHex:
+			err = sendData(rw.Writer, st.data)
+		default:
+			var got string
+			if got, err = readMatch(rw.Reader, st.match); err != nil {
+				err = expectFailed(err, []byte(got))
+			} else {
+				r.Match = got
+			}
+		}
+		r.RTT = durationMS(time.Since(start))
+		if err != nil {
+			r.Error = err.Error()
+			results = append(results, r)
+			return results, fmt.Errorf("step %d %s %q: %w", r.Step, r.Action, r.Arg, err)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// match returns the matched text and the end of the match in buf, end is -1 if the step does not match
+func (st *ExpectStep) match(buf []byte) (string, int) {
+	if st.re != nil {
+		loc := st.re.FindIndex(buf)
+		if loc == nil {
+			return "", -1
+		}
+		return string(buf[loc[0]:loc[1]]), loc[1]
+	}
+	i := bytes.Index(buf, st.data)
+	if i < 0 {
+		return "", -1
+	}
+	return hex.EncodeToString(st.data), i + len(st.data)
+}
+
+// expectFailed describes a read error of an expect step with the end of the data received so far
+func expectFailed(err error, buf []byte) error {
+	var netErr net.Error
+	msg := err.Error()
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		msg = "timeout"
+	} else if errors.Is(err, io.EOF) {
+		msg = "connection closed"
+	}
+	if len(buf) > 64 {
+		buf = buf[len(buf)-64:]
+	}
+	return fmt.Errorf("%s, received %q", msg, buf)
+}
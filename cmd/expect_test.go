@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func resetExpect(t *testing.T) {
+	t.Cleanup(func() {
+		expectSend = ""
+		expectRegexp = ""
+		expectFile = ""
+		expectScript = nil
+		pingTimeout = 3
+	})
+}
+
+// smtpGreeter is a line protocol server sending a banner and answering EHLO
+func smtpGreeter(t *testing.T) string {
+	return startProxy(t, func(c net.Conn) {
+		_, _ = io.WriteString(c, "220 mail.example.com ESMTP\r\n")
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch line {
+			case "EHLO tcping2\r\n":
+				_, _ = io.WriteString(c, "250-mail.example.com\r\n250 STARTTLS\r\n")
+			case "QUIT\r\n":
+				_, _ = io.WriteString(c, "221 bye\r\n")
+				return
+			}
+		}
+	})
+}
+
+func TestLoadExpectScript(t *testing.T) {
+	resetExpect(t)
+	t.Run("none", func(t *testing.T) {
+		s, err := loadExpectScript()
+		require.NoError(t, err)
+		assert.Nil(t, s)
+	})
+	t.Run("flags", func(t *testing.T) {
+		expectSend = `HELLO\r\n`
+		expectRegexp = "^OK"
+		s, err := loadExpectScript()
+		require.NoError(t, err)
+		require.Len(t, s.Steps, 2)
+		assert.Equal(t, []byte("HELLO\r\n"), s.Steps[0].data)
+		assert.Equal(t, actionExpect, s.Steps[1].action)
+		assert.Equal(t, time.Duration(pingTimeout)*time.Second, s.Steps[1].Timeout)
+		expectSend, expectRegexp = "", ""
+	})
+	t.Run("send escapes", func(t *testing.T) {
+		for in, want := range map[string]string{
+			`a"b`:          `a"b`,
+			`a\"b`:         `a"b`,
+			`say "hi"\r\n`: "say \"hi\"\r\n",
+			`\x00\x01`:     "\x00\x01",
+			`back\\slash`:  `back\slash`,
+		} {
+			got, err := unescape(in)
+			require.NoError(t, err, in)
+			assert.Equal(t, want, got, in)
+		}
+		_, err := unescape(`trailing\`)
+		assert.Error(t, err)
+	})
+	t.Run("file", func(t *testing.T) {
+		expectFile = filepath.Join(t.TempDir(), "script.yaml")
+		script := "timeout: 5s\nsteps:\n  - expect: \"^220 \"\n  - send_hex: \"51:55:49:54 0d 0a\"\n    timeout: 1s\n  - expect_hex: \"0x32 0x32 0x31\"\n"
+		require.NoError(t, os.WriteFile(expectFile, []byte(script), 0600))
+		s, err := loadExpectScript()
+		require.NoError(t, err)
+		require.Len(t, s.Steps, 3)
+		assert.Equal(t, 5*time.Second, s.Steps[0].Timeout)
+		assert.Equal(t, []byte("QUIT\r\n"), s.Steps[1].data)
+		assert.Equal(t, time.Second, s.Steps[1].Timeout)
+		assert.Equal(t, []byte("221"), s.Steps[2].data)
+	})
+	for name, script := range map[string]string{
+		"no steps":     "timeout: 1s\n",
+		"two actions":  "steps:\n  - send: a\n    expect: b\n",
+		"no action":    "steps:\n  - timeout: 1s\n",
+		"bad regexp":   "steps:\n  - expect: \"(\"\n",
+		"bad hex":      "steps:\n  - send_hex: \"0g\"\n",
+		"invalid yaml": "steps: [\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectFile = filepath.Join(t.TempDir(), "script.yaml")
+			require.NoError(t, os.WriteFile(expectFile, []byte(script), 0600))
+			_, err := loadExpectScript()
+			assert.Error(t, err)
+		})
+	}
+	t.Run("script and flags", func(t *testing.T) {
+		expectRegexp = "^OK"
+		_, err := loadExpectScript()
+		assert.ErrorContains(t, err, "can not be combined")
+	})
+}
+
+func TestExpectScriptRun(t *testing.T) {
+	addr := smtpGreeter(t)
+	script := func(steps ...ExpectStep) *ExpectScript {
+		s := &ExpectScript{Timeout: 500 * time.Millisecond, Steps: steps}
+		require.NoError(t, s.compile())
+		return s
+	}
+	run := func(s *ExpectScript) ([]StepResult, error) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		return s.Run(conn)
+	}
+
+	t.Run("conversation", func(t *testing.T) {
+		steps, err := run(script(
+			ExpectStep{Expect: "^220 "},
+			ExpectStep{Send: "EHLO tcping2\r\n"},
+			ExpectStep{Expect: `^250 STARTTLS\r?$`},
+			ExpectStep{SendHex: "51 55 49 54 0d 0a"},
+			ExpectStep{ExpectHex: "323231"},
+		))
+		require.NoError(t, err)
+		require.Len(t, steps, 5)
+		assert.Equal(t, "220 ", steps[0].Match)
+		assert.Equal(t, "250 STARTTLS\r", steps[2].Match, "^ and $ match lines")
+		assert.Equal(t, "323231", steps[4].Match)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		steps, err := run(script(
+			ExpectStep{Send: "EHLO tcping2\r\n"},
+			ExpectStep{Expect: "^250 AUTH"},
+		))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "step 2 expect")
+		require.Len(t, steps, 2)
+		assert.Contains(t, steps[1].Error, "timeout")
+		assert.Contains(t, steps[1].Error, "STARTTLS")
+		assert.GreaterOrEqual(t, steps[1].RTT, 400.0)
+	})
+	t.Run("buffer limit", func(t *testing.T) {
+		flood := startProxy(t, func(c net.Conn) {
+			chunk := bytes.Repeat([]byte("x"), 4096)
+			for {
+				if _, err := c.Write(chunk); err != nil {
+					return
+				}
+			}
+		})
+		conn, err := net.Dial("tcp", flood)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		steps, err := script(ExpectStep{Expect: "never"}).Run(conn)
+		require.Error(t, err)
+		require.Len(t, steps, 1)
+		assert.Contains(t, steps[0].Error, fmt.Sprintf("no match within %d bytes", expectBufferSize))
+		assert.Less(t, steps[0].RTT, 400.0, "the step fails before the timeout")
+	})
+	t.Run("closed", func(t *testing.T) {
+		_, err := run(script(
+			ExpectStep{Send: "QUIT\r\n"},
+			ExpectStep{Expect: "^221"},
+			ExpectStep{Expect: "never"},
+		))
+		assert.ErrorContains(t, err, "connection closed")
+	})
+}
+
+func TestTCPExpect(t *testing.T) {
+	resetExpect(t)
+	resetTargets(t)
+	addr := smtpGreeter(t)
+	t.Run("CMD TCP expect", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			addr,
+			"--send", `EHLO tcping2\r\n`,
+			"--expect", "STARTTLS",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record tcp "+addr+" OPEN")
+		expectSend, expectRegexp = "", ""
+	})
+	t.Run("CMD TCP expect failed", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			addr,
+			"--expect", "^554",
+			"-t", "1",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record tcp "+addr+" EXPECT-FAILED")
+		expectRegexp = ""
+	})
+	t.Run("CMD TCP script with port list", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			"127.0.0.1",
+			"-p", "22,80",
+			"--expect", "^SSH",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "port list")
+		expectRegexp = ""
+	})
+}
@@ -1,10 +1,18 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,20 +26,74 @@ import (
 
 // HTTPing is a struct that contains the statistics of the httping
 type HTTPing struct {
-	URL      string
-	Proxy    bool
-	Scheme   string
-	DNS      int64
-	TCP      int64
-	TLS      int64
-	Process  int64
-	Transfer int64
-	Total    int64
+	URL        string            `json:"url" yaml:"url"`
+	Method     string            `json:"method" yaml:"method"`
+	Proxy      bool              `json:"proxy" yaml:"proxy"`
+	Scheme     string            `json:"scheme" yaml:"scheme"`
+	Host       string            `json:"host" yaml:"host"`
+	Port       int               `json:"port" yaml:"port"`
+	Status     int               `json:"status" yaml:"status"`
+	StatusLine string            `json:"status_line" yaml:"status_line"`
+	Size       int64             `json:"size" yaml:"size"`
+	Verdict    string            `json:"verdict" yaml:"verdict"`
+	Assertions []AssertionResult `json:"assertions,omitempty" yaml:"assertions,omitempty"`
+	Remote     string            `json:"remote,omitempty" yaml:"remote,omitempty"`
+	Server     string            `json:"server,omitempty" yaml:"server,omitempty"`
+	CertSerial string            `json:"cert_serial,omitempty" yaml:"cert_serial,omitempty"`
+	BodyHash   string            `json:"body_sha256" yaml:"body_sha256"`
+	Differs    []string          `json:"differs,omitempty" yaml:"differs,omitempty"`
+	Source     string            `json:"source,omitempty" yaml:"source,omitempty"`
+	Seq        int               `json:"seq,omitempty" yaml:"seq,omitempty"`
+	Reused     bool              `json:"reused" yaml:"reused"`
+	WasIdle    bool              `json:"was_idle" yaml:"was_idle"`
+	IdleTime   float64           `json:"idle_ms" yaml:"idle_ms"`
+	DNS        int64             `json:"-" yaml:"-"`
+	TCP        int64             `json:"-" yaml:"-"`
+	TLS        int64             `json:"-" yaml:"-"`
+	Process    int64             `json:"-" yaml:"-"`
+	Transfer   int64             `json:"-" yaml:"-"`
+	Total      int64             `json:"-" yaml:"-"`
+	Timings    HTTPTimings       `json:"timings" yaml:"timings"`
+	Redirects  int               `json:"redirects" yaml:"redirects"`
+	Hops       []HTTPHop         `json:"hops" yaml:"hops"`
+	// connectIP pins the connection to an address of the host, nil resolves the host
+	connectIP net.IP
+	// request and expect are the request options and response assertions, nil sends a bare GET
+	// and accepts every response
+	request *HTTPRequest
+	expect  *HTTPExpect
+	// client is shared by repeated requests to reuse their connections, nil creates a new one
+	client *http.Client
+}
+
+// HTTPHop is a single request of a redirect chain, Flags marks a redirect to plain HTTP, to another
+// host or back to an URL of the chain
+type HTTPHop struct {
+	URL      string      `json:"url" yaml:"url"`
+	Method   string      `json:"method" yaml:"method"`
+	Status   int         `json:"status" yaml:"status"`
+	Location string      `json:"location,omitempty" yaml:"location,omitempty"`
+	Remote   string      `json:"remote,omitempty" yaml:"remote,omitempty"`
+	Reused   bool        `json:"reused" yaml:"reused"`
+	WasIdle  bool        `json:"was_idle" yaml:"was_idle"`
+	IdleTime float64     `json:"idle_ms" yaml:"idle_ms"`
+	Flags    []string    `json:"flags,omitempty" yaml:"flags,omitempty"`
+	Timings  HTTPTimings `json:"timings" yaml:"timings"`
+}
+
+// HTTPTimings contains the durations of the request phases in milliseconds
+type HTTPTimings struct {
+	DNS      float64 `json:"dns_ms" yaml:"dns_ms"`
+	TCP      float64 `json:"tcp_ms" yaml:"tcp_ms"`
+	TLS      float64 `json:"tls_ms" yaml:"tls_ms"`
+	Process  float64 `json:"process_ms" yaml:"process_ms"`
+	Transfer float64 `json:"transfer_ms" yaml:"transfer_ms"`
+	Total    float64 `json:"total_ms" yaml:"total_ms"`
 }
 
 var (
 	httpCmd = &cobra.Command{
-		Use:          "http",
+		Use:          "http [url ...]",
 		Short:        "Run httptrace to the target",
 		Long:         ``,
 		RunE:         runHTTPPing,
@@ -44,30 +106,85 @@ const schemeHTTPS = "https"
 
 func init() {
 	httpCmd.Flags().StringVarP(&queryAddress, "address", "a", "", "URL to query")
+	httpCmd.Flags().StringVarP(&httpMethod, "method", "X", "", "request method, default GET or POST with a body")
+	httpCmd.Flags().StringArrayVarP(&httpHeaders, "header", "H", nil, "request header 'Name: value', can be repeated")
+	httpCmd.Flags().StringVarP(&httpData, "data", "d", "", "request body")
+	httpCmd.Flags().StringVar(&httpDataFile, "data-file", "", "file with the request body")
+	httpCmd.Flags().StringVar(&httpExpectStatus, "expect-status", "", "expected status codes like 200-299,301")
+	httpCmd.Flags().StringVar(&httpExpectBody, "expect-body", "", "regular expression the response body must match")
+	httpCmd.Flags().StringArrayVar(&httpExpectJSON, "expect-json", nil, "expected JSON value path=value like data.items.0.state=up, can be repeated")
+	httpCmd.Flags().StringArrayVar(&httpResolve, "resolve", nil, "resolve host:port to the addresses host:port:addr[,addr], can be repeated")
+	httpCmd.Flags().StringArrayVar(&httpConnectTo, "connect-to", nil, "connect to host2:port2 instead of host1:port1 with host1:port1:host2:port2, empty parts match all, can be repeated")
+	httpCmd.Flags().IntVar(&httpMaxRedirects, "max-redirects", 10, "maximum number of redirects to follow")
+	httpCmd.Flags().BoolVar(&httpNoFollow, "no-follow", false, "do not follow redirects")
+	httpCmd.Flags().IntVarP(&pingCount, "count", "c", pingCount, "number of requests per URL on a reused connection, 0 runs until interrupted")
+	httpCmd.Flags().Float64VarP(&pingInterval, "interval", "i", pingInterval, "interval between requests in sec")
+	httpCmd.Flags().BoolVar(&httpAllIPs, "all-ips", false, "trace the URL on every address of the host and compare the responses")
+	addTargetFlags(httpCmd)
 	RootCmd.AddCommand(httpCmd)
 }
 
 func runHTTPPing(_ *cobra.Command, args []string) error {
-	if len(args) > 0 {
-		queryAddress = args[0]
+	if err := checkPingLoopFlags(); err != nil {
+		return err
 	}
-	if queryAddress == "" {
+	targets, err := collectTargets(args)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
 		return fmt.Errorf("please specify an URL to query")
 	}
-	h := new(HTTPing)
-	err := h.Run(queryAddress)
+	request, err := httpRequestFromFlags()
+	if err != nil {
+		return err
+	}
+	expect, err := httpExpectFromFlags()
 	if err != nil {
-		log.Debugf("HTTPing failed: %v", err)
 		return err
 	}
-	h.Log()
+	if err = parseHTTPOverrides(); err != nil {
+		return err
+	}
+	if httpAllIPs {
+		if pingCount != 1 {
+			return fmt.Errorf("--count is not supported with --all-ips")
+		}
+		if relayHost() != "" {
+			return fmt.Errorf("--all-ips needs direct connections, --proxy and --ssh-jump are not supported")
+		}
+		err = runTargets("http", targets, func(j *targetJob) {
+			runHTTPMembers(j, request, expect)
+		})
+		log.Debugf("HTTPing done")
+		return err
+	}
+	if pingCount != 1 {
+		runHTTPPingLoop(targets, request, expect)
+		log.Debugf("HTTPing done")
+		return nil
+	}
+	err = runTargets("http", targets, func(j *targetJob) {
+		h := &HTTPing{request: request, expect: expect}
+		if e := h.Run(j.target); e != nil {
+			log.Debugf("HTTPing failed: %v", e)
+			j.err = e
+			return
+		}
+		j.emit(h.Record(), h.Log)
+	})
 	log.Debugf("HTTPing done")
-	return nil
+	return err
 }
 
 // Run New sends an HTTP request to a given address and returns the time it took to get a reply
 func (h *HTTPing) Run(address string) (err error) {
-	var t0, t1, t2, t3, t4, t5, t6, t7 int64
+	return h.RunContext(context.Background(), address)
+}
+
+// RunContext is like Run but aborts the request when ctx is done. Redirects are followed hop by hop,
+// the phase durations are summed over all hops and the other values belong to the last response.
+func (h *HTTPing) RunContext(ctx context.Context, address string) (err error) {
 	log.Debugf("HTTPing started for %s", address)
 	// check if is address really an URL, if not add https://
 	if !strings.Contains(address, "://") {
@@ -83,9 +200,120 @@ func (h *HTTPing) Run(address string) (err error) {
 	default:
 		return fmt.Errorf("invalid scheme in URL %s, only http and https allowed", address)
 	}
+	first, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+
+	h.Method = http.MethodGet
+	var payload []byte
+	if h.request != nil {
+		h.Method = h.request.Method
+		payload = h.request.Body
+	}
+	if h.client == nil {
+		h.client = h.newClient(first.Hostname())
+	}
+	h.Hops = nil
+	h.DNS, h.TCP, h.TLS, h.Process, h.Transfer, h.Total = 0, 0, 0, 0, 0, 0
+	method, target := h.Method, first
+	seen := map[string]bool{}
+	var failed string
+	var body []byte
+	for {
+		var hop *HTTPHop
+		var location *url.URL
+		hop, location, body, err = h.doHop(ctx, h.client, method, target, payload, target.Host == first.Host)
+		if err != nil {
+			return err
+		}
+		h.Hops = append(h.Hops, *hop)
+		seen[target.String()] = true
+		if location == nil || httpNoFollow {
+			break
+		}
+		last := &h.Hops[len(h.Hops)-1]
+		last.Flags = hopFlags(target, location)
+		if seen[location.String()] {
+			last.Flags = append(last.Flags, hopLoop)
+			failed = "redirect loop to " + location.String()
+			break
+		}
+		if len(h.Hops) > httpMaxRedirects {
+			failed = fmt.Sprintf("stopped after %d redirects", httpMaxRedirects)
+			break
+		}
+		var resend bool
+		if method, resend = redirectMethod(hop.Status, method); !resend {
+			payload = nil
+		}
+		target = location
+	}
+	h.Redirects = len(h.Hops) - 1
+	h.Reused, h.WasIdle, h.IdleTime = h.Hops[0].Reused, h.Hops[0].WasIdle, h.Hops[0].IdleTime
+	h.Verdict = verdictPass
+	h.Assertions = h.expect.check(h.Status, body)
+	if failed != "" {
+		h.Assertions = append([]AssertionResult{{Assertion: "redirects", Detail: failed}}, h.Assertions...)
+	}
+	for _, a := range h.Assertions {
+		if !a.Pass {
+			h.Verdict = verdictFail
+		}
+	}
 
-	// create a new HTTP request
-	req, _ := http.NewRequest("GET", address, nil)
+	// Detect system proxies
+	pc := httpproxy.FromEnvironment()
+	if relayHost() != "" {
+		log.Debugf("HTTPing uses %s", relayHost())
+		h.Proxy = true
+	} else if pc.HTTPProxy != "" {
+		log.Debugf("HTTPing detected proxy %s", pc.HTTPProxy)
+		h.Proxy = true
+	}
+	return nil
+}
+
+// newClient returns the HTTP client of the trace, redirects are followed by RunContext
+func (h *HTTPing) newClient(host string) *http.Client {
+	tr := newTransport(0)
+	if h.connectIP != nil {
+		tr.Proxy = nil
+		tr.DialContext = pinnedDialContext(h.connectIP, host)
+	}
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: tr,
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// doHop sends a single request and returns its timings, the redirect location of a 3xx response and the
+// part of the body kept for the assertions. The headers of the request options are sent to the first host only.
+func (h *HTTPing) doHop(ctx context.Context, c *http.Client, method string, target *url.URL, payload []byte, firstHost bool) (*HTTPHop, *url.URL, []byte, error) {
+	var t0, t1, t2, t3, t4, t5, t6, t7 int64
+	var dnsErr error
+	var conn httptrace.GotConnInfo
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid request: %w", err)
+	}
+	if h.request != nil {
+		for k, v := range h.request.Header {
+			if firstHost || !sensitiveHeaders[k] {
+				req.Header[k] = v
+			}
+		}
+		if host := req.Header.Get("Host"); host != "" && firstHost {
+			req.Host = host
+		}
+	}
 	// create a new HTTP trace definition
 	trace := &httptrace.ClientTrace{
 		DNSStart: func(_ httptrace.DNSStartInfo) {
@@ -94,11 +322,16 @@ func (h *HTTPing) Run(address string) (err error) {
 		DNSDone: func(info httptrace.DNSDoneInfo) {
 			t1 = time.Now().UnixNano()
 			if info.Err != nil {
-				err = info.Err
+				dnsErr = info.Err
 				log.Warn(info.Err)
 			}
 		},
 		ConnectStart: func(_, _ string) {
+			// connections to an IP or a --resolve address are not resolved
+			if t0 == 0 {
+				t0 = time.Now().UnixNano()
+				t1 = t0
+			}
 		},
 		ConnectDone: func(_, addr string, err error) {
 			if err != nil {
@@ -106,8 +339,11 @@ func (h *HTTPing) Run(address string) (err error) {
 			}
 			t2 = time.Now().UnixNano()
 		},
-		GotConn: func(_ httptrace.GotConnInfo) {
+		GotConn: func(info httptrace.GotConnInfo) {
 			t3 = time.Now().UnixNano()
+			conn = info
+			h.Source = localSource(info.Conn)
+			h.Remote = info.Conn.RemoteAddr().String()
 		},
 		GotFirstResponseByte: func() {
 			t4 = time.Now().UnixNano()
@@ -121,43 +357,135 @@ func (h *HTTPing) Run(address string) (err error) {
 	}
 	// add the trace and run the request
 	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
-	c := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-	log.Debugf("HTTPing do request")
-	_, err = c.Do(req)
+	log.Debugf("HTTPing do request %s %s", method, target)
+	start := time.Now().UnixNano()
+	resp, err := c.Do(req)
 	if err != nil {
 		match, _ := regexp.MatchString("Client.Timeout exceeded", err.Error())
 		if match {
 			err = fmt.Errorf("HTTP connection timeout")
 		}
+		if dnsErr != nil {
+			log.Debugf("HTTPing DNS lookup failed: %v", dnsErr)
+		}
 		err = fmt.Errorf("HTTP Client returned '%s'", err)
 		log.Debugf("HTTPing failed: %v", err)
-		return
+		return nil, nil, nil, err
+	}
+	h.Status = resp.StatusCode
+	h.StatusLine = resp.Proto + " " + resp.Status
+	h.Server = resp.Header.Get("Server")
+	h.CertSerial = ""
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		h.CertSerial = resp.TLS.PeerCertificates[0].SerialNumber.Text(16)
+	}
+	// read the body to measure the transfer and allow the connection to be reused,
+	// it is only kept for the body assertions
+	buf := &limitedBuffer{}
+	if h.expect.needsBody() {
+		buf.max = httpMaxBody
 	}
-	log.Debugf("HTTPing create Statistics")
-	// create statistics
+	hash := sha256.New()
+	_, _ = io.Copy(io.MultiWriter(buf, hash), resp.Body)
+	_ = resp.Body.Close()
+	h.Size = buf.n
+	h.BodyHash = hex.EncodeToString(hash.Sum(nil))
 	t7 = time.Now().UnixNano()
 
+	// a reused connection has no DNS and connect phase
 	if t0 == 0 {
-		t0 = t2
-		t1 = t2
+		t0, t1 = start, start
+	}
+	if t2 == 0 {
+		t2 = t1
+	}
+	if t3 == 0 {
+		t3 = t2
+	}
+	hop := &HTTPHop{URL: target.String(), Method: method, Status: resp.StatusCode, Remote: h.Remote,
+		Reused: conn.Reused, WasIdle: conn.WasIdle, IdleTime: float64(conn.IdleTime) / 1e6}
+	hop.Timings = HTTPTimings{
+		DNS:      float64(t1-t0) / 1e6,
+		TCP:      float64(t2-t1) / 1e6,
+		TLS:      float64(t6-t5) / 1e6,
+		Process:  float64(t4-t3) / 1e6,
+		Transfer: float64(t7-t4) / 1e6,
+		Total:    float64(t7-t0) / 1e6,
 	}
+	h.DNS += t1 - t0
+	h.TCP += t2 - t1
+	h.TLS += t6 - t5
+	h.Process += t4 - t3
+	h.Transfer += t7 - t4
+	h.Total += t7 - t0
+	log.Debugf("HTTPing hop %s status %d reused %t total %.1f ms", hop.URL, hop.Status, hop.Reused, hop.Timings.Total)
 
-	h.DNS = t1 - t0
-	h.TCP = t2 - t1
-	h.Process = t4 - t3
-	h.Transfer = t7 - t4
-	h.TLS = t6 - t5
-	h.Total = t7 - t0
+	var location *url.URL
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if location, err = resp.Location(); err == nil {
+			hop.Location = location.String()
+		} else {
+			location = nil
+		}
+	}
+	return hop, location, buf.Bytes(), nil
+}
 
-	// Detect system proxies
-	pc := httpproxy.FromEnvironment()
-	if pc.HTTPProxy != "" {
-		log.Debugf("HTTPing detected proxy %s", pc.HTTPProxy)
-		h.Proxy = true
+// pinnedDialContext returns a dial function connecting to ip instead of host, the port of a --connect-to
+// rule is honored. Other hosts of a redirect chain are resolved.
+func pinnedDialContext(ip net.IP, host string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := newDialer(0)
+	resolving := httpDialContext(0)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		h, port, err := net.SplitHostPort(connectTo(addr))
+		if err != nil {
+			return nil, err
+		}
+		if a, _, _ := net.SplitHostPort(addr); !strings.EqualFold(a, host) {
+			log.Debugf("connect to %s is not pinned to %s", h, ip)
+			return resolving(ctx, network, addr)
+		}
+		return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	}
+}
+
+// Record returns the serializable result of the trace
+func (h *HTTPing) Record() Result {
+	host, port, err := common.GetHostPort(h.URL)
+	status := "OK"
+	if err != nil {
+		status = "ERROR"
+	} else if h.Verdict == verdictFail {
+		status = verdictFail
+		err = errors.New(h.failedAssertions())
+	}
+	h.Host = host
+	h.Port = port
+	h.Timings = h.phaseTimings()
+	return newResult("http", h.URL, status, err, h)
+}
+
+// failedAssertions describes the failed assertions
+func (h *HTTPing) failedAssertions() string {
+	var list []string
+	for _, a := range h.Assertions {
+		if !a.Pass {
+			list = append(list, a.Assertion+": "+a.Detail)
+		}
+	}
+	return strings.Join(list, "; ")
+}
+
+// phaseTimings converts the nanosecond phase durations to milliseconds
+func (h *HTTPing) phaseTimings() HTTPTimings {
+	return HTTPTimings{
+		DNS:      float64(h.DNS) / 1e6,
+		TCP:      float64(h.TCP) / 1e6,
+		TLS:      float64(h.TLS) / 1e6,
+		Process:  float64(h.Process) / 1e6,
+		Transfer: float64(h.Transfer) / 1e6,
+		Total:    float64(h.Total) / 1e6,
 	}
-	return
 }
 
 // Log logs the httping results
@@ -170,6 +498,18 @@ func (h *HTTPing) Log() {
 		fmt.Printf("%s:    %s\n", cyan("%-10s", "Scheme"), h.Scheme)
 		fmt.Printf("%s:    %s\n", cyan("%-10s", "Host"), host)
 		fmt.Printf("%s:    %d\n", cyan("%-10s", "Port"), port)
+		if h.Remote != "" && !h.Proxy {
+			fmt.Printf("%s:    %s\n", cyan("%-10s", "Remote"), h.Remote)
+		}
+		fmt.Printf("%s:    %s\n", cyan("%-10s", "Method"), h.Method)
+		fmt.Printf("%s:    %s\n", cyan("%-10s", "Status"), h.StatusLine)
+		if h.Server != "" {
+			fmt.Printf("%s:    %s\n", cyan("%-10s", "Server"), h.Server)
+		}
+		fmt.Printf("%s:    %d bytes\n", cyan("%-10s", "Size"), h.Size)
+		if sourceSet() && h.Source != "" {
+			fmt.Printf("%s:    %s\n", cyan("%-10s", "Source"), h.Source)
+		}
 		fmt.Printf("%s:    %.2f ms\n", cyan("%-10s", "DNS Lookup"), float64(h.DNS)/1e6)
 		fmt.Printf("%s:    %.2f ms\n", cyan("%-10s", "TCP"), float64(h.TCP)/1e6)
 		if h.Scheme == "https" {
@@ -178,9 +518,25 @@ func (h *HTTPing) Log() {
 		fmt.Printf("%s:    %.2f ms\n", cyan("%-10s", "Process"), float64(h.Process)/1e6)
 		fmt.Printf("%s:    %.2f ms\n", cyan("%-10s", "Transfer"), float64(h.Transfer)/1e6)
 		fmt.Printf("%s:    %.2f ms\n", cyan("%-10s", "Total"), float64(h.Total)/1e6)
+		h.logHops()
+		h.logVerdict()
 		log.Debugf("result HTTPing for %s: OK", h.URL)
 		return
 	}
 	fmt.Printf("%s%s%s\n", cyan("%-7s", "HTTP"), red(" %s: ", "ERROR"), err)
 	log.Debugf("result HTTPing for %s: ERROR (%v)", h.URL, err)
 }
+
+// logVerdict prints the verdict and the failed assertions
+func (h *HTTPing) logVerdict() {
+	if h.Verdict == verdictFail {
+		fmt.Printf("%s:    %s\n", cyan("%-10s", "Verdict"), red("%s", verdictFail))
+		for _, a := range h.Assertions {
+			if !a.Pass {
+				fmt.Printf("%-10s     %s: %s\n", "", a.Assertion, a.Detail)
+			}
+		}
+		return
+	}
+	fmt.Printf("%s:    %s\n", cyan("%-10s", "Verdict"), green("%s", verdictPass))
+}
@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// httpMaxBody limits the part of the response body kept for the body and JSON assertions
+const httpMaxBody = 10 << 20
+
+// http verdicts
+const (
+	verdictPass = "PASS"
+	verdictFail = "FAIL"
+)
+
+var (
+	httpMethod       string
+	httpHeaders      []string
+	httpData         string
+	httpDataFile     string
+	httpExpectStatus string
+	httpExpectBody   string
+	httpExpectJSON   []string
+)
+
+// HTTPRequest is the request sent by a probe, the zero value sends a bare GET
+type HTTPRequest struct {
+	Method string
+	Header http.Header
+	Body   []byte
+}
+
+// HTTPExpect holds the assertions on the response, the zero value accepts every response
+type HTTPExpect struct {
+	Status [][2]int
+	Body   *regexp.Regexp
+	JSON   []jsonAssertion
+
+	statusText string
+}
+
+type jsonAssertion struct {
+	path  string
+	value string
+}
+
+// AssertionResult is the outcome of an assertion on the response
+type AssertionResult struct {
+	Assertion string `json:"assertion" yaml:"assertion"`
+	Pass      bool   `json:"pass" yaml:"pass"`
+	Detail    string `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+// httpRequestFromFlags builds the request of --method, --header, --data and --data-file.
+// A body without --method is sent as POST.
+func httpRequestFromFlags() (*HTTPRequest, error) {
+	r := &HTTPRequest{Method: strings.ToUpper(httpMethod), Header: http.Header{}}
+	for _, h := range httpHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, use 'Name: value'", h)
+		}
+		r.Header.Add(name, strings.TrimSpace(value))
+	}
+	switch {
+	case httpData != "" && httpDataFile != "":
+		return nil, errors.New("--data and --data-file can not be combined")
+	case httpData != "":
+		r.Body = []byte(httpData)
+	case httpDataFile != "":
+		b, err := os.ReadFile(httpDataFile)
+		if err != nil {
+			return nil, fmt.Errorf("read data file: %w", err)
+		}
+		r.Body = b
+	}
+	if r.Method == "" {
+		r.Method = http.MethodGet
+		if r.Body != nil {
+			r.Method = http.MethodPost
+		}
+	}
+	return r, nil
+}
+
+// httpExpectFromFlags parses --expect-status, --expect-body and --expect-json
+func httpExpectFromFlags() (*HTTPExpect, error) {
+	e := new(HTTPExpect)
+	var err error
+	if httpExpectStatus != "" {
+		if e.Status, err = parseStatusRanges(httpExpectStatus); err != nil {
+			return nil, err
+		}
+		e.statusText = httpExpectStatus
+	}
+	if httpExpectBody != "" {
+		if e.Body, err = regexp.Compile("(?m)" + httpExpectBody); err != nil {
+			return nil, fmt.Errorf("invalid --expect-body: %w", err)
+		}
+	}
+	for _, j := range httpExpectJSON {
+		path, value, ok := strings.Cut(j, "=")
+		path = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(path), "$"), ".")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid --expect-json %q, use path=value", j)
+		}
+		e.JSON = append(e.JSON, jsonAssertion{path: path, value: value})
+	}
+	return e, nil
+}
+
+// parseStatusRanges parses a list of status codes and ranges like 200-299,301
+func parseStatusRanges(s string) ([][2]int, error) {
+	var list [][2]int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			hi = lo
+		}
+		a, err1 := strconv.Atoi(lo)
+		b, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || a < 100 || b > 599 || a > b {
+			return nil, fmt.Errorf("invalid status range %q, use a list like 200-299,301", part)
+		}
+		list = append(list, [2]int{a, b})
+	}
+	return list, nil
+}
+
+// needsBody reports whether an assertion inspects the response body
+func (e *HTTPExpect) needsBody() bool {
+	return e != nil && (e.Body != nil || len(e.JSON) > 0)
+}
+
+// check runs the assertions on the status code and the body
+func (e *HTTPExpect) check(status int, body []byte) []AssertionResult {
+	if e == nil {
+		return nil
+	}
+	var list []AssertionResult
+	if len(e.Status) > 0 {
+		r := AssertionResult{Assertion: "status " + e.statusText}
+		for _, s := range e.Status {
+			r.Pass = r.Pass || (status >= s[0] && status <= s[1])
+		}
+		if !r.Pass {
+			r.Detail = fmt.Sprintf("got %d", status)
+		}
+		list = append(list, r)
+	}
+	if e.Body != nil {
+		r := AssertionResult{Assertion: "body " + strings.TrimPrefix(e.Body.String(), "(?m)"), Pass: e.Body.Match(body)}
+		if !r.Pass {
+			r.Detail = "no match"
+		}
+		list = append(list, r)
+	}
+	if len(e.JSON) == 0 {
+		return list
+	}
+	var doc any
+	jsonErr := json.Unmarshal(body, &doc)
+	for _, j := range e.JSON {
+		r := AssertionResult{Assertion: "json " + j.path + "=" + j.value}
+		switch v, err := jsonPath(doc, j.path); {
+		case jsonErr != nil:
+			r.Detail = "invalid JSON: " + jsonErr.Error()
+		case err != nil:
+			r.Detail = err.Error()
+		default:
+			r.Pass = v == j.value
+			if !r.Pass {
+				r.Detail = "got " + v
+			}
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+// jsonPath returns the value at a dotted path like data.items.0.name as text: strings unquoted,
+// numbers, booleans and null as in JSON and objects and arrays as compact JSON
+func jsonPath(doc any, path string) (string, error) {
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[key]
+			if !ok {
+				return "", fmt.Errorf("%s not found", key)
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("index %s not found", key)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("%s not found", key)
+		}
+	}
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64), nil
+	}
+	b, err := json.Marshal(v)
+	return string(bytes.TrimSpace(b)), err
+}
+
+// limitedBuffer keeps the first max bytes written and counts all
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+	n   int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	if room := b.max - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// Bytes returns the kept part of the data
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
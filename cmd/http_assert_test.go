@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func resetHTTPFlags(t *testing.T) {
+	t.Cleanup(func() {
+		httpMethod = ""
+		httpHeaders = nil
+		httpData = ""
+		httpDataFile = ""
+		httpExpectStatus = ""
+		httpExpectBody = ""
+		httpExpectJSON = nil
+	})
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	r, err := parseStatusRanges("200-299, 301,404")
+	require.NoError(t, err)
+	assert.Equal(t, [][2]int{{200, 299}, {301, 301}, {404, 404}}, r)
+	for _, s := range []string{"", "2xx", "299-200", "99", "200-600"} {
+		_, err = parseStatusRanges(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	var doc any = map[string]any{
+		"status": "up",
+		"data": map[string]any{
+			"items": []any{map[string]any{"n": 3.0, "ok": true, "tags": []any{"a"}}},
+			"none":  nil,
+		},
+	}
+	for path, want := range map[string]string{
+		"status":            "up",
+		"data.items.0.n":    "3",
+		"data.items.0.ok":   "true",
+		"data.items.0.tags": `["a"]`,
+		"data.none":         "null",
+	} {
+		v, err := jsonPath(doc, path)
+		require.NoError(t, err, path)
+		assert.Equal(t, want, v, path)
+	}
+	for _, path := range []string{"missing", "data.items.1", "data.items.x", "status.len"} {
+		_, err := jsonPath(doc, path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestHTTPRequestFromFlags(t *testing.T) {
+	resetHTTPFlags(t)
+	r, err := httpRequestFromFlags()
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodGet, r.Method)
+	assert.Nil(t, r.Body)
+
+	httpHeaders = []string{"Content-Type: application/json", "X-Trace:  abc "}
+	httpDataFile = filepath.Join(t.TempDir(), "body.json")
+	require.NoError(t, os.WriteFile(httpDataFile, []byte(`{"a":1}`), 0600))
+	r, err = httpRequestFromFlags()
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodPost, r.Method, "a body is posted by default")
+	assert.Equal(t, "abc", r.Header.Get("X-Trace"))
+	assert.Equal(t, []byte(`{"a":1}`), r.Body)
+
+	httpMethod = "put"
+	r, err = httpRequestFromFlags()
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodPut, r.Method)
+
+	httpData = "x"
+	_, err = httpRequestFromFlags()
+	assert.ErrorContains(t, err, "can not be combined")
+	httpData, httpHeaders = "", []string{"no colon"}
+	_, err = httpRequestFromFlags()
+	assert.ErrorContains(t, err, "invalid header")
+}
+
+func TestHTTPExpectCheck(t *testing.T) {
+	resetHTTPFlags(t)
+	e, err := httpExpectFromFlags()
+	require.NoError(t, err)
+	assert.Empty(t, e.check(500, nil), "no assertions accept every response")
+	assert.False(t, e.needsBody())
+
+	httpExpectStatus = "200-299"
+	httpExpectBody = `^"state"`
+	httpExpectJSON = []string{"$.state=up", "count=2"}
+	e, err = httpExpectFromFlags()
+	require.NoError(t, err)
+	assert.True(t, e.needsBody())
+	list := e.check(200, []byte("{\n\"state\": \"up\", \"count\": 3}"))
+	require.Len(t, list, 4)
+	assert.True(t, list[0].Pass)
+	assert.True(t, list[1].Pass, "^ matches at line start")
+	assert.True(t, list[2].Pass)
+	assert.False(t, list[3].Pass)
+	assert.Equal(t, "got 3", list[3].Detail)
+
+	list = e.check(503, []byte("<html>"))
+	assert.Equal(t, "got 503", list[0].Detail)
+	assert.Contains(t, list[2].Detail, "invalid JSON")
+
+	httpExpectJSON = []string{"state"}
+	_, err = httpExpectFromFlags()
+	assert.Error(t, err)
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// httpPhases are the phases of the HTTP statistics in output order
+var httpPhases = []string{"dns", "tcp", "tls", "process", "transfer", "total"}
+
+// HTTPStats collects the phase durations and the connection reuse of repeated requests to one URL.
+// The total of requests on a new connection (cold) and on a reused connection (warm) is kept apart.
+type HTTPStats struct {
+	URL        string
+	Reused     int
+	Reconnects int
+	phases     map[string]*PingStats
+	cold, warm *PingStats
+}
+
+// HTTPStatsSummary is the serializable summary of repeated requests, durations are in milliseconds
+type HTTPStatsSummary struct {
+	URL            string             `json:"url" yaml:"url"`
+	Sent           int                `json:"sent" yaml:"sent"`
+	OK             int                `json:"ok" yaml:"ok"`
+	Failed         int                `json:"failed" yaml:"failed"`
+	Loss           float64            `json:"loss_pct" yaml:"loss_pct"`
+	NewConnections int                `json:"new_connections" yaml:"new_connections"`
+	Reused         int                `json:"reused" yaml:"reused"`
+	Reconnects     int                `json:"reconnects" yaml:"reconnects"`
+	Phases         []HTTPPhaseSummary `json:"phases" yaml:"phases"`
+	Cold           *HTTPPhaseSummary  `json:"cold,omitempty" yaml:"cold,omitempty"`
+	Warm           *HTTPPhaseSummary  `json:"warm,omitempty" yaml:"warm,omitempty"`
+}
+
+// HTTPPhaseSummary is the statistics of one phase
+type HTTPPhaseSummary struct {
+	Phase string  `json:"phase" yaml:"phase"`
+	Min   float64 `json:"min_ms" yaml:"min_ms"`
+	Avg   float64 `json:"avg_ms" yaml:"avg_ms"`
+	P95   float64 `json:"p95_ms" yaml:"p95_ms"`
+	Max   float64 `json:"max_ms" yaml:"max_ms"`
+}
+
+// NewHTTPStats returns an empty statistics record for the given URL
+func NewHTTPStats(url string) *HTTPStats {
+	s := &HTTPStats{URL: url, phases: map[string]*PingStats{}, cold: NewPingStats(url), warm: NewPingStats(url)}
+	for _, p := range httpPhases {
+		s.phases[p] = NewPingStats(url)
+	}
+	return s
+}
+
+// Add records a request. A new connection after a request was answered means the keep-alive connection was
+// closed by the server, a load balancer or a proxy in between.
+func (s *HTTPStats) Add(h *HTTPing, err error) {
+	if err != nil {
+		for _, p := range s.phases {
+			p.Add(0, false)
+		}
+		return
+	}
+	total := time.Duration(h.Total)
+	switch {
+	case h.Reused:
+		s.Reused++
+		s.warm.Add(total, true)
+	default:
+		if s.phases["total"].OK > 0 {
+			s.Reconnects++
+		}
+		s.cold.Add(total, true)
+	}
+	for p, d := range map[string]int64{"dns": h.DNS, "tcp": h.TCP, "tls": h.TLS, "process": h.Process,
+		"transfer": h.Transfer, "total": h.Total} {
+		s.phases[p].Add(time.Duration(d), true)
+	}
+}
+
+// phaseSummary returns the statistics of a phase or nil without samples
+func phaseSummary(phase string, s *PingStats) *HTTPPhaseSummary {
+	if s.OK == 0 {
+		return nil
+	}
+	return &HTTPPhaseSummary{Phase: phase, Min: durationMS(s.Min()), Avg: durationMS(s.Avg()),
+		P95: durationMS(s.Percentile(95)), Max: durationMS(s.Max())}
+}
+
+// Summary returns the computed values of the statistics record
+func (s *HTTPStats) Summary() HTTPStatsSummary {
+	total := s.phases["total"]
+	sum := HTTPStatsSummary{
+		URL:            s.URL,
+		Sent:           total.Sent,
+		OK:             total.OK,
+		Failed:         total.Failed,
+		Loss:           total.Loss(),
+		NewConnections: total.OK - s.Reused,
+		Reused:         s.Reused,
+		Reconnects:     s.Reconnects,
+		Cold:           phaseSummary("total cold", s.cold),
+		Warm:           phaseSummary("total warm", s.warm),
+	}
+	for _, p := range httpPhases {
+		if ps := phaseSummary(p, s.phases[p]); ps != nil {
+			sum.Phases = append(sum.Phases, *ps)
+		}
+	}
+	return sum
+}
+
+// Record returns the summary as serializable result
+func (s *HTTPStats) Record() Result {
+	return newResult("http", s.URL, "STATS", nil, s.Summary())
+}
+
+// Log prints the summary with a row per phase and the totals of cold and warm requests
+func (s *HTTPStats) Log() {
+	sum := s.Summary()
+	log.Debugf("statistics for %s: sent %d ok %d reused %d reconnects %d", s.URL, sum.Sent, sum.OK, sum.Reused, sum.Reconnects)
+	lossFn := green
+	switch {
+	case sum.OK == 0:
+		lossFn = red
+	case sum.Failed > 0:
+		lossFn = yellow
+	}
+	fmt.Printf("%s%s%s\n", cyan("%-7s", "HTTP"), cyan("%-10s", "STATS"), s.URL)
+	fmt.Printf("       sent %d  ok %d  failed %d  %s\n", sum.Sent, sum.OK, sum.Failed, lossFn("loss %.1f%%", sum.Loss))
+	if sum.OK == 0 {
+		return
+	}
+	dropped := ""
+	if sum.Reconnects > 0 {
+		dropped = "  " + yellow("keep-alive dropped %d times", sum.Reconnects)
+	}
+	fmt.Printf("       connections %d new  %d reused%s\n", sum.NewConnections, sum.Reused, dropped)
+	fmt.Println("       " + cyan("%-12s%10s%10s%10s%10s", "PHASE ms", "MIN", "AVG", "P95", "MAX"))
+	rows := sum.Phases
+	for _, p := range []*HTTPPhaseSummary{sum.Cold, sum.Warm} {
+		if p != nil {
+			rows = append(rows, *p)
+		}
+	}
+	for _, p := range rows {
+		fmt.Printf("       %-12s%10.2f%10.2f%10.2f%10.2f\n", p.Phase, p.Min, p.Avg, p.P95, p.Max)
+	}
+}
+
+// LogRequest prints a line per request of a repeated trace
+func (h *HTTPing) LogRequest() {
+	conn := "new"
+	if h.Reused {
+		conn = fmt.Sprintf("reused idle %.1f ms", h.IdleTime)
+	}
+	statusFn := green
+	if h.Verdict == verdictFail {
+		statusFn = red
+	}
+	t := h.phaseTimings()
+	fmt.Printf("%s%s%-30s    seq %d  dns %.1f  tcp %.1f  tls %.1f  proc %.1f  xfer %.1f  total %.1f ms  %s\n",
+		cyan("%-7s", "HTTP"), statusFn("%-10d", h.Status), h.URL, h.Seq, t.DNS, t.TCP, t.TLS, t.Process, t.Transfer,
+		t.Total, conn)
+}
+
+// runHTTPPingLoop requests all URLs repeatedly, every URL keeps its client to reuse the connections.
+// The URLs of a round are requested with --parallel concurrent requests.
+// It stops after pingCount rounds or, if pingCount is 0, on interrupt and prints a summary per URL.
+func runHTTPPingLoop(urls []string, request *HTTPRequest, expect *HTTPExpect) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	interval := time.Duration(pingInterval * float64(time.Second))
+	stats := make([]*HTTPStats, len(urls))
+	last := make([]*HTTPing, len(urls))
+	for i, u := range urls {
+		stats[i] = NewHTTPStats(u)
+		last[i] = &HTTPing{}
+	}
+	log.Debugf("HTTPing loop with count %d interval %v", pingCount, interval)
+	for seq := 1; pingCount == 0 || seq <= pingCount; seq++ {
+		round := make([]*HTTPing, len(urls))
+		errs := make([]error, len(urls))
+		runParallel(len(urls), func(i int) {
+			h := &HTTPing{Seq: seq, request: request, expect: expect, client: last[i].client}
+			errs[i] = h.RunContext(ctx, urls[i])
+			round[i] = h
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		for i, h := range round {
+			err := errs[i]
+			stats[i].Add(h, err)
+			last[i] = h
+			if err != nil {
+				emit(newResult("http", urls[i], "ERROR", err, h), func() {
+					fmt.Printf("%s%s%-30s    seq %d  %s\n", cyan("%-7s", "HTTP"), red("%-10s", "ERROR"), urls[i], seq, err)
+				})
+				continue
+			}
+			emit(h.Record(), h.LogRequest)
+		}
+		if seq == pingCount {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+	if textOutput() {
+		fmt.Println()
+	}
+	for _, s := range stats {
+		emit(s.Record(), s.Log)
+	}
+}
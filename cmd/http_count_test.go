@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func TestHTTPStats(t *testing.T) {
+	ms := int64(time.Millisecond)
+	s := NewHTTPStats("https://www.example.com/")
+	s.Add(&HTTPing{TCP: 10 * ms, TLS: 20 * ms, Total: 50 * ms}, nil)
+	s.Add(&HTTPing{Reused: true, Total: 20 * ms}, nil)
+	s.Add(nil, errors.New("timeout"))
+	s.Add(&HTTPing{TCP: 12 * ms, TLS: 22 * ms, Total: 54 * ms}, nil)
+	s.Add(&HTTPing{Reused: true, Total: 22 * ms}, nil)
+
+	sum := s.Summary()
+	assert.Equal(t, 5, sum.Sent)
+	assert.Equal(t, 4, sum.OK)
+	assert.Equal(t, 1, sum.Failed)
+	assert.Equal(t, 2, sum.NewConnections)
+	assert.Equal(t, 2, sum.Reused)
+	assert.Equal(t, 1, sum.Reconnects, "the second new connection means the keep-alive connection was dropped")
+	require.Len(t, sum.Phases, len(httpPhases))
+	total := sum.Phases[len(sum.Phases)-1]
+	assert.Equal(t, "total", total.Phase)
+	assert.InDelta(t, 20.0, total.Min, 0.001)
+	assert.InDelta(t, 36.5, total.Avg, 0.001)
+	assert.InDelta(t, 54.0, total.P95, 0.001)
+	require.NotNil(t, sum.Cold)
+	require.NotNil(t, sum.Warm)
+	assert.InDelta(t, 52.0, sum.Cold.Avg, 0.001)
+	assert.InDelta(t, 21.0, sum.Warm.Avg, 0.001)
+	s.Log()
+
+	empty := NewHTTPStats("https://www.example.com/").Summary()
+	assert.Nil(t, empty.Cold)
+	assert.Empty(t, empty.Phases)
+}
+
+func TestHTTPCount(t *testing.T) {
+	resetTargets(t)
+	t.Cleanup(func() {
+		pingCount = 1
+		pingInterval = 1
+	})
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer web.Close()
+
+	t.Run("CMD HTTP count", func(t *testing.T) {
+		args := []string{
+			"http",
+			web.URL + "/",
+			"--count", "3",
+			"--interval", "0",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "HTTPing loop with count 3")
+		assert.Equal(t, 1, strings.Count(out, "status 200 reused false"), "first request opens the connection")
+		assert.Equal(t, 2, strings.Count(out, "status 200 reused true"), "later requests reuse it")
+		assert.Contains(t, out, "record http "+web.URL+"/ STATS")
+	})
+	t.Run("CMD HTTP count all-ips", func(t *testing.T) {
+		args := []string{
+			"http",
+			web.URL + "/",
+			"--all-ips",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "--count is not supported with --all-ips")
+	})
+	httpAllIPs = false
+}
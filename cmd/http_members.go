@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// httpDiffers is the record status of a member whose response differs from the majority
+const httpDiffers = "DIFFERS"
+
+var httpAllIPs bool
+
+// httpMember is the trace of a URL on one address of its host
+type httpMember struct {
+	h   *HTTPing
+	ip  string
+	err error
+}
+
+// runHTTPMembers traces the URL of a job on every address of its host in turn. The connections are
+// pinned to the address, the URL gives the Host header and the TLS server name.
+func runHTTPMembers(j *targetJob, request *HTTPRequest, expect *HTTPExpect) {
+	address := j.target
+	if !strings.Contains(address, "://") {
+		address = schemeHTTPS + "://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Hostname() == "" {
+		j.err = fmt.Errorf("invalid URL %s", j.target)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == schemeHTTP {
+			port = "80"
+		}
+	}
+	host, port, err := net.SplitHostPort(connectTo(net.JoinHostPort(u.Hostname(), port)))
+	if err != nil {
+		j.err = err
+		return
+	}
+	addrs, err := httpLookup(context.Background(), host, port)
+	if err != nil {
+		j.err = err
+		return
+	}
+	log.Debugf("HTTPing %s on %d addresses", address, len(addrs))
+	members := make([]*httpMember, len(addrs))
+	for i, a := range addrs {
+		m := &httpMember{ip: a, h: &HTTPing{request: request, expect: expect, connectIP: net.ParseIP(a)}}
+		m.h.Remote = net.JoinHostPort(a, port)
+		m.err = m.h.Run(address)
+		members[i] = m
+	}
+	compareMembers(members)
+	for i, m := range members {
+		text := func() {}
+		if i == 0 {
+			text = func() { logHTTPMembers(address, members) }
+		}
+		j.emit(m.record(), text)
+	}
+}
+
+// compareMembers marks the members whose status, server header, certificate or body differs
+// from the most common value, failed members differ in "error"
+func compareMembers(members []*httpMember) {
+	fields := []struct {
+		name  string
+		value func(h *HTTPing) string
+	}{
+		{"status", func(h *HTTPing) string { return strconv.Itoa(h.Status) }},
+		{"server", func(h *HTTPing) string { return h.Server }},
+		{"cert", func(h *HTTPing) string { return h.CertSerial }},
+		{"body", func(h *HTTPing) string { return h.BodyHash }},
+	}
+	var ok []*httpMember
+	for _, m := range members {
+		if m.err != nil {
+			m.h.Differs = []string{"error"}
+			continue
+		}
+		ok = append(ok, m)
+	}
+	if len(ok) < 2 {
+		return
+	}
+	for _, f := range fields {
+		count := map[string]int{}
+		common, best := "", 0
+		for _, m := range ok {
+			v := f.value(m.h)
+			count[v]++
+			if count[v] > best {
+				common, best = v, count[v]
+			}
+		}
+		for _, m := range ok {
+			if f.value(m.h) != common {
+				m.h.Differs = append(m.h.Differs, f.name)
+			}
+		}
+	}
+}
+
+// record returns the http record of a member, a member differing from the others is reported as DIFFERS
+func (m *httpMember) record() Result {
+	if m.err != nil {
+		m.h.Timings = m.h.phaseTimings()
+		return newResult("http", m.h.URL, "ERROR", m.err, m.h)
+	}
+	r := m.h.Record()
+	if r.Status == "OK" && len(m.h.Differs) > 0 {
+		r.Status = httpDiffers
+		r.Error = "differs in " + strings.Join(m.h.Differs, ", ")
+	}
+	return r
+}
+
+// logHTTPMembers prints a row per address, values differing from the other members are red
+func logHTTPMembers(address string, members []*httpMember) {
+	fmt.Printf("%s:    %s  (%d addresses)\n", cyan("%-10s", "URL"), address, len(members))
+	fmt.Println(cyan("%-28s%-8s%10s%10s%10s%10s%10s  %-20s%-18s%-14s%s", "ADDRESS", "STATUS", "TCP ms", "TLS ms",
+		"PROC ms", "XFER ms", "TOTAL ms", "SERVER", "CERT SERIAL", "BODY SHA256", "DIFF"))
+	for _, m := range members {
+		h := m.h
+		if m.err != nil {
+			fmt.Printf("%-28s%s%s\n", m.ip, red("%-8s", "ERROR"), m.err)
+			continue
+		}
+		differs := map[string]bool{}
+		for _, d := range h.Differs {
+			differs[d] = true
+		}
+		cell := func(field, format string, v any) string {
+			if differs[field] {
+				return red(format, v)
+			}
+			return fmt.Sprintf(format, v)
+		}
+		t := h.phaseTimings()
+		fmt.Printf("%-28s%s%10.1f%10.1f%10.1f%10.1f%10.1f  %s%s%s%s\n", m.ip, cell("status", "%-8d", h.Status),
+			t.TCP, t.TLS, t.Process, t.Transfer, t.Total, cell("server", "%-20s", shorten(h.Server, 19)),
+			cell("cert", "%-18s", shorten(h.CertSerial, 16)), cell("body", "%-14s", shorten(h.BodyHash, 12)),
+			red("%s", strings.Join(h.Differs, ",")))
+	}
+}
+
+// shorten cuts s to n characters
+func shorten(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func TestCompareMembers(t *testing.T) {
+	member := func(status int, server, body string) *httpMember {
+		return &httpMember{h: &HTTPing{URL: "http://www.example.test/", Status: status, Server: server, BodyHash: body}}
+	}
+	members := []*httpMember{
+		member(200, "nginx", "aa"),
+		member(200, "nginx", "aa"),
+		member(502, "nginx", "bb"),
+		member(200, "apache", "aa"),
+		{h: &HTTPing{}, err: errors.New("refused")},
+	}
+	compareMembers(members)
+	assert.Empty(t, members[0].h.Differs)
+	assert.Empty(t, members[1].h.Differs)
+	assert.Equal(t, []string{"status", "body"}, members[2].h.Differs)
+	assert.Equal(t, []string{"server"}, members[3].h.Differs)
+	assert.Equal(t, []string{"error"}, members[4].h.Differs)
+	assert.Equal(t, httpDiffers, members[2].record().Status)
+	assert.Equal(t, "ERROR", members[4].record().Status)
+
+	single := []*httpMember{member(500, "", "")}
+	compareMembers(single)
+	assert.Empty(t, single[0].h.Differs, "a single member has nothing to compare")
+}
+
+// serveLoopback runs handler on the loopback address ip and port or skips the test
+func serveLoopback(t *testing.T, ip string, port int, handler http.HandlerFunc) {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("loopback address %s not available: %v", ip, err)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: time.Second}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+}
+
+func TestHTTPAllIPs(t *testing.T) {
+	resetHTTPOverrides(t)
+	resetTargets(t)
+	t.Cleanup(func() { httpAllIPs = false })
+	hosts := map[string]string{}
+	node := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			hosts[body] = r.Host
+			w.Header().Set("Server", "web")
+			_, _ = io.WriteString(w, body)
+		}
+	}
+	port := freePort(t)
+	serveLoopback(t, "127.0.0.1", port, node("ok"))
+	serveLoopback(t, "127.0.0.2", port, node("ok"))
+	serveLoopback(t, "127.0.0.3", port, node("stale"))
+	url := fmt.Sprintf("http://www.example.test:%d/", port)
+
+	args := []string{
+		"http",
+		url,
+		"--all-ips",
+		"--resolve", fmt.Sprintf("www.example.test:%d:127.0.0.1,127.0.0.2,127.0.0.3", port),
+		"-o", "json",
+		flagUnitTest,
+		flagDebug,
+	}
+	out, err := common.CmdRun(RootCmd, args)
+	require.NoError(t, err)
+	t.Log(out)
+	assert.Contains(t, out, "HTTPing "+url+" on 3 addresses")
+	assert.Contains(t, out, "record http "+url+" OK")
+	assert.Contains(t, out, "record http "+url+" DIFFERS")
+	assert.Equal(t, fmt.Sprintf("www.example.test:%d", port), hosts["stale"], "Host header of the URL is sent to every member")
+}
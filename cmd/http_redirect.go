@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// flags of a redirect hop
+const (
+	hopDowngrade = "downgrade"
+	hopCrossHost = "cross-host"
+	hopLoop      = "loop"
+)
+
+var (
+	httpMaxRedirects = 10
+	httpNoFollow     bool
+)
+
+// sensitiveHeaders are not sent to other hosts of a redirect chain, like the HTTP client of Go does
+var sensitiveHeaders = map[string]bool{
+	"Authorization":    true,
+	"Www-Authenticate": true,
+	"Cookie":           true,
+	"Cookie2":          true,
+}
+
+// logHops prints a row per request of a redirect chain, downgrades and loops are red
+func (h *HTTPing) logHops() {
+	if len(h.Hops) == 1 {
+		if loc := h.Hops[0].Location; loc != "" {
+			fmt.Printf("%s:    %s\n", cyan("%-10s", "Location"), loc)
+		}
+		return
+	}
+	fmt.Printf("%s:    %d\n", cyan("%-10s", "Redirects"), h.Redirects)
+	fmt.Println(cyan("%-4s%-8s%-8s%10s%10s%10s%10s%10s%10s  %s", "HOP", "STATUS", "METHOD", "DNS ms", "TCP ms", "TLS ms",
+		"PROC ms", "XFER ms", "TOTAL ms", "URL"))
+	for i, hop := range h.Hops {
+		t := hop.Timings
+		fmt.Printf("%-4d%-8d%-8s%10.1f%10.1f%10.1f%10.1f%10.1f%10.1f  %s\n", i+1, hop.Status, hop.Method,
+			t.DNS, t.TCP, t.TLS, t.Process, t.Transfer, t.Total, hop.URL)
+		if hop.Location == "" {
+			continue
+		}
+		flags := ""
+		for _, f := range hop.Flags {
+			if f == hopCrossHost {
+				flags += "  " + yellow("%s", f)
+			} else {
+				flags += "  " + red("%s", f)
+			}
+		}
+		fmt.Printf("%-20s-> %s%s\n", "", hop.Location, flags)
+	}
+}
+
+// redirectMethod returns the method of the request following a redirect and whether the body is sent again.
+// Like browsers, 303 and a POST answered with 301 or 302 continue with GET, 307 and 308 repeat the request.
+func redirectMethod(status int, method string) (string, bool) {
+	switch {
+	case method == http.MethodHead:
+		return method, false
+	case status == http.StatusSeeOther,
+		(status == http.StatusMovedPermanently || status == http.StatusFound) && method == http.MethodPost:
+		return http.MethodGet, false
+	}
+	return method, true
+}
+
+// hopFlags returns the flags of a redirect from one URL to the next
+func hopFlags(from, to *url.URL) []string {
+	var flags []string
+	if from.Scheme == schemeHTTPS && to.Scheme == schemeHTTP {
+		flags = append(flags, hopDowngrade)
+	}
+	if !strings.EqualFold(from.Hostname(), to.Hostname()) {
+		flags = append(flags, hopCrossHost)
+	}
+	return flags
+}
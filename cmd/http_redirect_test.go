@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func TestRedirectMethod(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		method string
+		next   string
+		resend bool
+	}{
+		{http.StatusMovedPermanently, http.MethodGet, http.MethodGet, true},
+		{http.StatusFound, http.MethodPost, http.MethodGet, false},
+		{http.StatusSeeOther, http.MethodPut, http.MethodGet, false},
+		{http.StatusSeeOther, http.MethodHead, http.MethodHead, false},
+		{http.StatusTemporaryRedirect, http.MethodPost, http.MethodPost, true},
+		{http.StatusPermanentRedirect, http.MethodPut, http.MethodPut, true},
+	} {
+		next, resend := redirectMethod(c.status, c.method)
+		assert.Equal(t, c.next, next, "%d %s", c.status, c.method)
+		assert.Equal(t, c.resend, resend, "%d %s", c.status, c.method)
+	}
+}
+
+func TestHopFlags(t *testing.T) {
+	u := func(s string) *url.URL {
+		p, err := url.Parse(s)
+		require.NoError(t, err)
+		return p
+	}
+	assert.Empty(t, hopFlags(u("http://example.com/"), u("https://example.com/")))
+	assert.Equal(t, []string{hopDowngrade}, hopFlags(u("https://example.com/"), u("http://EXAMPLE.com/")))
+	assert.Equal(t, []string{hopDowngrade, hopCrossHost}, hopFlags(u("https://example.com/"), u("http://www.example.com/")))
+	assert.Equal(t, []string{hopCrossHost}, hopFlags(u("https://example.com/"), u("https://example.com.evil.test/")))
+}
+
+func TestHTTPRedirects(t *testing.T) {
+	var other *httptest.Server
+	var auth []string
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/login":
+			http.Redirect(w, r, "/home", http.StatusSeeOther)
+		case "/home":
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			_, _ = io.WriteString(w, "welcome")
+		case "/ping":
+			http.Redirect(w, r, "/pong", http.StatusFound)
+		case "/pong":
+			http.Redirect(w, r, "/ping", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, other.URL+"/", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer web.Close()
+	other = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+	// the same server under another name
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	other.URL = otherURL
+
+	t.Run("follow chain", func(t *testing.T) {
+		h := &HTTPing{request: &HTTPRequest{Method: http.MethodPost, Body: []byte("user=me")}}
+		require.NoError(t, h.Run(web.URL+"/login"))
+		require.Len(t, h.Hops, 2)
+		assert.Equal(t, 1, h.Redirects)
+		assert.Equal(t, http.StatusSeeOther, h.Hops[0].Status)
+		assert.Equal(t, web.URL+"/home", h.Hops[0].Location)
+		assert.Equal(t, http.MethodGet, h.Hops[1].Method)
+		assert.Equal(t, http.StatusOK, h.Status)
+		assert.Equal(t, int64(len("welcome")), h.Size)
+		assert.Equal(t, verdictPass, h.Verdict)
+		total := h.Hops[0].Timings.Total + h.Hops[1].Timings.Total
+		assert.InDelta(t, total, h.phaseTimings().Total, 0.001, "total is summed over the hops")
+	})
+	t.Run("loop", func(t *testing.T) {
+		h := &HTTPing{}
+		require.NoError(t, h.Run(web.URL+"/ping"))
+		require.Len(t, h.Hops, 2)
+		assert.Equal(t, []string{hopLoop}, h.Hops[1].Flags)
+		assert.Equal(t, verdictFail, h.Verdict)
+		assert.Contains(t, h.Record().Error, "redirect loop to "+web.URL+"/ping")
+	})
+	t.Run("cross host", func(t *testing.T) {
+		auth = nil
+		h := &HTTPing{request: &HTTPRequest{Method: http.MethodGet, Header: http.Header{"Authorization": {"Bearer secret"}}}}
+		require.NoError(t, h.Run(web.URL+"/away"))
+		require.Len(t, h.Hops, 2)
+		assert.Equal(t, []string{hopCrossHost}, h.Hops[0].Flags)
+		assert.Equal(t, []string{"Bearer secret", ""}, auth, "credentials are not sent to other hosts")
+	})
+}
+
+func TestHTTPRedirectFlags(t *testing.T) {
+	resetTargets(t)
+	t.Cleanup(func() {
+		httpMaxRedirects = 10
+		httpNoFollow = false
+	})
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		}
+	}))
+	defer web.Close()
+
+	t.Run("CMD HTTP no follow", func(t *testing.T) {
+		args := []string{
+			"http",
+			web.URL + "/old",
+			"--no-follow",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "HTTPing hop "+web.URL+"/old status 301")
+		assert.NotContains(t, out, "HTTPing hop "+web.URL+"/new")
+		assert.Contains(t, out, "result HTTPing for "+web.URL+"/old: OK")
+	})
+	httpNoFollow = false
+	t.Run("CMD HTTP max redirects", func(t *testing.T) {
+		args := []string{
+			"http",
+			web.URL + "/old",
+			"--max-redirects", "0",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record http "+web.URL+"/old FAIL")
+	})
+}
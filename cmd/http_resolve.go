@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	httpResolve   []string
+	httpConnectTo []string
+	// resolveRules and connectToRules are the parsed --resolve and --connect-to flags
+	resolveRules   map[string][]string
+	connectToRules []connectToRule
+)
+
+// connectToRule connects to toHost:toPort instead of host:port. Empty host or port match
+// every host or port, empty toHost or toPort keep the original.
+type connectToRule struct {
+	host, port     string
+	toHost, toPort string
+}
+
+// parseHTTPOverrides parses --resolve host:port:addr[,addr] and --connect-to host1:port1:host2:port2,
+// IPv6 addresses are written in brackets like curl does
+func parseHTTPOverrides() error {
+	resolveRules, connectToRules = nil, nil
+	if (len(httpResolve) > 0 || len(httpConnectTo) > 0) && proxyURL != nil {
+		return errors.New("--resolve and --connect-to are not supported with --proxy")
+	}
+	for _, r := range httpResolve {
+		parts := splitColons(r, 3)
+		if len(parts) != 3 || parts[0] == "" || !validPort(parts[1]) {
+			return fmt.Errorf("invalid --resolve %s, use host:port:addr[,addr]", r)
+		}
+		var addrs []string
+		for _, a := range strings.Split(parts[2], ",") {
+			ip := net.ParseIP(strings.Trim(a, "[]"))
+			if ip == nil {
+				return fmt.Errorf("invalid address %s in --resolve %s", a, r)
+			}
+			addrs = append(addrs, ip.String())
+		}
+		if resolveRules == nil {
+			resolveRules = map[string][]string{}
+		}
+		key := net.JoinHostPort(strings.ToLower(strings.Trim(parts[0], "[]")), parts[1])
+		resolveRules[key] = append(resolveRules[key], addrs...)
+	}
+	for _, c := range httpConnectTo {
+		parts := splitColons(c, 4)
+		if len(parts) != 4 || (parts[1] != "" && !validPort(parts[1])) || (parts[3] != "" && !validPort(parts[3])) {
+			return fmt.Errorf("invalid --connect-to %s, use host1:port1:host2:port2", c)
+		}
+		connectToRules = append(connectToRules, connectToRule{
+			host: strings.ToLower(strings.Trim(parts[0], "[]")), port: parts[1],
+			toHost: strings.Trim(parts[2], "[]"), toPort: parts[3],
+		})
+	}
+	return nil
+}
+
+// splitColons splits s at the first n-1 colons outside of brackets
+func splitColons(s string, n int) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 && len(parts) < n-1 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func validPort(p string) bool {
+	n, err := strconv.Atoi(p)
+	return err == nil && n > 0 && n < 65536
+}
+
+// connectTo applies the first matching --connect-to rule to a host:port address
+func connectTo(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	for _, r := range connectToRules {
+		if (r.host != "" && r.host != strings.ToLower(host)) || (r.port != "" && r.port != port) {
+			continue
+		}
+		if r.toHost != "" {
+			host = r.toHost
+		}
+		if r.toPort != "" {
+			port = r.toPort
+		}
+		to := net.JoinHostPort(host, port)
+		log.Debugf("connect to %s instead of %s", to, addr)
+		return to
+	}
+	return addr
+}
+
+// httpLookup returns the addresses of host: the --resolve override, the IP itself or the result of
+// the global DNS resolver. The lookup is reported to the HTTP trace of ctx.
+func httpLookup(ctx context.Context, host, port string) ([]string, error) {
+	if addrs, ok := resolveRules[net.JoinHostPort(strings.ToLower(host), port)]; ok {
+		log.Debugf("resolve %s:%s to %v", host, port, addrs)
+		return addrs, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, err := lookupProbeHost(host)
+	if trace != nil && trace.DNSDone != nil {
+		info := httptrace.DNSDoneInfo{Err: err}
+		for _, ip := range ips {
+			info.Addrs = append(info.Addrs, net.IPAddr{IP: ip})
+		}
+		trace.DNSDone(info)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return addrs, err
+}
+
+// httpDialContext returns the dial function of the HTTP transport. It applies --connect-to and --resolve,
+// resolves the host with the global DNS settings and tries the addresses in order.
+func httpDialContext(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := newDialer(timeout)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(connectTo(addr))
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := httpLookup(ctx, host, port)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			var conn net.Conn
+			conn, err = d.DialContext(ctx, network, net.JoinHostPort(a, port))
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+			log.Debugf("connect to %s failed: %v", a, err)
+		}
+		return nil, err
+	}
+}
+
+// relayAddress applies --connect-to and --resolve to an address dialed through the SSH bastion,
+// other names are resolved by the bastion
+func relayAddress(addr string) string {
+	addr = connectTo(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if addrs, ok := resolveRules[net.JoinHostPort(strings.ToLower(host), port)]; ok {
+		return net.JoinHostPort(addrs[0], port)
+	}
+	return addr
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func resetHTTPOverrides(t *testing.T) {
+	t.Cleanup(func() {
+		httpResolve, httpConnectTo = nil, nil
+		resolveRules, connectToRules = nil, nil
+	})
+}
+
+func TestParseHTTPOverrides(t *testing.T) {
+	resetHTTPOverrides(t)
+	httpResolve = []string{"www.example.com:443:192.0.2.1,[2001:db8::1]", "WWW.example.com:443:192.0.2.2"}
+	httpConnectTo = []string{"www.example.com:443:backend1:8443", "::[2001:db8::2]:"}
+	require.NoError(t, parseHTTPOverrides())
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}, resolveRules["www.example.com:443"])
+	assert.Equal(t, []connectToRule{
+		{host: "www.example.com", port: "443", toHost: "backend1", toPort: "8443"},
+		{toHost: "2001:db8::2"},
+	}, connectToRules)
+
+	for _, c := range []struct{ resolve, connect string }{
+		{"www.example.com:443", ""},
+		{"www.example.com:https:192.0.2.1", ""},
+		{"www.example.com:443:backend", ""},
+		{"", "www.example.com:443:backend"},
+		{"", "www.example.com:0::"},
+	} {
+		httpResolve, httpConnectTo = nil, nil
+		if c.resolve != "" {
+			httpResolve = []string{c.resolve}
+		}
+		if c.connect != "" {
+			httpConnectTo = []string{c.connect}
+		}
+		assert.Error(t, parseHTTPOverrides(), "%+v", c)
+	}
+}
+
+func TestConnectTo(t *testing.T) {
+	resetHTTPOverrides(t)
+	connectToRules = []connectToRule{
+		{host: "www.example.com", port: "443", toHost: "backend1", toPort: "8443"},
+		{host: "api.example.com", toHost: "2001:db8::2"},
+		{port: "80", toPort: "8080"},
+	}
+	for addr, want := range map[string]string{
+		"www.example.com:443": "backend1:8443",
+		"WWW.example.com:443": "backend1:8443",
+		"www.example.com:80":  "www.example.com:8080",
+		"api.example.com:443": "[2001:db8::2]:443",
+		"db.example.com:5432": "db.example.com:5432",
+	} {
+		assert.Equal(t, want, connectTo(addr), addr)
+	}
+	resolveRules = map[string][]string{"backend1:8443": {"192.0.2.10"}}
+	assert.Equal(t, "192.0.2.10:8443", relayAddress("www.example.com:443"))
+	assert.Equal(t, "db.example.com:5432", relayAddress("db.example.com:5432"))
+}
+
+func TestHTTPOverrides(t *testing.T) {
+	resetHTTPOverrides(t)
+	resetTargets(t)
+	var host string
+	web := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer web.Close()
+	port := web.Listener.Addr().(*net.TCPAddr).Port
+
+	t.Run("CMD HTTP resolve", func(t *testing.T) {
+		url := fmt.Sprintf("http://backend.example.test:%d/", port)
+		args := []string{
+			"http",
+			url,
+			"--resolve", fmt.Sprintf("backend.example.test:%d:127.0.0.1", port),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record http "+url+" OK")
+		assert.Equal(t, fmt.Sprintf("backend.example.test:%d", port), host, "Host header of the URL is kept")
+	})
+	t.Run("CMD HTTP connect-to", func(t *testing.T) {
+		httpResolve = nil
+		args := []string{
+			"http",
+			"http://www.example.test/",
+			"--connect-to", fmt.Sprintf("www.example.test::127.0.0.1:%d", port),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record http http://www.example.test/ OK")
+		assert.Equal(t, "www.example.test", host)
+	})
+	t.Run("CMD HTTP invalid resolve", func(t *testing.T) {
+		httpConnectTo = nil
+		args := []string{
+			"http",
+			"http://www.example.test/",
+			"--resolve", "www.example.test:80",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "invalid --resolve")
+	})
+}
@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tommi2day/gomodules/common"
 )
 
@@ -27,3 +31,62 @@ func TestHTTPing(t *testing.T) {
 		t.Log(out)
 	})
 }
+
+func TestHTTPAssertions(t *testing.T) {
+	resetHTTPFlags(t)
+	resetTargets(t)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("X-Token") != "secret" || string(body) != "ping" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"status":"up","checks":[{"name":"db","ok":true}]}`)
+	}))
+	defer web.Close()
+
+	t.Run("CMD HTTP assertions pass", func(t *testing.T) {
+		args := []string{
+			"http",
+			web.URL,
+			"-H", "X-Token: secret",
+			"--data", "ping",
+			"--expect-status", "200-299",
+			"--expect-body", `"up"`,
+			"--expect-json", "checks.0.ok=true",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record http "+web.URL+" OK")
+	})
+	t.Run("CMD HTTP assertions fail", func(t *testing.T) {
+		httpHeaders, httpData, httpExpectBody, httpExpectJSON = nil, "", "", nil
+		args := []string{
+			"http",
+			web.URL,
+			"--expect-status", "200",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record http "+web.URL+" FAIL")
+	})
+	t.Run("CMD HTTP invalid status range", func(t *testing.T) {
+		args := []string{
+			"http",
+			web.URL,
+			"--expect-status", "2xx",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "invalid status range")
+	})
+}
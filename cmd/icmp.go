@@ -0,0 +1,576 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ICMPing is a struct that contains an ICMP echo session to one address and the result of the last probe
+type ICMPing struct {
+	Address    string        `json:"address" yaml:"address"`
+	IP         *net.IPAddr   `json:"-" yaml:"-"`
+	Duration   time.Duration `json:"-" yaml:"-"`
+	RTT        float64       `json:"rtt_ms" yaml:"rtt_ms"`
+	IPType     IPType        `json:"-" yaml:"-"`
+	ID         int           `json:"id" yaml:"id"`
+	Seq        int           `json:"seq" yaml:"seq"`
+	TTL        int           `json:"ttl" yaml:"ttl"`
+	Size       int           `json:"size" yaml:"size"`
+	Mode       string        `json:"mode" yaml:"mode"`
+	Source     string        `json:"source,omitempty" yaml:"source,omitempty"`
+	Notices    []*ICMPError  `json:"notices,omitempty" yaml:"notices,omitempty"`
+	Duplicates int           `json:"duplicates" yaml:"duplicates"`
+	OutOfOrder int           `json:"out_of_order" yaml:"out_of_order"`
+	conn       *icmp.PacketConn
+	// received are the 16 bit sequence numbers with a reply
+	received map[uint16]bool
+}
+
+// IPType is a struct that contains the type of IP address to use
+type IPType struct {
+	Type               string
+	ListenAddr         string
+	Network            string
+	ICMPNetwork        string
+	DgramNetwork       string
+	ProtocolNumber     int
+	RequestMessageType icmp.Type
+	ReplyMessageType   icmp.Type
+}
+
+var (
+	// IPType4 is the type of IP address to use for IPv4
+	IPType4 = IPType{
+		Type:               "4",
+		ListenAddr:         "0.0.0.0",
+		Network:            "ip4",
+		ICMPNetwork:        "ip4:icmp",
+		DgramNetwork:       "udp4",
+		ProtocolNumber:     1,
+		RequestMessageType: ipv4.ICMPTypeEcho,
+		ReplyMessageType:   ipv4.ICMPTypeEchoReply,
+	}
+	// IPType6 is the type of IP address to use for IPv6
+	IPType6 = IPType{
+		Type:               "6",
+		ListenAddr:         "::",
+		Network:            "ip6",
+		ICMPNetwork:        "ip6:ipv6-icmp",
+		DgramNetwork:       "udp6",
+		ProtocolNumber:     58,
+		RequestMessageType: ipv6.ICMPTypeEchoRequest,
+		ReplyMessageType:   ipv6.ICMPTypeEchoReply,
+	}
+)
+
+var (
+	icmpCmd = &cobra.Command{
+		Use:          "icmp [host ...]",
+		Short:        "Ping using ICMP protocol",
+		Long:         ``,
+		RunE:         runICMPPing,
+		SilenceUsage: true,
+	}
+	icmpSize = 56
+	icmpTTL  = 0
+)
+
+const (
+	icmpModeRaw   = "raw"
+	icmpModeDgram = "dgram"
+)
+
+func init() {
+	icmpCmd.Flags().StringVarP(&queryAddress, "address", "a", "", "ip/host to query")
+	icmpCmd.Flags().IntVarP(&pingTimeout, "timeout", "t", pingTimeout, "Ping Timeout in sec")
+	icmpCmd.Flags().IntVarP(&pingCount, "count", "c", pingCount, "number of echo requests per address, 0 runs until interrupted")
+	icmpCmd.Flags().Float64VarP(&pingInterval, "interval", "i", pingInterval, "interval between echo requests in sec")
+	icmpCmd.Flags().IntVarP(&icmpSize, "size", "s", icmpSize, "echo payload size in bytes")
+	icmpCmd.Flags().IntVar(&icmpTTL, "ttl", icmpTTL, "IP TTL / hop limit of echo requests, 0 uses the system default")
+	addTargetFlags(icmpCmd)
+	RootCmd.AddCommand(icmpCmd)
+}
+
+func runICMPPing(_ *cobra.Command, args []string) error {
+	log.Debugf("ICMPing called with %s %v", queryAddress, args)
+	if err := checkPingLoopFlags(); err != nil {
+		return err
+	}
+	targets, err := collectTargets(args)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("please specify an address to query")
+	}
+	resolve := func(j *targetJob) []net.IP {
+		ips, e := lookupProbeHost(targetHost(j.target))
+		if e != nil {
+			log.Debugf("DNS lookup failed: %v", e)
+			j.err = e
+		}
+		return ips
+	}
+	if pingCount == 1 {
+		err = runTargets("icmp", targets, func(j *targetJob) {
+			for _, ip := range resolve(j) {
+				i := new(ICMPing)
+				e := i.Run(ip.String())
+				j.emit(i.Record(e), func() { i.Log(e) })
+			}
+		})
+		log.Debugf("ICMPing done")
+		return err
+	}
+	resolved := make([][]string, len(targets))
+	err = runTargets("icmp", targets, func(j *targetJob) {
+		for _, ip := range resolve(j) {
+			resolved[j.index] = append(resolved[j.index], ip.String())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	for _, a := range uniqueAddresses(resolved) {
+		ips = append(ips, net.ParseIP(a))
+	}
+	runICMPPingLoop(ips)
+	log.Debugf("ICMPing done")
+	return nil
+}
+
+// runICMPPingLoop opens an echo session per address and pings all of them repeatedly.
+// The sessions of a round are pinged with --parallel concurrent requests.
+// It stops after pingCount rounds or, if pingCount is 0, on interrupt and prints a summary per address.
+func runICMPPingLoop(ips []net.IP) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	interval := time.Duration(pingInterval * float64(time.Second))
+	var sessions []*ICMPing
+	var stats []*PingStats
+	defer func() {
+		for _, i := range sessions {
+			i.Close()
+		}
+	}()
+	for n, ip := range ips {
+		i := &ICMPing{ID: (os.Getpid() + n) & 0xffff}
+		if err := i.Open(ip.String()); err != nil {
+			emit(i.Record(err), func() { i.Log(err) })
+			continue
+		}
+		sessions = append(sessions, i)
+		stats = append(stats, NewPingStats(i.IP.String()))
+	}
+	if len(sessions) == 0 {
+		return
+	}
+	log.Debugf("ICMPing loop with count %d interval %v", pingCount, interval)
+	for seq := 1; pingCount == 0 || seq <= pingCount; seq++ {
+		errs := make([]error, len(sessions))
+		runParallel(len(sessions), func(n int) {
+			errs[n] = sessions[n].Ping(ctx, seq)
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		for n, i := range sessions {
+			err := errs[n]
+			stats[n].Add(i.Duration, err == nil)
+			emit(i.Record(err), func() { i.Log(err) })
+		}
+		if seq == pingCount {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+	for n, i := range sessions {
+		stats[n].Duplicates = i.Duplicates
+		stats[n].OutOfOrder = i.OutOfOrder
+	}
+	logStatsSummary("ICMP", stats)
+}
+
+// Record returns the serializable result of the last probe
+func (i *ICMPing) Record(err error) Result {
+	target := i.Address
+	if i.IP != nil {
+		target = i.IP.String()
+	}
+	status := "OPEN"
+	var ie *ICMPError
+	switch {
+	case errors.As(err, &ie):
+		status = ie.Status
+	case err != nil:
+		status = "ERROR"
+	}
+	i.RTT = durationMS(i.Duration)
+	// the session is reused for the next probe, keep a copy of the current state
+	snapshot := *i
+	snapshot.Notices = append([]*ICMPError(nil), i.Notices...)
+	return newResult("icmp", target, status, err, &snapshot)
+}
+
+// Log logs the ping results
+func (i *ICMPing) Log(err error) {
+	log.Debugf("enter ICMPing Log %s", i.IP.String())
+	for _, n := range i.Notices {
+		fmt.Printf("%s%s%-30s    %s\n", cyan("%-7s", "ICMP"), yellow("%-13s", n.Status), i.IP.String(), n)
+	}
+	var ie *ICMPError
+	if errors.As(err, &ie) {
+		fmt.Printf("%s%s%-30s    %s\n", cyan("%-7s", "ICMP"), red("%-13s", ie.Status), i.IP.String(), ie)
+		log.Debugf("result ICMPing to %s: %s (%v)", i.IP.String(), ie.Status, ie)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			fmt.Printf("%s%s%s\n",
+				cyan("%-7s", "ICMP"),
+				red("%-10s", "ERROR"),
+				red("No privileges (raw socket needs root or CAP_NET_RAW, datagram socket needs net.ipv4.ping_group_range)"))
+		} else {
+			fmt.Printf("%s%s%-30s    %s\n",
+				cyan("%-7s", "ICMP"),
+				red("%-10s", "ERROR"), i.IP.String(), err)
+		}
+		log.Debugf("result ICMPing to %s: ERROR (%v)", i.IP.String(), err)
+		return
+	}
+	log.Debugf("result ICMPing to %s: OPEN", i.IP.String())
+	src := ""
+	if sourceSet() {
+		src = " src=" + i.Source
+	}
+	fmt.Printf("%s%s%-30s    %s ms  seq=%d ttl=%d mode=%s%s\n",
+		cyan("%-7s", "ICMP"),
+		green("%-10s", "OPEN"), i.IP.String(),
+		fmt.Sprintf("%.1f", float64(i.Duration.Microseconds())/1000), i.Seq, i.TTL, i.Mode, src)
+}
+
+// Run sends an ICMP echo request to a given address and returns the time it took to get a reply
+func (i *ICMPing) Run(host string) (err error) {
+	err = i.Open(host)
+	if err != nil {
+		return
+	}
+	defer i.Close()
+	return i.Ping(context.Background(), 1)
+}
+
+// Open resolves the address and opens the ICMP socket of the session
+func (i *ICMPing) Open(host string) (err error) {
+	// Check ip type
+	// Resolve address
+	var dst *net.IPAddr
+	log.Debugf("ICMPing Run to %s", host)
+	dst, err = net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		log.Debugf("ICMPing ResolveIPAddr ip4 failed: %v", err)
+		dst, err = net.ResolveIPAddr("ip6", host)
+		if err != nil {
+			log.Debugf("ICMPing ResolveIPAddr ip6 failed: %v", err)
+			return
+		}
+		i.IPType = IPType6
+	} else {
+		i.IPType = IPType4
+	}
+	i.IP = dst
+	i.Address = dst.String()
+	if i.ID == 0 {
+		i.ID = os.Getpid() & 0xffff
+	}
+	i.received = map[uint16]bool{}
+	log.Debugf("prepare ICMPing to IP %s type %s", i.IP.String(), i.IPType.Type)
+	// Start listening for icmp replies
+	err = i.listen()
+	if err != nil {
+		return err
+	}
+	if err = i.bindDevice(); err != nil {
+		i.Close()
+		return err
+	}
+	i.setSocketOptions()
+	return nil
+}
+
+// bindDevice binds the ICMP socket to the --interface or --vrf device
+func (i *ICMPing) bindDevice() error {
+	if p := i.conn.IPv4PacketConn(); p != nil {
+		return bindPacketConn(p.PacketConn)
+	}
+	if p := i.conn.IPv6PacketConn(); p != nil {
+		return bindPacketConn(p.PacketConn)
+	}
+	return nil
+}
+
+// listen opens a privileged raw ICMP socket and falls back to an unprivileged
+// datagram ICMP socket (Linux net.ipv4.ping_group_range, macOS) if that fails
+func (i *ICMPing) listen() error {
+	addr, err := sourceListenAddr(i.IPType)
+	if err != nil {
+		return err
+	}
+	c, rawErr := icmp.ListenPacket(i.IPType.ICMPNetwork, addr)
+	if rawErr == nil {
+		i.conn = c
+		i.Mode = icmpModeRaw
+		i.Source = localIP(c.LocalAddr())
+		log.Debugf("ICMPing uses raw socket %s on %s", i.IPType.ICMPNetwork, addr)
+		return nil
+	}
+	log.Debugf("ICMPing ListenPacket %s failed: %v, try %s", i.IPType.ICMPNetwork, rawErr, i.IPType.DgramNetwork)
+	dgramErr := i.listenDgram(addr)
+	if dgramErr != nil {
+		return errors.Join(
+			fmt.Errorf("raw socket: %w", rawErr),
+			fmt.Errorf("datagram socket: %w", dgramErr))
+	}
+	return nil
+}
+
+// listenDgram opens an unprivileged datagram ICMP socket on the local address
+func (i *ICMPing) listenDgram(addr string) error {
+	c, err := icmp.ListenPacket(i.IPType.DgramNetwork, addr)
+	if err != nil {
+		log.Debugf("ICMPing ListenPacket %s failed: %v", i.IPType.DgramNetwork, err)
+		return err
+	}
+	i.conn = c
+	i.Mode = icmpModeDgram
+	i.Source = localIP(c.LocalAddr())
+	// the kernel replaces the echo identifier with the local port of the socket
+	if a, ok := c.LocalAddr().(*net.UDPAddr); ok && a.Port > 0 {
+		i.ID = a.Port
+	}
+	log.Debugf("ICMPing uses datagram socket %s with id %d", i.IPType.DgramNetwork, i.ID)
+	return nil
+}
+
+// target returns the destination address in the form required by the socket type
+func (i *ICMPing) target() net.Addr {
+	if i.Mode == icmpModeDgram {
+		return &net.UDPAddr{IP: i.IP.IP, Zone: i.IP.Zone}
+	}
+	return i.IP
+}
+
+// setSocketOptions sets the TTL of outgoing packets and requests the TTL of replies.
+// Failures are not fatal, as not every platform supports these options.
+func (i *ICMPing) setSocketOptions() {
+	if p := i.conn.IPv4PacketConn(); p != nil {
+		if icmpTTL > 0 {
+			if err := p.SetTTL(icmpTTL); err != nil {
+				log.Debugf("ICMPing SetTTL failed: %v", err)
+			}
+		}
+		if err := p.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			log.Debugf("ICMPing SetControlMessage failed: %v", err)
+		}
+	}
+	if p := i.conn.IPv6PacketConn(); p != nil {
+		if icmpTTL > 0 {
+			if err := p.SetHopLimit(icmpTTL); err != nil {
+				log.Debugf("ICMPing SetHopLimit failed: %v", err)
+			}
+		}
+		if err := p.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+			log.Debugf("ICMPing SetControlMessage failed: %v", err)
+		}
+	}
+}
+
+// Close closes the ICMP socket of the session
+func (i *ICMPing) Close() {
+	if i.conn != nil {
+		_ = i.conn.Close()
+		i.conn = nil
+	}
+}
+
+// Ping sends one echo request with the given sequence number and waits for the matching reply
+func (i *ICMPing) Ping(ctx context.Context, seq int) (err error) {
+	i.Seq = seq
+	// a long run reuses the sequence number after 65536 requests
+	delete(i.received, uint16(seq))
+	i.Duration = 0
+	i.TTL = 0
+	i.Notices = nil
+	data := make([]byte, icmpSize)
+	for n := range data {
+		data[n] = byte(n)
+	}
+	// Make a new ICMP message
+	m := icmp.Message{
+		Type: i.IPType.RequestMessageType,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID: i.ID, Seq: seq & 0xffff,
+			Data: data,
+		},
+	}
+	b, err := m.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	// Send it
+	start := time.Now()
+	n, err := i.conn.WriteTo(b, i.target())
+	if err != nil {
+		log.Debugf("ICMPing WriteTo failed: %v", err)
+		return err
+	} else if n != len(b) {
+		log.Debugf("ICMPing WriteTo failed: got %v; want %v", n, len(b))
+		return fmt.Errorf("got %v; want %v", n, len(b))
+	}
+
+	// Wait for a reply
+	log.Debugf("ICMPing waiting for reply seq %d", seq)
+	deadline := start.Add(time.Duration(pingTimeout) * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err = i.conn.SetReadDeadline(deadline)
+	if err != nil {
+		log.Debugf("ICMPing SetReadDeadline failed: %v", err)
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = i.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	return i.waitReply(seq, start)
+}
+
+// waitReply reads packets until the echo reply matching seq or an ICMP error caused by it arrives
+// or the read deadline expires. Unrelated packets are skipped, replies belonging to other
+// sequence numbers are counted as duplicate or out of order.
+func (i *ICMPing) waitReply(seq int, start time.Time) error {
+	reply := make([]byte, max(1500, icmpSize+128))
+	for {
+		n, ttl, peer, err := i.readFrom(reply)
+		if err != nil {
+			log.Debugf("ICMPing ReadFrom failed: %v", err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return fmt.Errorf("timeout waiting for reply from %s seq %d", i.IP.String(), seq)
+			}
+			return err
+		}
+		duration := time.Since(start)
+
+		rm, err := icmp.ParseMessage(i.IPType.ProtocolNumber, reply[:n])
+		if err != nil {
+			log.Debugf("ICMPing ParseMessage failed: %v", err)
+			continue
+		}
+		if ie := i.matchError(reply[:n], peer, seq); ie != nil {
+			if ie.Status == icmpStatusRedirect {
+				i.Notices = append(i.Notices, ie)
+				continue
+			}
+			i.Duration = duration
+			return ie
+		}
+		if rm.Type != i.IPType.ReplyMessageType {
+			log.Debugf("ICMPing ignore %v from %v", rm.Type, peer)
+			continue
+		}
+		echo, ok := rm.Body.(*icmp.Echo)
+		if !ok || echo.ID != i.ID || !sameIP(peer, i.IP.IP) {
+			log.Debugf("ICMPing ignore foreign echo reply from %v", peer)
+			continue
+		}
+		if i.track(echo.Seq, seq) {
+			i.Duration = duration
+			i.TTL = ttl
+			i.Size = n
+			log.Debugf("ICMPing ReplyMessageType received, seq %d duration %v", seq, i.Duration)
+			return nil
+		}
+	}
+}
+
+// track records the echo reply got while waiting for the request want and reports whether it answers want.
+// Other replies count as duplicate or out of order, the sequence numbers are compared by their 16 bit value.
+func (i *ICMPing) track(got, want int) bool {
+	key := uint16(got)
+	switch {
+	case key == uint16(want) && !i.received[key]:
+		i.received[key] = true
+		return true
+	case i.received[key]:
+		i.Duplicates++
+		log.Debugf("ICMPing duplicate reply seq %d", got)
+	default:
+		i.received[key] = true
+		i.OutOfOrder++
+		log.Debugf("ICMPing out of order reply seq %d while waiting for %d", got, want)
+	}
+	return false
+}
+
+// matchError returns the decoded ICMP error message if it was caused by the echo request seq of this session
+func (i *ICMPing) matchError(raw []byte, peer net.Addr, seq int) *ICMPError {
+	ie, inner := decodeICMPError(i.IPType.ProtocolNumber, raw, peer)
+	if ie == nil {
+		return nil
+	}
+	id, qseq, ok := quotedEcho(inner, i.IPType.Type == IPType6.Type, i.IP.IP)
+	if !ok || id != i.ID || qseq != seq&0xffff {
+		log.Debugf("ICMPing ignore unrelated %s from %v", ie.Reason, peer)
+		return nil
+	}
+	log.Debugf("ICMPing got %s: %v", ie.Status, ie)
+	return ie
+}
+
+// readFrom reads one ICMP message and returns the TTL / hop limit of the packet if available
+func (i *ICMPing) readFrom(b []byte) (n int, ttl int, peer net.Addr, err error) {
+	if p := i.conn.IPv4PacketConn(); p != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, peer, err = p.ReadFrom(b)
+		if cm != nil {
+			ttl = cm.TTL
+		}
+		return
+	}
+	if p := i.conn.IPv6PacketConn(); p != nil {
+		var cm *ipv6.ControlMessage
+		n, cm, peer, err = p.ReadFrom(b)
+		if cm != nil {
+			ttl = cm.HopLimit
+		}
+		return
+	}
+	n, peer, err = i.conn.ReadFrom(b)
+	return
+}
+
+// sameIP reports whether the peer address belongs to ip
+func sameIP(peer net.Addr, ip net.IP) bool {
+	switch a := peer.(type) {
+	case *net.IPAddr:
+		return a.IP.Equal(ip)
+	case *net.UDPAddr:
+		return a.IP.Equal(ip)
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// status values of decoded ICMP error messages
+const (
+	icmpStatusUnreach     = "UNREACH"
+	icmpStatusProhibited  = "PROHIBITED"
+	icmpStatusTTLExceeded = "TTL-EXCEEDED"
+	icmpStatusFragNeeded  = "FRAG-NEEDED"
+	icmpStatusRedirect    = "REDIRECT"
+)
+
+// ICMPError describes an ICMP error message a router or the target sent in response to a probe
+type ICMPError struct {
+	Status  string `json:"status" yaml:"status"`
+	Reason  string `json:"reason" yaml:"reason"`
+	Router  string `json:"router" yaml:"router"`
+	MTU     int    `json:"mtu,omitempty" yaml:"mtu,omitempty"`
+	Gateway string `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	Type    int    `json:"type" yaml:"type"`
+	Code    int    `json:"code" yaml:"code"`
+}
+
+// Error implements the error interface
+func (e *ICMPError) Error() string {
+	msg := fmt.Sprintf("%s from %s", e.Reason, e.Router)
+	if e.MTU > 0 {
+		msg += fmt.Sprintf(", next-hop MTU %d", e.MTU)
+	}
+	if e.Gateway != "" {
+		msg += fmt.Sprintf(", new gateway %s", e.Gateway)
+	}
+	return msg
+}
+
+// icmp4UnreachCodes maps ICMPv4 destination unreachable codes to status and reason
+var icmp4UnreachCodes = map[int][2]string{
+	0:  {icmpStatusUnreach, "network unreachable"},
+	1:  {icmpStatusUnreach, "host unreachable"},
+	2:  {icmpStatusUnreach, "protocol unreachable"},
+	3:  {icmpStatusUnreach, "port unreachable"},
+	4:  {icmpStatusFragNeeded, "fragmentation needed"},
+	5:  {icmpStatusUnreach, "source route failed"},
+	6:  {icmpStatusUnreach, "destination network unknown"},
+	7:  {icmpStatusUnreach, "destination host unknown"},
+	8:  {icmpStatusUnreach, "source host isolated"},
+	9:  {icmpStatusProhibited, "network administratively prohibited"},
+	10: {icmpStatusProhibited, "host administratively prohibited"},
+	11: {icmpStatusUnreach, "network unreachable for TOS"},
+	12: {icmpStatusUnreach, "host unreachable for TOS"},
+	13: {icmpStatusProhibited, "communication administratively prohibited"},
+	14: {icmpStatusProhibited, "host precedence violation"},
+	15: {icmpStatusProhibited, "precedence cutoff in effect"},
+}
+
+// icmp6UnreachCodes maps ICMPv6 destination unreachable codes to status and reason
+var icmp6UnreachCodes = map[int][2]string{
+	0: {icmpStatusUnreach, "no route to destination"},
+	1: {icmpStatusProhibited, "communication administratively prohibited"},
+	2: {icmpStatusUnreach, "beyond scope of source address"},
+	3: {icmpStatusUnreach, "address unreachable"},
+	4: {icmpStatusUnreach, "port unreachable"},
+	5: {icmpStatusProhibited, "source address failed ingress/egress policy"},
+	6: {icmpStatusProhibited, "reject route to destination"},
+}
+
+// decodeICMPError decodes an ICMPv4 (proto 1) or ICMPv6 (proto 58) error message.
+// raw is the complete ICMP message. It returns nil if the message is no error message,
+// otherwise the decoded error and the original datagram quoted in the message.
+func decodeICMPError(proto int, raw []byte, peer net.Addr) (e *ICMPError, inner []byte) {
+	if len(raw) < 8 {
+		return nil, nil
+	}
+	typ := int(raw[0])
+	code := int(raw[1])
+	e = &ICMPError{Type: typ, Code: code, Router: peerIP(peer)}
+	inner = raw[8:]
+	if proto == IPType6.ProtocolNumber {
+		if !decodeICMP6Error(e, raw) {
+			return nil, nil
+		}
+		if ipv6.ICMPType(typ) == ipv6.ICMPTypeRedirect {
+			inner = icmp6RedirectedHeader(raw)
+		}
+		return e, inner
+	}
+	if !decodeICMP4Error(e, raw) {
+		return nil, nil
+	}
+	return e, inner
+}
+
+// decodeICMP4Error fills status and reason of an ICMPv4 error message and reports whether it is one
+func decodeICMP4Error(e *ICMPError, raw []byte) bool {
+	switch ipv4.ICMPType(e.Type) {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		e.Status, e.Reason = codeText(icmp4UnreachCodes, e.Code, icmpStatusUnreach, "destination unreachable")
+		if e.Code == 4 {
+			e.MTU = int(binary.BigEndian.Uint16(raw[6:8]))
+		}
+	case ipv4.ICMPTypeTimeExceeded:
+		e.Status, e.Reason = icmpStatusTTLExceeded, "TTL exceeded in transit"
+		if e.Code == 1 {
+			e.Reason = "fragment reassembly time exceeded"
+		}
+	case ipv4.ICMPTypeRedirect:
+		e.Status, e.Reason = icmpStatusRedirect, "redirect"
+		e.Gateway = net.IP(raw[4:8]).String()
+	case ipv4.ICMPTypeParameterProblem:
+		e.Status, e.Reason = icmpStatusUnreach, "parameter problem"
+	default:
+		return false
+	}
+	return true
+}
+
+// decodeICMP6Error fills status and reason of an ICMPv6 error message and reports whether it is one
+func decodeICMP6Error(e *ICMPError, raw []byte) bool {
+	switch ipv6.ICMPType(e.Type) {
+	case ipv6.ICMPTypeDestinationUnreachable:
+		e.Status, e.Reason = codeText(icmp6UnreachCodes, e.Code, icmpStatusUnreach, "destination unreachable")
+	case ipv6.ICMPTypePacketTooBig:
+		e.Status, e.Reason = icmpStatusFragNeeded, "packet too big"
+		e.MTU = int(binary.BigEndian.Uint32(raw[4:8]))
+	case ipv6.ICMPTypeTimeExceeded:
+		e.Status, e.Reason = icmpStatusTTLExceeded, "hop limit exceeded in transit"
+		if e.Code == 1 {
+			e.Reason = "fragment reassembly time exceeded"
+		}
+	case ipv6.ICMPTypeRedirect:
+		if len(raw) < 40 {
+			return false
+		}
+		e.Status, e.Reason = icmpStatusRedirect, "redirect"
+		e.Gateway = net.IP(raw[8:24]).String()
+	case ipv6.ICMPTypeParameterProblem:
+		e.Status, e.Reason = icmpStatusUnreach, "parameter problem"
+	default:
+		return false
+	}
+	return true
+}
+
+// codeText looks up the status and reason of an ICMP code, falling back to the given defaults
+func codeText(m map[int][2]string, code int, status, reason string) (string, string) {
+	if t, ok := m[code]; ok {
+		return t[0], t[1]
+	}
+	return status, fmt.Sprintf("%s (code %d)", reason, code)
+}
+
+// icmp6RedirectedHeader returns the original datagram of the Redirected Header option of an ICMPv6 redirect
+func icmp6RedirectedHeader(raw []byte) []byte {
+	opts := raw[40:]
+	for len(opts) >= 8 {
+		l := int(opts[1]) * 8
+		if l == 0 || l > len(opts) {
+			return nil
+		}
+		if opts[0] == 4 {
+			return opts[8:l]
+		}
+		opts = opts[l:]
+	}
+	return nil
+}
+
+// quotedPacket parses the original IP datagram quoted in an ICMP error message and
+// returns its destination, upper layer protocol and the upper layer payload
+func quotedPacket(inner []byte, v6 bool) (dst net.IP, proto int, payload []byte, ok bool) {
+	if v6 {
+		if len(inner) < ipv6.HeaderLen {
+			return nil, 0, nil, false
+		}
+		return net.IP(inner[24:40]), int(inner[6]), inner[ipv6.HeaderLen:], true
+	}
+	if len(inner) < ipv4.HeaderLen {
+		return nil, 0, nil, false
+	}
+	hl := int(inner[0]&0x0f) << 2
+	if hl < ipv4.HeaderLen || hl > len(inner) {
+		return nil, 0, nil, false
+	}
+	return net.IP(inner[16:20]), int(inner[9]), inner[hl:], true
+}
+
+// quotedEcho returns identifier and sequence number of the echo request quoted in an ICMP error
+// if it was sent to dst
+func quotedEcho(inner []byte, v6 bool, dst net.IP) (id, seq int, ok bool) {
+	qdst, proto, payload, ok := quotedPacket(inner, v6)
+	if !ok || !qdst.Equal(dst) || len(payload) < 8 {
+		return 0, 0, false
+	}
+	want := IPType4
+	if v6 {
+		want = IPType6
+	}
+	if proto != want.ProtocolNumber || int(payload[0]) != typeNumber(want.RequestMessageType) {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(payload[4:6])), int(binary.BigEndian.Uint16(payload[6:8])), true
+}
+
+// typeNumber returns the numeric value of an ICMP message type
+func typeNumber(t icmp.Type) int {
+	switch v := t.(type) {
+	case ipv4.ICMPType:
+		return int(v)
+	case ipv6.ICMPType:
+		return int(v)
+	}
+	return -1
+}
+
+// peerIP returns the IP address of a packet source as string
+func peerIP(peer net.Addr) string {
+	switch a := peer.(type) {
+	case *net.IPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	}
+	return peer.String()
+}
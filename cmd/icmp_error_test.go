@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	testICMPRouter = "192.0.2.254"
+	testICMPTarget = "198.51.100.7"
+)
+
+// quotedEcho4 builds an IPv4 header followed by the first bytes of an echo request to dst
+func quotedEcho4(t *testing.T, dst string, id, seq int) []byte {
+	t.Helper()
+	h := &ipv4.Header{Version: 4, Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + 8, TTL: 1, Protocol: 1,
+		Src: net.ParseIP("192.0.2.1"), Dst: net.ParseIP(dst)}
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+	echo := make([]byte, 8)
+	echo[0] = byte(ipv4.ICMPTypeEcho)
+	binary.BigEndian.PutUint16(echo[4:], uint16(id))
+	binary.BigEndian.PutUint16(echo[6:], uint16(seq))
+	return append(b, echo...)
+}
+
+// quotedEcho6 builds an IPv6 header followed by the first bytes of an echo request to dst
+func quotedEcho6(dst string, id, seq int) []byte {
+	b := make([]byte, ipv6.HeaderLen+8)
+	b[0] = 0x60
+	b[6] = 58
+	copy(b[24:40], net.ParseIP(dst).To16())
+	b[40] = byte(ipv6.ICMPTypeEchoRequest)
+	binary.BigEndian.PutUint16(b[44:], uint16(id))
+	binary.BigEndian.PutUint16(b[46:], uint16(seq))
+	return b
+}
+
+func marshalICMP(t *testing.T, m *icmp.Message) []byte {
+	t.Helper()
+	b, err := m.Marshal(nil)
+	if err != nil {
+		t.Fatalf("marshal icmp: %v", err)
+	}
+	return b
+}
+
+func TestDecodeICMP4Errors(t *testing.T) {
+	router := &net.IPAddr{IP: net.ParseIP(testICMPRouter)}
+	inner := quotedEcho4(t, testICMPTarget, 4711, 3)
+	cases := []struct {
+		name   string
+		msg    *icmp.Message
+		status string
+		reason string
+	}{
+		{"host", &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1, Body: &icmp.DstUnreach{Data: inner}}, icmpStatusUnreach, "host unreachable"},
+		{"net", &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 0, Body: &icmp.DstUnreach{Data: inner}}, icmpStatusUnreach, "network unreachable"},
+		{"admin", &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 13, Body: &icmp.DstUnreach{Data: inner}}, icmpStatusProhibited, "communication administratively prohibited"},
+		{"unknown code", &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 42, Body: &icmp.DstUnreach{Data: inner}}, icmpStatusUnreach, "destination unreachable (code 42)"},
+		{"ttl", &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Code: 0, Body: &icmp.TimeExceeded{Data: inner}}, icmpStatusTTLExceeded, "TTL exceeded in transit"},
+		{"reassembly", &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Code: 1, Body: &icmp.TimeExceeded{Data: inner}}, icmpStatusTTLExceeded, "fragment reassembly time exceeded"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, q := decodeICMPError(IPType4.ProtocolNumber, marshalICMP(t, tc.msg), router)
+			if assert.NotNil(t, e) {
+				assert.Equal(t, tc.status, e.Status)
+				assert.Equal(t, tc.reason, e.Reason)
+				assert.Equal(t, testICMPRouter, e.Router)
+			}
+			id, seq, ok := quotedEcho(q, false, net.ParseIP(testICMPTarget))
+			assert.True(t, ok)
+			assert.Equal(t, 4711, id)
+			assert.Equal(t, 3, seq)
+		})
+	}
+
+	t.Run("fragmentation needed", func(t *testing.T) {
+		raw := marshalICMP(t, &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{Data: inner}})
+		binary.BigEndian.PutUint16(raw[6:8], 1400)
+		e, _ := decodeICMPError(IPType4.ProtocolNumber, raw, router)
+		assert.Equal(t, icmpStatusFragNeeded, e.Status)
+		assert.Equal(t, 1400, e.MTU)
+		assert.Contains(t, e.Error(), "next-hop MTU 1400")
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		raw := make([]byte, 8)
+		raw[0] = byte(ipv4.ICMPTypeRedirect)
+		raw[1] = 1
+		copy(raw[4:8], net.ParseIP("192.0.2.2").To4())
+		raw = append(raw, inner...)
+		e, _ := decodeICMPError(IPType4.ProtocolNumber, raw, router)
+		assert.Equal(t, icmpStatusRedirect, e.Status)
+		assert.Equal(t, "192.0.2.2", e.Gateway)
+		assert.Contains(t, e.Error(), "new gateway 192.0.2.2")
+	})
+
+	t.Run("no error", func(t *testing.T) {
+		raw := marshalICMP(t, &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1, Seq: 1}})
+		e, _ := decodeICMPError(IPType4.ProtocolNumber, raw, router)
+		assert.Nil(t, e)
+		e, _ = decodeICMPError(IPType4.ProtocolNumber, raw[:4], router)
+		assert.Nil(t, e)
+	})
+}
+
+func TestDecodeICMP6Errors(t *testing.T) {
+	router := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	target := "2001:db8::7"
+	inner := quotedEcho6(target, 4711, 5)
+	cases := []struct {
+		name   string
+		msg    *icmp.Message
+		status string
+	}{
+		{"no route", &icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 0, Body: &icmp.DstUnreach{Data: inner}}, icmpStatusUnreach},
+		{"admin", &icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 1, Body: &icmp.DstUnreach{Data: inner}}, icmpStatusProhibited},
+		{"too big", &icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Code: 0, Body: &icmp.PacketTooBig{MTU: 1280, Data: inner}}, icmpStatusFragNeeded},
+		{"hop limit", &icmp.Message{Type: ipv6.ICMPTypeTimeExceeded, Code: 0, Body: &icmp.TimeExceeded{Data: inner}}, icmpStatusTTLExceeded},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, q := decodeICMPError(IPType6.ProtocolNumber, marshalICMP(t, tc.msg), router)
+			if assert.NotNil(t, e) {
+				assert.Equal(t, tc.status, e.Status)
+				assert.Equal(t, "2001:db8::1", e.Router)
+			}
+			id, seq, ok := quotedEcho(q, true, net.ParseIP(target))
+			assert.True(t, ok)
+			assert.Equal(t, 4711, id)
+			assert.Equal(t, 5, seq)
+		})
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		raw := make([]byte, 40)
+		raw[0] = byte(ipv6.ICMPTypeRedirect)
+		copy(raw[8:24], net.ParseIP("fe80::1"))
+		copy(raw[24:40], net.ParseIP(target))
+		opt := make([]byte, 8)
+		opt[0] = 4
+		opt[1] = byte((8 + len(inner)) / 8)
+		raw = append(append(raw, opt...), inner...)
+		e, q := decodeICMPError(IPType6.ProtocolNumber, raw, router)
+		assert.Equal(t, icmpStatusRedirect, e.Status)
+		assert.Equal(t, "fe80::1", e.Gateway)
+		_, _, ok := quotedEcho(q, true, net.ParseIP(target))
+		assert.True(t, ok)
+	})
+}
+
+func TestQuotedEchoMismatch(t *testing.T) {
+	inner := quotedEcho4(t, testICMPTarget, 1, 1)
+	_, _, ok := quotedEcho(inner, false, net.ParseIP("198.51.100.8"))
+	assert.False(t, ok, "other destination")
+	_, _, ok = quotedEcho(inner[:10], false, net.ParseIP(testICMPTarget))
+	assert.False(t, ok, "truncated")
+	inner[9] = 17
+	_, _, ok = quotedEcho(inner, false, net.ParseIP(testICMPTarget))
+	assert.False(t, ok, "no icmp")
+	_, _, ok = quotedEcho(make([]byte, 10), true, net.ParseIP(testICMPTarget))
+	assert.False(t, ok, "truncated v6")
+}
+
+func TestICMPingMatchError(t *testing.T) {
+	i := &ICMPing{IP: &net.IPAddr{IP: net.ParseIP(testICMPTarget)}, IPType: IPType4, ID: 4711}
+	router := &net.IPAddr{IP: net.ParseIP(testICMPRouter)}
+	raw := marshalICMP(t, &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 10,
+		Body: &icmp.DstUnreach{Data: quotedEcho4(t, testICMPTarget, 4711, 2)}})
+
+	ie := i.matchError(raw, router, 2)
+	if assert.NotNil(t, ie) {
+		assert.Equal(t, icmpStatusProhibited, ie.Status)
+	}
+	assert.Nil(t, i.matchError(raw, router, 3), "other sequence")
+	i.ID = 1
+	assert.Nil(t, i.matchError(raw, router, 2), "other identifier")
+
+	// Log prints the status column
+	var err error = ie
+	var target *ICMPError
+	assert.True(t, errors.As(err, &target))
+	i.Notices = []*ICMPError{{Status: icmpStatusRedirect, Reason: "redirect", Router: testICMPRouter, Gateway: "192.0.2.2"}}
+	i.Log(err)
+}
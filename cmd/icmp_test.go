@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func TestICMPPingLocal(t *testing.T) {
+	if os.Getenv("SKIP_ICMP") != "" {
+		t.Skip("SKIP_ICMP set")
+	}
+	skipIfNoRawICMP(t)
+	t.Cleanup(func() {
+		pingCount = 1
+		pingInterval = 1
+		icmpSize = 56
+	})
+
+	t.Run("session", func(t *testing.T) {
+		i := new(ICMPing)
+		err := i.Open("127.0.0.1")
+		assert.NoError(t, err)
+		defer i.Close()
+		for seq := 1; seq <= 2; seq++ {
+			err = i.Ping(context.Background(), seq)
+			assert.NoErrorf(t, err, "Ping seq %d should not fail", seq)
+			assert.Equal(t, seq, i.Seq)
+			assert.Positive(t, i.Duration)
+		}
+		assert.Zero(t, i.Duplicates)
+	})
+
+	t.Run("CMD ICMP count", func(t *testing.T) {
+		args := []string{
+			"icmp",
+			flagAddress, "127.0.0.1",
+			"-c", "2",
+			"-i", "0.1",
+			"-s", "100",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoErrorf(t, err, "ICMP command should not return an error:%s", err)
+		assert.Contains(t, out, "ICMPing loop with count 2", "ICMP command should run a loop")
+		assert.Contains(t, out, "statistics for 127.0.0.1: sent 2 ok 2 failed 0", "ICMP command should log statistics")
+		assert.Contains(t, out, "ICMPing done", "ICMP command should contain ICMPing done")
+		t.Log(out)
+	})
+}
+
+func TestSameIP(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	assert.True(t, sameIP(&net.IPAddr{IP: ip}, ip))
+	assert.True(t, sameIP(&net.UDPAddr{IP: ip}, ip))
+	assert.False(t, sameIP(&net.IPAddr{IP: net.ParseIP("192.0.2.2")}, ip))
+	assert.False(t, sameIP(&net.TCPAddr{IP: ip}, ip))
+}
+
+func TestICMPPingDgram(t *testing.T) {
+	if os.Getenv("SKIP_ICMP") != "" {
+		t.Skip("SKIP_ICMP set")
+	}
+	i := &ICMPing{IPType: IPType4, IP: &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, received: map[uint16]bool{}}
+	if err := i.listenDgram(IPType4.ListenAddr); err != nil {
+		t.Skipf("skipping ICMP datagram socket: not permitted by net.ipv4.ping_group_range: %v", err)
+	}
+	defer i.Close()
+	assert.Equal(t, icmpModeDgram, i.Mode)
+	assert.IsType(t, &net.UDPAddr{}, i.target())
+	err := i.Ping(context.Background(), 1)
+	assert.NoError(t, err, "Ping via datagram socket should not fail")
+	assert.Positive(t, i.Duration)
+}
+
+func TestICMPTrack(t *testing.T) {
+	i := &ICMPing{received: map[uint16]bool{}}
+	assert.True(t, i.track(1, 1))
+	assert.False(t, i.track(1, 2))
+	assert.Equal(t, 1, i.Duplicates)
+	assert.False(t, i.track(3, 2))
+	assert.Equal(t, 1, i.OutOfOrder)
+	assert.True(t, i.track(2, 2))
+
+	// after 65536 requests the 16 bit sequence number wraps, Ping forgets the reply of the old request
+	delete(i.received, 1)
+	assert.True(t, i.track(1, 65537), "reply with the wrapped sequence number answers the request")
+	assert.False(t, i.track(1, 65537))
+	assert.Equal(t, 2, i.Duplicates)
+}
+
+func TestICMPPingLogPermission(_ *testing.T) {
+	i := &ICMPing{IP: &net.IPAddr{IP: net.ParseIP("127.0.0.1")}}
+	i.Log(os.ErrPermission)
+	i.Log(errors.New("some error"))
+}
+
+func TestICMPRecordSnapshot(t *testing.T) {
+	i := &ICMPing{Address: "127.0.0.1", Seq: 1, Mode: icmpModeRaw}
+	r := i.Record(nil)
+	i.Seq = 2
+	assert.Equal(t, "OPEN", r.Status)
+	assert.Equal(t, 1, r.Data.(*ICMPing).Seq, "record must not change with the session")
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric types of the Prometheus text exposition format
+const (
+	metricGauge     = "gauge"
+	metricCounter   = "counter"
+	metricHistogram = "histogram"
+)
+
+// latencyBuckets are the histogram upper bounds in seconds for probe latencies
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricRegistry keeps metric families and renders them in the Prometheus text format.
+// It is safe for concurrent use by the probe workers and the HTTP handler.
+type metricRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+// metricFamily is a named metric with all its label combinations
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// metricSeries is the value of a family for one label set. Histograms use counts, sum and count.
+type metricSeries struct {
+	labels string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{families: map[string]*metricFamily{}}
+}
+
+// setGauge sets the gauge name for the label pairs to v
+func (r *metricRegistry) setGauge(name, help string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(name, help, metricGauge, nil, labels).value = v
+}
+
+// addCounter increments the counter name for the label pairs by v
+func (r *metricRegistry) addCounter(name, help string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(name, help, metricCounter, nil, labels).value += v
+}
+
+// observe adds v to the histogram name for the label pairs
+func (r *metricRegistry) observe(name, help string, buckets []float64, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.series(name, help, metricHistogram, buckets, labels)
+	for i, b := range buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// series returns the series of a family and label set and creates both if needed
+func (r *metricRegistry) series(name, help, typ string, buckets []float64, labels []string) *metricSeries {
+	f := r.families[name]
+	if f == nil {
+		f = &metricFamily{name: name, help: help, typ: typ, buckets: buckets, series: map[string]*metricSeries{}}
+		r.families[name] = f
+	}
+	key := formatLabels(labels)
+	s := f.series[key]
+	if s == nil {
+		s = &metricSeries{labels: key}
+		if typ == metricHistogram {
+			s.counts = make([]uint64, len(buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// write renders all families sorted by name in the Prometheus text exposition format
+func (r *metricRegistry) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for n := range r.families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, n := range names {
+		r.families[n].write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *metricFamily) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.typ != metricHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, s.labels, formatMetricValue(s.value))
+			continue
+		}
+		for i, le := range f.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", formatMetricValue(le)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, s.labels, formatMetricValue(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, s.labels, s.count)
+	}
+}
+
+// formatLabels renders name/value pairs as {a="1",b="2"} keeping their order
+func formatLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", pairs[i], escapeLabel(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// withLabel appends one label to a rendered label set
+func withLabel(labels, name, value string) string {
+	l := fmt.Sprintf("%s=\"%s\"", name, value)
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return labels[:len(labels)-1] + "," + l + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os/exec"
 	"runtime"
 	"strconv"
@@ -17,42 +18,43 @@ import (
 
 // MTR is a struct that contains the MTR report
 type MTR struct {
-	Report ReportMTR `json:"report"`
+	Report ReportMTR `json:"report" yaml:"report"`
 }
 
 // ReportMTR is a struct that contains the MTR report parts
 type ReportMTR struct {
-	Desc DescMTR   `json:"mtr"`
-	Hops []HopsMTR `json:"hubs"`
+	Desc DescMTR   `json:"mtr" yaml:"mtr"`
+	Hops []HopsMTR `json:"hubs" yaml:"hubs"`
 }
 
 // DescMTR is a struct that contains the MTR call information
 type DescMTR struct {
-	Src        string `json:"src"`
-	Dst        string `json:"dst"`
-	Tos        int    `json:"tos"`
-	Tests      int    `json:"tests"`
-	Psize      string `json:"psize"`
-	Bitpattern string `json:"bitpattern"`
+	Src        string `json:"src" yaml:"src"`
+	Dst        string `json:"dst" yaml:"dst"`
+	Tos        int    `json:"tos" yaml:"tos"`
+	Tests      int    `json:"tests" yaml:"tests"`
+	Psize      string `json:"psize" yaml:"psize"`
+	Bitpattern string `json:"bitpattern" yaml:"bitpattern"`
 }
 
 // HopsMTR is a struct that contains the MTR hop information
 type HopsMTR struct {
-	Count int     `json:"count"`
-	Host  string  `json:"host"`
-	Loss  float64 `json:"Loss%"`
-	Snt   int     `json:"Snt"`
-	Last  float64 `json:"Last"`
-	Avg   float64 `json:"Avg"`
-	Best  float64 `json:"Best"`
-	Wrst  float64 `json:"Wrst"`
-	StDev float64 `json:"StDev"`
+	Count int     `json:"count" yaml:"count"`
+	Host  string  `json:"host" yaml:"host"`
+	IP    string  `json:"ip,omitempty" yaml:"ip,omitempty"`
+	Loss  float64 `json:"Loss%" yaml:"Loss%"`
+	Snt   int     `json:"Snt" yaml:"Snt"`
+	Last  float64 `json:"Last" yaml:"Last"`
+	Avg   float64 `json:"Avg" yaml:"Avg"`
+	Best  float64 `json:"Best" yaml:"Best"`
+	Wrst  float64 `json:"Wrst" yaml:"Wrst"`
+	StDev float64 `json:"StDev" yaml:"StDev"`
 }
 
 var (
 	mtrCmd = &cobra.Command{
 		Use:          "mtr",
-		Short:        "Traceroute using MTR",
+		Short:        "Traceroute using the native engine or MTR",
 		Long:         ``,
 		RunE:         runMTR,
 		SilenceUsage: true,
@@ -65,19 +67,54 @@ const osWin = "windows"
 
 func init() {
 	mtrCmd.Flags().StringVarP(&queryAddress, "address", "a", "", "ip/host to ping")
-	mtrCmd.Flags().StringVarP(&queryPort, "port", "p", "", "tcp port to ping")
+	mtrCmd.Flags().StringVarP(&queryPort, "port", "p", "", "tcp port to ping, base port for udp probes")
 	mtrCmd.Flags().StringVarP(&mtrBin, "mtr", "m", mtrBin, "mtr binary path or use MTR_BIN env var")
-	mtrCmd.Flags().BoolVarP(&tcpFlag, "tcp", "t", false, "use TCP instead of ICMP")
-	os := runtime.GOOS
-	if os != osWin {
-		// mtr cli is not available on windows
-		RootCmd.AddCommand(mtrCmd)
+	mtrCmd.Flags().BoolVarP(&tcpFlag, "tcp", "t", false, "use TCP instead of ICMP (same as --proto tcp)")
+	mtrCmd.Flags().StringVar(&traceEngine, "engine", traceEngine, "traceroute engine: native or mtr")
+	mtrCmd.Flags().StringVar(&traceProto, "proto", traceProto, "probe protocol: icmp, udp or tcp")
+	mtrCmd.Flags().IntVarP(&traceCount, "count", "c", traceCount, "probes per hop")
+	mtrCmd.Flags().IntVar(&traceMaxHops, "max-hops", traceMaxHops, "maximum number of hops")
+	mtrCmd.Flags().IntVar(&traceTimeout, "timeout", traceTimeout, "seconds to wait for the answers of a probe round")
+	mtrCmd.Flags().BoolVarP(&traceNumeric, "numeric", "n", false, "do not resolve hop addresses to names")
+	mtrCmd.Flags().IntVar(&traceMultipath, "multipath", 0, "number of flows to probe for ECMP path enumeration (icmp/udp, native engine)")
+	RootCmd.AddCommand(mtrCmd)
+}
+
+// checkTraceFlags validates engine and protocol settings of the mtr command
+func checkTraceFlags() error {
+	if tcpFlag {
+		traceProto = traceProtoTCP
+	}
+	switch traceProto {
+	case traceProtoICMP, traceProtoUDP, traceProtoTCP:
+	default:
+		return fmt.Errorf("invalid protocol %s, use icmp, udp or tcp", traceProto)
+	}
+	switch traceEngine {
+	case traceEngineNative:
+	case traceEngineMTR:
+		if runtime.GOOS == osWin {
+			// mtr cli is not available on windows
+			return fmt.Errorf("mtr engine is not available on %s", osWin)
+		}
+		if !common.CommandExists(mtrBin) {
+			return fmt.Errorf("mtr command '%s' not found", mtrBin)
+		}
+	default:
+		return fmt.Errorf("invalid engine %s, use native or mtr", traceEngine)
 	}
+	if traceMultipath > 0 && (traceEngine != traceEngineNative || traceProto == traceProtoTCP) {
+		return fmt.Errorf("multipath trace needs the native engine with icmp or udp probes")
+	}
+	if traceCount < 1 || traceMaxHops < 1 || traceMaxHops > 255 {
+		return fmt.Errorf("count must be positive and max-hops between 1 and 255")
+	}
+	return nil
 }
 
 func runMTR(_ *cobra.Command, args []string) error {
-	if !common.CommandExists(mtrBin) {
-		return fmt.Errorf("mtr command '%s' not found", mtrBin)
+	if err := checkTraceFlags(); err != nil {
+		return err
 	}
 	if len(args) > 0 {
 		queryAddress = args[0]
@@ -89,14 +126,18 @@ func runMTR(_ *cobra.Command, args []string) error {
 		queryPort = args[1]
 		queryAddress = queryAddress + ":" + queryPort
 	}
-	host, port, err := common.GetHostPort(queryAddress)
-	if err != nil {
-		return err
-	}
-	if port > 0 && queryPort == "" {
-		queryPort = fmt.Sprintf("%d", port)
+	host := queryAddress
+	if net.ParseIP(host) == nil {
+		h, port, err := common.GetHostPort(queryAddress)
+		if err != nil {
+			return err
+		}
+		host = h
+		if port > 0 && queryPort == "" {
+			queryPort = fmt.Sprintf("%d", port)
+		}
 	}
-	if queryPort == "" && tcpFlag {
+	if queryPort == "" && traceProto == traceProtoTCP {
 		return fmt.Errorf("please specify a port to ping")
 	}
 
@@ -104,30 +145,54 @@ func runMTR(_ *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	var mtr = new(MTR)
+	log.Debugf("MTR engine %s proto %s", traceEngine, traceProto)
 	for _, ip := range ips {
 		a := ip.String()
-		err = mtr.Run(a, queryPort, tcpFlag)
+		if traceMultipath > 0 {
+			report, err := RunMultipath(a, queryPort, traceProto, traceMultipath)
+			if err != nil {
+				emitMTRError(a, err)
+				continue
+			}
+			emit(newResult("mtr", a, "OK", nil, report), report.Log)
+			continue
+		}
+		var mtr = new(MTR)
+		if traceEngine == traceEngineMTR {
+			err = mtr.Run(a, queryPort, traceProto)
+		} else {
+			err = mtr.RunNative(a, queryPort, traceProto)
+		}
 		if err != nil {
-			fmt.Printf("%s%s\n", cyan("%-7s", "MTR"), red("%-10s", err))
+			emitMTRError(a, err)
 			continue
 		}
-		mtr.Log()
+		emit(newResult("mtr", a, "OK", nil, mtr.Report), mtr.Log)
 	}
 	log.Debugf("MTR done")
 	return nil
 }
 
+// emitMTRError reports a failed trace to ip
+func emitMTRError(ip string, err error) {
+	emit(newResult("mtr", ip, "ERROR", err, nil), func() {
+		fmt.Printf("%s%s\n", cyan("%-7s", "MTR"), red("%-10s", err))
+	})
+}
+
 // Log logs the mtr results
 func (mtr *MTR) Log() {
 	log.Debugf("entr log MTR to %s", mtr.Report.Desc.Dst)
+	fmt.Printf("%s %3s %-50s %7s %4s %7s %7s %7s %7s %7s\n", cyan("%-4s", "Hop"), "", "Host", "Loss", "Snt", "Last", "Avg", "Best", "Wrst", "StDev")
 	for _, h := range mtr.Report.Hops {
-		fmt.Printf("%s %3d %-60s Loss: %6.2f%% Avg:%6.2fms\n", cyan("%-4s", "Hop"), h.Count, h.Host, h.Loss, h.Avg)
+		log.Debugf("hop %d %s loss %.1f", h.Count, h.Host, h.Loss)
+		fmt.Printf("%s %3d %-50s %s %4d %7.2f %7.2f %7.2f %7.2f %7.2f\n", cyan("%-4s", "Hop"), h.Count, h.Host,
+			lossColor(h.Loss)("%6.1f%%", h.Loss), h.Snt, h.Last, h.Avg, h.Best, h.Wrst, h.StDev)
 	}
 }
 
-// Run runs system mtr command and returns the IP addresses of the hops
-func (mtr *MTR) Run(ip string, port string, t bool) (err error) {
+// Run runs system mtr command with icmp, udp or tcp probes and returns the IP addresses of the hops
+func (mtr *MTR) Run(ip string, port string, proto string) (err error) {
 	var cmd *exec.Cmd
 	log.Debugf("use mtr as %s", mtrBin)
 	cmd = exec.Command(mtrBin, "-v")
@@ -139,14 +204,20 @@ func (mtr *MTR) Run(ip string, port string, t bool) (err error) {
 	log.Debugf("mtr version: %s", string(out))
 	log.Debugf("start mtr to %s", ip)
 	txt := ip
-	if t {
-		cmd = exec.Command(mtrBin, "-j", ip, "-T", "-P", port)
+	c := strconv.Itoa(traceCount)
+	switch proto {
+	case traceProtoTCP:
+		cmd = exec.Command(mtrBin, "-j", "-c", c, ip, "-T", "-P", port)
 		txt = ip + ":" + port
-	} else {
-		cmd = exec.Command(mtrBin, "-j", ip)
+	case traceProtoUDP:
+		cmd = exec.Command(mtrBin, "-j", "-c", c, ip, "-u")
+	default:
+		cmd = exec.Command(mtrBin, "-j", "-c", c, ip)
 	}
 	log.Debugf("mtr command %s", strings.Join(cmd.Args, " "))
-	fmt.Printf("Waiting for MTR results to %s ...\n", txt)
+	if textOutput() {
+		fmt.Printf("Waiting for MTR results to %s ...\n", txt)
+	}
 	out, err = cmd.CombinedOutput()
 	if err != nil {
 		log.Debugf("error running mtr: %v:%s", err, string(out))
@@ -109,12 +109,18 @@ func TestMTR(t *testing.T) {
 	if !common.CommandExists(mtr) {
 		t.Skip("Skipping MTR test, not found")
 	}
+	t.Cleanup(func() {
+		traceEngine = traceEngineNative
+		traceProto = traceProtoICMP
+		tcpFlag = false
+	})
 
 	t.Run("CMD MTR", func(t *testing.T) {
 		args := []string{
 			"mtr",
 			flagAddress, testURL,
 			"-t",
+			"--engine", "mtr",
 			"-m", mtr,
 			flagUnitTest,
 			flagDebug,
@@ -0,0 +1,431 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// multipath tracing follows the Paris/Dublin traceroute approach: all probes of one flow keep the
+// header fields load balancers hash on constant, while different flows vary them in a controlled way.
+// ICMP flows differ by the echo checksum (compensated in the payload), UDP flows by the source port.
+// The TTL of a UDP probe is encoded in the datagram length, which is not part of the flow hash.
+// The probes of a flow and TTL have the same key in every round, so the round is sent along to keep
+// a late answer from matching the probe of the next round: ICMP probes carry it in the echo identifier,
+// UDP probes add 256 bytes to the length in odd rounds.
+
+const maxTraceFlows = 255
+
+var traceMultipath = 0
+
+// MultipathReport lists the next hops per TTL and the distinct paths found by probing several flows
+type MultipathReport struct {
+	Dst   string          `json:"dst" yaml:"dst"`
+	Proto string          `json:"proto" yaml:"proto"`
+	Flows int             `json:"flows" yaml:"flows"`
+	Tests int             `json:"tests" yaml:"tests"`
+	Hops  []MultipathHop  `json:"hops" yaml:"hops"`
+	Paths []MultipathPath `json:"paths" yaml:"paths"`
+}
+
+// MultipathHop contains all next hops seen at one TTL
+type MultipathHop struct {
+	TTL      int       `json:"ttl" yaml:"ttl"`
+	NextHops []NextHop `json:"next_hops" yaml:"next_hops"`
+}
+
+// NextHop is a router answering at a TTL for a set of flows
+type NextHop struct {
+	Host  string  `json:"host" yaml:"host"`
+	Flows []int   `json:"flows" yaml:"flows"`
+	Sent  int     `json:"sent" yaml:"sent"`
+	Recv  int     `json:"received" yaml:"received"`
+	Loss  float64 `json:"loss" yaml:"loss"`
+}
+
+// MultipathPath is a distinct sequence of hops shared by a set of flows.
+// Sent, Recv and Loss refer to the last hop of the path.
+type MultipathPath struct {
+	Hops    []string `json:"hops" yaml:"hops"`
+	Flows   []int    `json:"flows" yaml:"flows"`
+	Sent    int      `json:"sent" yaml:"sent"`
+	Recv    int      `json:"received" yaml:"received"`
+	Loss    float64  `json:"loss" yaml:"loss"`
+	Reached bool     `json:"reached" yaml:"reached"`
+}
+
+// flowHop collects the answers of one flow at one TTL
+type flowHop struct {
+	sent  int
+	ok    int
+	hosts map[string]int
+}
+
+// probeKey returns the probe identifier of a flow and TTL in multipath mode
+func probeKey(flow, ttl int) int {
+	return flow<<8 | ttl
+}
+
+// echoID returns the ICMP echo identifier of a probe, in multipath mode it carries the round
+func (t *nativeTracer) echoID(p *traceProbe) int {
+	if t.flows == 0 {
+		return t.id
+	}
+	return (t.id + p.round) & 0xffff
+}
+
+// echoRound returns the round of an ICMP echo identifier or -1 if it is none of this tracer
+func (t *nativeTracer) echoRound(id int) int {
+	switch {
+	case t.flows > 0:
+		return (id - t.id) & 0xffff
+	case id == t.id:
+		return 0
+	}
+	return -1
+}
+
+// matchRound returns seq if the pending probe was sent in round, compared in the bits of mask the
+// probe header carries, else -1. Single path probes have unique keys and are not checked.
+func (t *nativeTracer) matchRound(seq, round, mask int) int {
+	if seq < 0 || t.flows == 0 {
+		return seq
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[seq]; ok && p.round&mask == round {
+		return seq
+	}
+	return -1
+}
+
+// flowTarget returns the ICMP echo checksum used by a flow
+func flowTarget(flow int) uint16 {
+	return uint16(0x1000 + flow) //nolint:gosec // flow is limited to maxTraceFlows
+}
+
+// newMultipathTracer opens a tracer probing flows parallel flows to ip
+func newMultipathTracer(ip net.IP, proto string, port int, flows int) (*nativeTracer, error) {
+	if proto == traceProtoTCP {
+		return nil, fmt.Errorf("multipath trace supports icmp and udp probes only")
+	}
+	if flows < 1 || flows > maxTraceFlows {
+		return nil, fmt.Errorf("number of flows must be between 1 and %d", maxTraceFlows)
+	}
+	t, err := newNativeTracer(ip, proto, port)
+	if err != nil {
+		return nil, err
+	}
+	t.flows = flows
+	switch proto {
+	case traceProtoUDP:
+		t.flowPorts = map[int]int{}
+		for f := 0; f < flows; f++ {
+			c, err := net.ListenPacket("udp"+t.ipType.Type, "")
+			if err != nil {
+				t.Close()
+				return nil, err
+			}
+			t.flowConns = append(t.flowConns, c)
+			t.flowPorts[c.LocalAddr().(*net.UDPAddr).Port] = f
+		}
+	case traceProtoICMP:
+		if t.ipType.Type == IPType6.Type {
+			// the ICMPv6 checksum covers the source address
+			t.srcIP, err = localIPFor(ip)
+			if err != nil {
+				t.Close()
+				return nil, err
+			}
+		}
+	}
+	log.Debugf("multipath trace to %s with %d %s flows", ip, flows, proto)
+	return t, nil
+}
+
+// localIPFor returns the source address the system uses to reach dst
+func localIPFor(dst net.IP) (net.IP, error) {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: traceUDPBasePort})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = c.Close() }()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// flowChecksum sets the first two payload bytes of an echo request so that the ICMP checksum
+// equals the target checksum of the flow, independent of the sequence number
+func (t *nativeTracer) flowChecksum(p *traceProbe, data []byte) {
+	b := make([]byte, 8+len(data))
+	b[0] = byte(typeNumber(t.ipType.RequestMessageType))
+	binary.BigEndian.PutUint16(b[4:6], uint16(t.echoID(p)))  //nolint:gosec // 16bit id
+	binary.BigEndian.PutUint16(b[6:8], uint16(p.seq&0xffff)) //nolint:gosec // 16bit sequence
+	copy(b[10:], data[2:])
+	var sum uint32
+	if t.ipType.Type == IPType6.Type {
+		ph := make([]byte, 40)
+		copy(ph[0:16], t.srcIP.To16())
+		copy(ph[16:32], t.dst.To16())
+		binary.BigEndian.PutUint32(ph[32:36], uint32(len(b))) //nolint:gosec // small packet
+		ph[39] = byte(IPType6.ProtocolNumber)
+		sum = onesSum(sum, ph)
+	}
+	sum = onesSum(sum, b)
+	// the final checksum is the complement of the folded sum, so the sum including the
+	// compensation word x has to be the complement of the target: x = ^target - sum
+	x := onesFold(uint32(^flowTarget(p.flow)) + uint32(^onesFold(sum)))
+	binary.BigEndian.PutUint16(data[0:2], x)
+}
+
+// onesSum adds the 16bit words of b to sum
+func onesSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// onesFold folds a 32bit sum to a 16bit ones complement sum
+func onesFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum) //nolint:gosec // folded to 16bit
+}
+
+// sendFlowUDP sends a UDP probe on the socket of its flow, the length encodes the TTL and the round
+func (t *nativeTracer) sendFlowUDP(p *traceProbe) error {
+	c := t.flowConns[p.flow]
+	if err := t.setTTL(c, p.ttl); err != nil {
+		return err
+	}
+	_, err := c.WriteTo(make([]byte, len(t.payload())+(p.round&1)<<8+p.ttl), &net.UDPAddr{IP: t.dst, Port: t.base})
+	return err
+}
+
+// quotedFlowUDP returns the probe key of a quoted UDP header or -1 if it is no probe of this tracer
+func (t *nativeTracer) quotedFlowUDP(src, dst int, payload []byte) int {
+	flow, ok := t.flowPorts[src]
+	if !ok || dst != t.base {
+		return -1
+	}
+	n := int(binary.BigEndian.Uint16(payload[4:6])) - 8 - len(t.payload())
+	ttl := n & 0xff
+	if n < 0 || ttl < 1 {
+		return -1
+	}
+	return t.matchRound(probeKey(flow, ttl), n>>8, 1)
+}
+
+// RunMultipath sends count rounds of probes for all flows and returns the next hops and paths
+func (t *nativeTracer) RunMultipath(count, maxHops int) *MultipathReport {
+	stop := make(chan struct{})
+	go t.receive(stop)
+	defer close(stop)
+
+	grid := make([][]*flowHop, t.flows)
+	for f := range grid {
+		grid[f] = make([]*flowHop, maxHops+1)
+		for ttl := 1; ttl <= maxHops; ttl++ {
+			grid[f][ttl] = &flowHop{hosts: map[string]int{}}
+		}
+	}
+	end := make([]int, t.flows)
+	reached := make([]bool, t.flows)
+	maxTTL := maxHops
+	for r := 1; r <= count; r++ {
+		for _, p := range t.round(maxTTL) {
+			h := grid[p.flow][p.ttl]
+			h.sent++
+			if !p.ok {
+				continue
+			}
+			h.ok++
+			h.hosts[p.host]++
+			if (p.reached || p.final) && (end[p.flow] == 0 || p.ttl < end[p.flow]) {
+				end[p.flow] = p.ttl
+				reached[p.flow] = p.reached
+			}
+		}
+		// shorten the rounds to the longest path once every flow found its end
+		longest := 0
+		for _, e := range end {
+			if e == 0 {
+				longest = maxTTL
+				break
+			}
+			longest = max(longest, e)
+		}
+		maxTTL = longest
+		log.Debugf("multipath round %d done, path length %d", r, maxTTL)
+	}
+	return t.multipathReport(grid, end, reached, count)
+}
+
+// multipathReport groups the flow answers by next hop and by complete path
+func (t *nativeTracer) multipathReport(grid [][]*flowHop, end []int, reached []bool, count int) *MultipathReport {
+	report := &MultipathReport{Dst: t.dst.String(), Proto: t.proto, Flows: t.flows, Tests: count}
+	length, longest := flowLengths(grid, end)
+	for ttl := 1; ttl <= longest; ttl++ {
+		next := map[string]*NextHop{}
+		for f := range grid {
+			if ttl > length[f] {
+				continue
+			}
+			h := grid[f][ttl]
+			host := flowHost(h)
+			nh, ok := next[host]
+			if !ok {
+				nh = &NextHop{Host: host}
+				next[host] = nh
+			}
+			nh.Flows = append(nh.Flows, f)
+			nh.Sent += h.sent
+			nh.Recv += h.ok
+		}
+		hop := MultipathHop{TTL: ttl}
+		for _, nh := range next {
+			nh.Loss = lossPercent(nh.Sent, nh.Recv)
+			hop.NextHops = append(hop.NextHops, *nh)
+		}
+		sort.Slice(hop.NextHops, func(i, j int) bool { return hop.NextHops[i].Host < hop.NextHops[j].Host })
+		report.Hops = append(report.Hops, hop)
+	}
+	report.Paths = multipathPaths(grid, length, reached)
+	return report
+}
+
+// flowLengths returns the path length of each flow and the longest one. The path of a flow ends at
+// its end TTL or, if the end is unknown, at the last answering hop.
+func flowLengths(grid [][]*flowHop, end []int) (length []int, longest int) {
+	length = make([]int, len(grid))
+	for f := range grid {
+		length[f] = end[f]
+		if length[f] == 0 {
+			length[f] = 1
+			for ttl := len(grid[f]) - 1; ttl > 0; ttl-- {
+				if grid[f][ttl].ok > 0 {
+					length[f] = ttl
+					break
+				}
+			}
+		}
+		longest = max(longest, length[f])
+	}
+	return
+}
+
+// multipathPaths groups flows with the same sequence of hops, sorted by the number of flows
+func multipathPaths(grid [][]*flowHop, length []int, reached []bool) []MultipathPath {
+	paths := map[string]*MultipathPath{}
+	var keys []string
+	for f := range grid {
+		hops := make([]string, 0, length[f])
+		for ttl := 1; ttl <= length[f]; ttl++ {
+			hops = append(hops, flowHost(grid[f][ttl]))
+		}
+		key := strings.Join(hops, " ")
+		p, ok := paths[key]
+		if !ok {
+			p = &MultipathPath{Hops: hops, Reached: reached[f]}
+			paths[key] = p
+			keys = append(keys, key)
+		}
+		last := grid[f][length[f]]
+		p.Flows = append(p.Flows, f)
+		p.Sent += last.sent
+		p.Recv += last.ok
+	}
+	result := make([]MultipathPath, 0, len(keys))
+	for _, k := range keys {
+		p := paths[k]
+		p.Loss = lossPercent(p.Sent, p.Recv)
+		result = append(result, *p)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return len(result[i].Flows) > len(result[j].Flows) })
+	return result
+}
+
+// flowHost returns the most frequent responder of a flow hop or a placeholder for a silent hop
+func flowHost(h *flowHop) string {
+	if ip := mostFrequent(h.hosts); ip != "" {
+		return ip
+	}
+	return "*"
+}
+
+// lossPercent returns the percentage of unanswered probes
+func lossPercent(sent, recv int) float64 {
+	if sent == 0 {
+		return 0
+	}
+	return float64(sent-recv) * 100 / float64(sent)
+}
+
+// RunMultipath traces ip with flows parallel flows to enumerate ECMP paths
+func RunMultipath(ip string, port string, proto string, flows int) (*MultipathReport, error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return nil, fmt.Errorf("invalid ip address %s", ip)
+	}
+	p, err := tracePort(port)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newMultipathTracer(dst, proto, p, flows)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	if textOutput() {
+		fmt.Printf("Waiting for %s multipath trace results to %s with %d flows ...\n", strings.ToUpper(proto), ip, flows)
+	}
+	start := time.Now()
+	report := t.RunMultipath(traceCount, traceMaxHops)
+	log.Debugf("multipath trace to %s took %v", ip, time.Since(start))
+	return report, nil
+}
+
+// Log prints the next hops per TTL and the distinct paths
+func (r *MultipathReport) Log() {
+	log.Debugf("log multipath trace to %s", r.Dst)
+	fmt.Printf("%s%s%s  proto %s  flows %d  probes %d\n", cyan("%-7s", "MTR"), cyan("%-10s", "MULTIPATH"), r.Dst, r.Proto, r.Flows, r.Tests)
+	for _, h := range r.Hops {
+		for i, nh := range h.NextHops {
+			ttl := ""
+			if i == 0 {
+				ttl = fmt.Sprintf("%d", h.TTL)
+			}
+			fmt.Printf("%s %3s %-40s flows %-3d %s\n", cyan("%-4s", "Hop"), ttl, nh.Host, len(nh.Flows), lossColor(nh.Loss)("loss %5.1f%%", nh.Loss))
+			log.Debugf("hop %d next hop %s flows %v loss %.1f", h.TTL, nh.Host, nh.Flows, nh.Loss)
+		}
+	}
+	for i, p := range r.Paths {
+		status := "reached"
+		if !p.Reached {
+			status = "incomplete"
+		}
+		fmt.Printf("%s %3d flows %-3d %s %-10s %s\n", cyan("%-4s", "Path"), i+1, len(p.Flows), lossColor(p.Loss)("loss %5.1f%%", p.Loss),
+			status, strings.Join(p.Hops, " > "))
+		log.Debugf("path %d %s flows %v loss %.1f %s", i+1, strings.Join(p.Hops, " > "), p.Flows, p.Loss, status)
+	}
+}
+
+// lossColor returns the color function for a loss percentage
+func lossColor(loss float64) func(format string, a ...interface{}) string {
+	switch {
+	case loss >= 100:
+		return red
+	case loss > 0:
+		return yellow
+	}
+	return green
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestFlowChecksum(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ipType IPType
+		dst    net.IP
+		src    net.IP
+	}{
+		{"IPv4", IPType4, net.ParseIP("192.0.2.1"), nil},
+		{"IPv6", IPType6, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &nativeTracer{ipType: tc.ipType, dst: tc.dst, srcIP: tc.src, id: 0x4242, flows: 8}
+			for _, flow := range []int{0, 3, 7} {
+				for ttl := 1; ttl <= 30; ttl += 7 {
+					p := &traceProbe{flow: flow, ttl: ttl, seq: probeKey(flow, ttl), round: ttl}
+					data := tr.payload()
+					tr.flowChecksum(p, data)
+					m := icmp.Message{Type: tc.ipType.RequestMessageType, Body: &icmp.Echo{ID: tr.echoID(p), Seq: p.seq, Data: data}}
+					var psh []byte
+					if tc.src != nil {
+						psh = icmp.IPv6PseudoHeader(tc.src, tc.dst)
+					}
+					b, err := m.Marshal(psh)
+					require.NoError(t, err)
+					assert.Equal(t, flowTarget(flow), binary.BigEndian.Uint16(b[2:4]), "flow %d ttl %d checksum", flow, ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipathRound(t *testing.T) {
+	dst := net.ParseIP("192.0.2.1")
+	newProbe := func(tr *nativeTracer, round int) *traceProbe {
+		p := &traceProbe{flow: 1, ttl: 3, seq: probeKey(1, 3), round: round, sent: time.Now(), answered: make(chan struct{})}
+		tr.pending = map[int]*traceProbe{p.seq: p}
+		return p
+	}
+	t.Run("icmp", func(t *testing.T) {
+		tr := &nativeTracer{dst: dst, ipType: IPType4, proto: traceProtoICMP, id: 0x4242, flows: 2}
+		p := newProbe(tr, 5)
+		reply := func(round int) []byte {
+			b, err := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 0x4242 + round, Seq: probeKey(1, 3)}}).Marshal(nil)
+			require.NoError(t, err)
+			return b
+		}
+		tr.handle(reply(4), &net.IPAddr{IP: dst}, time.Now())
+		assert.False(t, p.ok, "late answer of the previous round")
+		tr.handle(reply(5), &net.IPAddr{IP: dst}, time.Now())
+		assert.True(t, p.ok)
+	})
+	t.Run("udp", func(t *testing.T) {
+		tr := &nativeTracer{dst: dst, ipType: IPType4, proto: traceProtoUDP, base: traceUDPBasePort, flows: 2,
+			flowPorts: map[int]int{40001: 1}}
+		quoted := func(round int) []byte {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint16(b[0:2], 40001)
+			binary.BigEndian.PutUint16(b[2:4], traceUDPBasePort)
+			binary.BigEndian.PutUint16(b[4:6], uint16(8+len(tr.payload())+(round&1)<<8+3)) //nolint:gosec // small length
+			return b
+		}
+		newProbe(tr, 4)
+		assert.Equal(t, -1, tr.quotedSeq(syscall.IPPROTO_UDP, quoted(3)), "late answer of the previous round")
+		assert.Equal(t, probeKey(1, 3), tr.quotedSeq(syscall.IPPROTO_UDP, quoted(4)))
+	})
+}
+
+func TestMultipathReport(t *testing.T) {
+	tr := &nativeTracer{dst: net.ParseIP("192.0.2.1"), proto: traceProtoUDP, flows: 3}
+	hop := func(sent, ok int, host string) *flowHop {
+		h := &flowHop{sent: sent, ok: ok, hosts: map[string]int{}}
+		if ok > 0 {
+			h.hosts[host] = ok
+		}
+		return h
+	}
+	// flows 0 and 2 use branch 10.0.0.2, flow 1 uses the lossy branch 10.0.0.3
+	grid := [][]*flowHop{
+		{nil, hop(4, 4, "10.0.0.1"), hop(4, 4, "10.0.0.2"), hop(4, 4, "192.0.2.1")},
+		{nil, hop(4, 4, "10.0.0.1"), hop(4, 2, "10.0.0.3"), hop(4, 2, "192.0.2.1")},
+		{nil, hop(4, 4, "10.0.0.1"), hop(4, 4, "10.0.0.2"), hop(4, 4, "192.0.2.1")},
+	}
+	r := tr.multipathReport(grid, []int{3, 3, 3}, []bool{true, true, true}, 4)
+	require.Len(t, r.Hops, 3)
+	require.Len(t, r.Hops[0].NextHops, 1)
+	assert.Equal(t, []int{0, 1, 2}, r.Hops[0].NextHops[0].Flows)
+	require.Len(t, r.Hops[1].NextHops, 2)
+	assert.Equal(t, "10.0.0.2", r.Hops[1].NextHops[0].Host)
+	assert.Equal(t, []int{0, 2}, r.Hops[1].NextHops[0].Flows)
+	assert.Equal(t, "10.0.0.3", r.Hops[1].NextHops[1].Host)
+	assert.InDelta(t, 50.0, r.Hops[1].NextHops[1].Loss, 0.01)
+	require.Len(t, r.Paths, 2)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "192.0.2.1"}, r.Paths[0].Hops)
+	assert.Equal(t, []int{0, 2}, r.Paths[0].Flows)
+	assert.Zero(t, r.Paths[0].Loss)
+	assert.Equal(t, []int{1}, r.Paths[1].Flows)
+	assert.InDelta(t, 50.0, r.Paths[1].Loss, 0.01)
+	assert.True(t, r.Paths[1].Reached)
+}
+
+func TestMultipathLocal(t *testing.T) {
+	skipIfNoRawICMP(t)
+	t.Cleanup(func() {
+		traceProto = traceProtoICMP
+		traceCount = 10
+		traceMultipath = 0
+	})
+	for _, proto := range []string{traceProtoICMP, traceProtoUDP} {
+		t.Run("session "+proto, func(t *testing.T) {
+			tr, err := newMultipathTracer(net.ParseIP("127.0.0.1"), proto, 0, 4)
+			require.NoError(t, err)
+			defer tr.Close()
+			r := tr.RunMultipath(2, 5)
+			require.Len(t, r.Paths, 1, "loopback has a single path")
+			assert.Equal(t, []string{"127.0.0.1"}, r.Paths[0].Hops)
+			assert.Equal(t, []int{0, 1, 2, 3}, r.Paths[0].Flows)
+			assert.True(t, r.Paths[0].Reached)
+			assert.Zero(t, r.Paths[0].Loss)
+		})
+	}
+	t.Run("tcp not supported", func(t *testing.T) {
+		_, err := newMultipathTracer(net.ParseIP("127.0.0.1"), traceProtoTCP, 80, 4)
+		assert.Error(t, err)
+	})
+	t.Run("CMD multipath udp", func(t *testing.T) {
+		args := []string{
+			"mtr",
+			flagAddress, "127.0.0.1",
+			"--proto", "udp",
+			"--multipath", "4",
+			"-c", "2",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Contains(t, out, "path 1 127.0.0.1 flows [0 1 2 3] loss 0.0 reached")
+		assert.Contains(t, out, "MTR done")
+		t.Log(out)
+	})
+}
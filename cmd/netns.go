@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommi2day/gomodules/netlib"
+)
+
+const (
+	// netnsDir holds the named network namespaces of ip netns
+	netnsDir = "/var/run/netns"
+	// netnsEnv marks the process started inside the network namespace
+	netnsEnv = "TCPING2_NETNS"
+)
+
+var (
+	netnsName string
+	vrfName   string
+	// netnsEtcDir holds the configuration files ip netns exec mounts over /etc
+	netnsEtcDir = "/etc/netns"
+)
+
+// netnsPath returns the file of a named network namespace, a name with a slash is used as path
+// like /proc/1234/ns/net
+func netnsPath(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return filepath.Join(netnsDir, name)
+}
+
+// netnsNameserver returns the first name server of the resolv.conf of a named network namespace,
+// ip netns exec uses this file as /etc/resolv.conf
+func netnsNameserver(name string) string {
+	if strings.Contains(name, "/") {
+		return ""
+	}
+	f, err := os.Open(filepath.Join(netnsEtcDir, name, "resolv.conf"))
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = f.Close() }()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) > 1 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// bindDevice returns the device the sockets are bound to: the --interface or the --vrf master device
+func bindDevice() string {
+	if sourceInterface != "" {
+		return sourceInterface
+	}
+	return vrfName
+}
+
+// vrfResolver returns a resolver sending the DNS queries of cfg through the VRF device
+func vrfResolver(cfg *netlib.DNSconfig) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if cfg.Nameserver != "" {
+				network = "udp"
+				if cfg.TCP {
+					network = "tcp"
+				}
+				address = net.JoinHostPort(cfg.Nameserver, "53")
+				if cfg.Port > 0 {
+					address = net.JoinHostPort(cfg.Nameserver, strconv.Itoa(cfg.Port))
+				}
+			}
+			log.Debugf("DNS query to %s via VRF %s", address, vrfName)
+			d := net.Dialer{Timeout: cfg.Timeout, Control: func(_, _ string, c syscall.RawConn) error {
+				return controlDevice(c, vrfName)
+			}}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
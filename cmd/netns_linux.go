@@ -0,0 +1,47 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// enterNetns moves the process into the network namespace. Go starts new threads from a template
+// thread outside of a namespace entered with setns, so the locked thread enters the namespace and
+// executes the program again. All threads of the new process are created in the namespace.
+func enterNetns(name string) error {
+	if os.Getenv(netnsEnv) == name {
+		log.Debugf("running in network namespace %s", name)
+		return nil
+	}
+	path := netnsPath(name)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open network namespace %s: %w", name, err)
+	}
+	defer func() { _ = f.Close() }()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// the thread is never unlocked, it is replaced by exec or the program exits with the error
+	runtime.LockOSThread()
+	if err = unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("enter network namespace %s: %w", name, err)
+	}
+	log.Debugf("entered network namespace %s, restart %s", path, exe)
+	env := []string{netnsEnv + "=" + name}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, netnsEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	return syscall.Exec(exe, os.Args, env)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package cmd
+
+import "errors"
+
+// enterNetns is only available on Linux
+func enterNetns(_ string) error {
+	return errors.New("--netns is only supported on Linux")
+}
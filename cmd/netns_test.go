@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+	"github.com/tommi2day/gomodules/netlib"
+)
+
+func resetNetns(t *testing.T) {
+	t.Cleanup(func() {
+		netnsName = ""
+		vrfName = ""
+		netnsEtcDir = "/etc/netns"
+	})
+}
+
+func TestNetnsPath(t *testing.T) {
+	assert.Equal(t, "/var/run/netns/blue", netnsPath("blue"))
+	assert.Equal(t, "/proc/1/ns/net", netnsPath("/proc/1/ns/net"))
+}
+
+func TestNetnsNameserver(t *testing.T) {
+	resetNetns(t)
+	netnsEtcDir = t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(netnsEtcDir, "blue"), 0755))
+	conf := "# resolver of blue\nsearch example.com\nnameserver 10.1.1.53\nnameserver 10.1.1.54\n"
+	require.NoError(t, os.WriteFile(filepath.Join(netnsEtcDir, "blue", "resolv.conf"), []byte(conf), 0600))
+	assert.Equal(t, "10.1.1.53", netnsNameserver("blue"))
+	assert.Empty(t, netnsNameserver("red"), "no resolv.conf")
+	assert.Empty(t, netnsNameserver("/proc/1/ns/net"), "namespace path has no resolv.conf")
+}
+
+func TestBindDevice(t *testing.T) {
+	resetNetns(t)
+	resetSource(t)
+	assert.Empty(t, bindDevice())
+	vrfName = "vrf-blue"
+	assert.Equal(t, "vrf-blue", bindDevice())
+	assert.True(t, sourceSet())
+	sourceInterface = "eth0"
+	assert.Equal(t, "eth0", bindDevice())
+}
+
+func TestCheckVRFFlags(t *testing.T) {
+	resetNetns(t)
+	resetSource(t)
+	vrfName = "nosuchvrf0"
+	assert.ErrorContains(t, checkSourceFlags(), "invalid VRF")
+	sourceInterface = loopbackInterface(t)
+	assert.ErrorContains(t, checkSourceFlags(), "can not be combined")
+}
+
+func TestVRFResolver(t *testing.T) {
+	resetNetns(t)
+	vrfName = "vrf-blue"
+	r := vrfResolver(&netlib.DNSconfig{Nameserver: "10.1.1.53", Port: 5353})
+	require.NotNil(t, r)
+	assert.True(t, r.PreferGo)
+	assert.NotNil(t, r.Dial)
+}
+
+func TestNetnsCmd(t *testing.T) {
+	resetNetns(t)
+	args := []string{
+		"tcp",
+		"127.0.0.1:22",
+		"--netns", "nosuchnetns",
+		flagUnitTest,
+	}
+	_, err := common.CmdRun(RootCmd, args)
+	if runtime.GOOS == "linux" {
+		assert.ErrorContains(t, err, "nosuchnetns")
+	} else {
+		assert.ErrorContains(t, err, "only supported on Linux")
+	}
+}
@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// output formats of the --output flag
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+	outputCSV  = "csv"
+)
+
+var (
+	outputFormat = outputText
+	// results collects the records of the running command for structured output
+	results []Result
+)
+
+// Result is the common serializable record of all commands. Data holds the command specific
+// result struct, Time is the completion time of the probe.
+type Result struct {
+	Time    time.Time `json:"time" yaml:"time"`
+	Command string    `json:"command" yaml:"command"`
+	Target  string    `json:"target" yaml:"target"`
+	Status  string    `json:"status" yaml:"status"`
+	Error   string    `json:"error,omitempty" yaml:"error,omitempty"`
+	Data    any       `json:"data,omitempty" yaml:"data,omitempty"`
+}
+
+// resultColumns are the leading CSV columns taken from the Result envelope
+var resultColumns = []string{"time", "command", "target", "status", "error"}
+
+// newResult returns a record of command for target stamped with the current time
+func newResult(command, target, status string, err error, data any) Result {
+	r := Result{
+		Time:    time.Now().UTC().Truncate(time.Millisecond),
+		Command: command,
+		Target:  target,
+		Status:  status,
+		Data:    data,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// textOutput reports whether the colored text renderer is selected
+func textOutput() bool {
+	return outputFormat == outputText && !pluginMode
+}
+
+// checkOutputFormat validates the --output and plugin threshold flags
+func checkOutputFormat(cmd *cobra.Command, _ []string) error {
+	results = nil
+	pluginExitCode = pluginUnknown
+	// the status line is the only output of a plugin
+	cmd.SilenceErrors = pluginMode
+	switch outputFormat {
+	case outputText, outputJSON, outputYAML, outputCSV:
+	default:
+		return fmt.Errorf("invalid output format %s, use text, json, yaml or csv", outputFormat)
+	}
+	if _, err := parseThresholds(pluginWarnFlag); err != nil {
+		return err
+	}
+	_, err := parseThresholds(pluginCritFlag)
+	return err
+}
+
+// emit prints a result with the text renderer or keeps it for the structured output
+func emit(r Result, text func()) {
+	if textOutput() {
+		text()
+		return
+	}
+	log.Debugf("record %s %s %s", r.Command, r.Target, r.Status)
+	results = append(results, r)
+}
+
+// flushResults writes the collected records in the selected structured format or as plugin status
+func flushResults(cmd *cobra.Command, _ []string) error {
+	if pluginMode {
+		command := cmd.Name()
+		if len(results) > 0 {
+			command = results[0].Command
+		}
+		pluginExitCode = writePlugin(os.Stdout, command, results)
+		results = nil
+		return nil
+	}
+	if textOutput() {
+		return nil
+	}
+	err := writeResults(os.Stdout, outputFormat, results)
+	results = nil
+	return err
+}
+
+// writeResults renders records as JSON array, YAML sequence or CSV table
+func writeResults(w io.Writer, format string, list []Result) error {
+	if list == nil {
+		list = []Result{}
+	}
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	case outputYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(list); err != nil {
+			return err
+		}
+		return enc.Close()
+	case outputCSV:
+		return writeCSV(w, list)
+	}
+	return fmt.Errorf("invalid output format %s", format)
+}
+
+// writeCSV writes one row per record. Nested data fields are flattened to dotted column names,
+// lists of plain values are joined with ';'.
+func writeCSV(w io.Writer, list []Result) error {
+	rows := make([]map[string]string, 0, len(list))
+	keys := map[string]bool{}
+	for _, r := range list {
+		row, err := flattenResult(r)
+		if err != nil {
+			return err
+		}
+		for k := range row {
+			keys[k] = true
+		}
+		rows = append(rows, row)
+	}
+	header := append([]string{}, resultColumns...)
+	var extra []string
+	for k := range keys {
+		if !isResultColumn(k) {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	header = append(header, extra...)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		line := make([]string, len(header))
+		for i, k := range header {
+			line[i] = row[k]
+		}
+		if err := cw.Write(line); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// flattenResult converts a record into column name/value pairs using its JSON field names
+func flattenResult(r Result) (map[string]string, error) {
+	row := map[string]string{
+		"time":    r.Time.Format(time.RFC3339Nano),
+		"command": r.Command,
+		"target":  r.Target,
+		"status":  r.Status,
+		"error":   r.Error,
+	}
+	if r.Data == nil {
+		return row, nil
+	}
+	b, err := json.Marshal(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var data any
+	if err = dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	flattenValue("", data, fields)
+	for k, v := range fields {
+		// data fields never hide the envelope columns
+		if isResultColumn(k) {
+			k = "data." + k
+		}
+		row[k] = v
+	}
+	return row, nil
+}
+
+// flattenValue adds the scalar values of v below prefix to out
+func flattenValue(prefix string, v any, out map[string]string) {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, e := range x {
+			flattenValue(joinKey(prefix, k), e, out)
+		}
+	case []any:
+		if scalarList(x) {
+			s := make([]string, len(x))
+			for i, e := range x {
+				s[i] = scalarString(e)
+			}
+			out[prefix] = strings.Join(s, ";")
+			return
+		}
+		for i, e := range x {
+			flattenValue(joinKey(prefix, strconv.Itoa(i)), e, out)
+		}
+	default:
+		out[prefix] = scalarString(x)
+	}
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func scalarList(l []any) bool {
+	for _, e := range l {
+		switch e.(type) {
+		case map[string]any, []any:
+			return false
+		}
+	}
+	return true
+}
+
+func scalarString(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case json.Number:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func isResultColumn(k string) bool {
+	for _, c := range resultColumns {
+		if c == k {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+	"gopkg.in/yaml.v3"
+)
+
+func testResults() []Result {
+	tcp := &TCPing{Address: "127.0.0.1:80", Msg: "OPEN", Duration: 1500 * time.Microsecond, RTT: 1.5}
+	refused := &TCPing{Address: "127.0.0.1:81", Msg: "REFUSED/CLOSED", Code: 1}
+	stats := NewPingStats("127.0.0.1:80")
+	stats.Add(time.Millisecond, true)
+	stats.Add(0, false)
+	mtr := &MTR{Report: ReportMTR{
+		Desc: DescMTR{Dst: "127.0.0.1", Tests: 1},
+		Hops: []HopsMTR{{Count: 1, Host: "localhost", IP: "127.0.0.1", Snt: 1}},
+	}}
+	return []Result{
+		tcp.Record(),
+		refused.Record(),
+		stats.Record("TCP"),
+		newResult("mtr", "127.0.0.1", "OK", nil, mtr.Report),
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	list := testResults()
+	t.Run("json", func(t *testing.T) {
+		var b bytes.Buffer
+		require.NoError(t, writeResults(&b, outputJSON, list))
+		var out []map[string]any
+		require.NoError(t, json.Unmarshal(b.Bytes(), &out))
+		require.Len(t, out, 4)
+		assert.Equal(t, "tcp", out[0]["command"])
+		assert.Equal(t, "OPEN", out[0]["status"])
+		assert.InDelta(t, 1.5, out[0]["data"].(map[string]any)["rtt_ms"], 0.001)
+		assert.Equal(t, "REFUSED", out[1]["status"])
+		assert.Equal(t, "REFUSED/CLOSED", out[1]["error"])
+		assert.Equal(t, "STATS", out[2]["status"])
+		assert.InDelta(t, 50.0, out[2]["data"].(map[string]any)["loss_pct"], 0.001)
+		_, err := time.Parse(time.RFC3339, out[0]["time"].(string))
+		assert.NoError(t, err, "time should be RFC3339")
+	})
+	t.Run("yaml", func(t *testing.T) {
+		var b bytes.Buffer
+		require.NoError(t, writeResults(&b, outputYAML, list))
+		var out []map[string]any
+		require.NoError(t, yaml.Unmarshal(b.Bytes(), &out))
+		require.Len(t, out, 4)
+		assert.Equal(t, "127.0.0.1:81", out[1]["target"])
+		hops := out[3]["data"].(map[string]any)["hubs"].([]any)
+		assert.Equal(t, "localhost", hops[0].(map[string]any)["host"])
+	})
+	t.Run("csv", func(t *testing.T) {
+		var b bytes.Buffer
+		require.NoError(t, writeResults(&b, outputCSV, list))
+		rows, err := csv.NewReader(&b).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 5)
+		header := rows[0]
+		assert.Equal(t, resultColumns, header[:len(resultColumns)])
+		col := func(name string) int {
+			for i, h := range header {
+				if h == name {
+					return i
+				}
+			}
+			t.Fatalf("column %s missing in %v", name, header)
+			return -1
+		}
+		assert.Equal(t, "1.5", rows[1][col("rtt_ms")])
+		assert.Equal(t, "127.0.0.1:80", rows[1][col("address")])
+		assert.Equal(t, "50", rows[3][col("loss_pct")])
+		assert.Equal(t, "localhost", rows[4][col("hubs.0.host")])
+		assert.Empty(t, rows[1][col("hubs.0.host")])
+	})
+	t.Run("empty", func(t *testing.T) {
+		var b bytes.Buffer
+		require.NoError(t, writeResults(&b, outputJSON, nil))
+		assert.Equal(t, "[]\n", b.String())
+	})
+}
+
+func TestFlattenResult(t *testing.T) {
+	r := newResult("tls", "example.com:443", "INVALID", errors.New("expired"), map[string]any{
+		"status": "inner",
+		"sans":   []string{"a", "b"},
+	})
+	row, err := flattenResult(r)
+	require.NoError(t, err)
+	assert.Equal(t, "INVALID", row["status"])
+	assert.Equal(t, "inner", row["data.status"])
+	assert.Equal(t, "a;b", row["sans"])
+	assert.Equal(t, "expired", row["error"])
+}
+
+func TestOutputFlag(t *testing.T) {
+	t.Cleanup(func() {
+		outputFormat = outputText
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	t.Run("CMD TCP json", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			flagAddress, "127.0.0.1",
+			"-p", fmt.Sprintf("%d", port),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Contains(t, out, fmt.Sprintf("record tcp 127.0.0.1:%d OPEN", port))
+		t.Log(out)
+	})
+	t.Run("invalid format", func(t *testing.T) {
+		args := []string{
+			"version",
+			"-o", "xml",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.Error(t, err)
+	})
+}
@@ -1,153 +1,198 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os/signal"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
 	"github.com/tommi2day/gomodules/common"
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
-	"golang.org/x/net/ipv6"
 
 	"os"
-	"regexp"
+	"strconv"
+	"strings"
 
 	"time"
 )
 
-type ICMPing struct {
-	Address  string
-	IP       *net.IPAddr
-	Duration time.Duration
-	IPType   IPType
-}
-
+// TCPing is a struct that contains the result of a TCP probe
 type TCPing struct {
-	Address string
-	Msg     string
-	Code    int
-}
-
-// IPType is a struct that contains the type of IP address to use
-type IPType struct {
-	Type               string
-	ListenAddr         string
-	Network            string
-	ICMPNetwork        string
-	ProtocolNumber     int
-	RequestMessageType icmp.Type
-	ReplyMessageType   icmp.Type
+	Address  string        `json:"address" yaml:"address"`
+	Msg      string        `json:"message" yaml:"message"`
+	Code     int           `json:"code" yaml:"code"`
+	Detail   string        `json:"detail,omitempty" yaml:"detail,omitempty"`
+	Source   string        `json:"source,omitempty" yaml:"source,omitempty"`
+	Proxy    string        `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	Steps    []StepResult  `json:"steps,omitempty" yaml:"steps,omitempty"`
+	Duration time.Duration `json:"-" yaml:"-"`
+	RTT      float64       `json:"rtt_ms" yaml:"rtt_ms"`
 }
 
 var (
-	// IPType4 is the type of IP address to use for IPv4
-	IPType4 = IPType{
-		Type:               "4",
-		ListenAddr:         "0.0.0.0",
-		Network:            "ip4",
-		ICMPNetwork:        "ip4:icmp",
-		ProtocolNumber:     1,
-		RequestMessageType: ipv4.ICMPTypeEcho,
-		ReplyMessageType:   ipv4.ICMPTypeEchoReply,
-	}
-	// IPType6 is the type of IP address to use for IPv6
-	IPType6 = IPType{
-		Type:               "6",
-		ListenAddr:         "::",
-		Network:            "ip6",
-		ICMPNetwork:        "ip6:ipv6-icmp",
-		ProtocolNumber:     58,
-		RequestMessageType: ipv6.ICMPTypeEchoRequest,
-		ReplyMessageType:   ipv6.ICMPTypeEchoReply,
-	}
-)
-
-var (
-	icmpCmd = &cobra.Command{
-		Use:          "icmp",
-		Short:        "Ping using ICMP protocol",
-		Long:         ``,
-		RunE:         runICMPPing,
-		SilenceUsage: true,
-	}
 	tcpCmd = &cobra.Command{
-		Use:          "tcp",
+		Use:          "tcp [host:port ...]",
 		Short:        "Ping using TCP protocol",
 		Long:         ``,
 		RunE:         runTCPPing,
 		SilenceUsage: true,
 	}
-	pingTimeout = 3
+	pingTimeout  = 3
+	pingCount    = 1
+	pingInterval = 1.0
 )
 
 func init() {
-	icmpCmd.Flags().StringVarP(&queryAddress, "address", "a", "", "ip/host to query")
 	tcpCmd.Flags().StringVarP(&queryAddress, "address", "a", "", "ip/host to ping")
-	tcpCmd.Flags().StringVarP(&queryPort, "port", "p", "", "tcp port to ping")
+	tcpCmd.Flags().StringVarP(&queryPort, "port", "p", "", "tcp port to ping, a list like 22,80,8000-8100 scans all ports")
+	tcpCmd.Flags().StringVar(&portNames, "ports", "", "named port lists to scan: "+strings.Join(portListNames(), ", "))
 	tcpCmd.Flags().IntVarP(&pingTimeout, "timeout", "t", pingTimeout, "Ping Timeout in sec")
+	tcpCmd.Flags().IntVarP(&pingCount, "count", "c", pingCount, "number of probes per address, 0 runs until interrupted")
+	tcpCmd.Flags().Float64VarP(&pingInterval, "interval", "i", pingInterval, "interval between probes in sec")
+	tcpCmd.Flags().StringVar(&expectSend, "send", "", "data to send after connecting, escapes like \\r\\n are interpreted")
+	tcpCmd.Flags().StringVar(&expectRegexp, "expect", "", "regular expression the answer must match")
+	tcpCmd.Flags().StringVar(&expectFile, "script", "", "YAML file with send/expect steps run after connecting")
+	addTargetFlags(tcpCmd)
 
 	RootCmd.AddCommand(tcpCmd)
-	RootCmd.AddCommand(icmpCmd)
 }
 
-func runICMPPing(_ *cobra.Command, args []string) error {
-	if len(args) > 0 {
-		queryAddress = args[0]
+func runTCPPing(cmd *cobra.Command, args []string) error {
+	// get arguments, the legacy form is "tcp host port"
+	if len(args) == 2 && isPortList(args[1]) {
+		queryPort = args[1]
+		args = args[:1]
 	}
-	log.Debugf("ICMPing called with %s:%s", queryAddress, queryPort)
-	if queryAddress == "" {
-		return fmt.Errorf("please specify an address to query")
+	log.Debugf("TCPing called with %s:%s %v", queryAddress, queryPort, args)
+	if err := checkPingLoopFlags(); err != nil {
+		return err
 	}
-	host, _, err := common.GetHostPort(queryAddress)
+	targets, err := collectTargets(args)
 	if err != nil {
-		log.Debugf("ICMPing GetHostPort failed: %v", err)
 		return err
 	}
-	ips, err := dnsConfig.LookupIP(host)
+	if len(targets) == 0 {
+		return fmt.Errorf("please specify an address to ping")
+	}
+	ports, scan, err := scanPorts(queryPort, portNames)
 	if err != nil {
-		log.Debugf("DNS lookup failed: %v", err)
 		return err
 	}
-	i := new(ICMPing)
-	for _, ip := range ips {
-		err = i.Run(ip.String())
-		i.Log(err)
+	if expectScript, err = loadExpectScript(); err != nil {
+		return err
 	}
-	log.Debugf("ICMPing done")
-	return nil
-}
-
-func runTCPPing(_ *cobra.Command, args []string) error {
-	// get arguments
-	if len(args) > 0 {
-		queryAddress = args[0]
+	if scan {
+		if pingCount != 1 {
+			return fmt.Errorf("--count is not supported with a port list")
+		}
+		if expectScript != nil {
+			return fmt.Errorf("--send, --expect and --script are not supported with a port list")
+		}
+		if !cmd.Flags().Changed("parallel") {
+			parallelJobs = scanDefaultParallel
+		}
+		err = runPortScan(targets, ports)
+		log.Debugf("TCP scan done")
+		return err
 	}
-	if len(args) > 1 {
-		queryPort = args[1]
+	port := 0
+	if len(ports) == 1 {
+		port = ports[0]
 	}
-	log.Debugf("TCPing called with %s:%s", queryAddress, queryPort)
 
-	// check if address is set
-	ips, err := normalizeAddress()
+	// iterate over the targets and their IPs
+	if pingCount == 1 {
+		err = runTargets("tcp", targets, func(j *targetJob) {
+			hosts, p, e := resolveTarget(j.target, port)
+			if e != nil {
+				log.Debugf("TCPing resolve %s failed: %v", j.target, e)
+				resolveFailed(j, e)
+				return
+			}
+			for _, h := range hosts {
+				t := new(TCPing)
+				_ = t.Run(net.JoinHostPort(h, p))
+				j.emit(t.Record(), t.Log)
+			}
+		})
+		log.Debugf("TCPing done")
+		return err
+	}
+	resolved := make([][]string, len(targets))
+	err = runTargets("tcp", targets, func(j *targetJob) {
+		hosts, p, e := resolveTarget(j.target, port)
+		if e != nil {
+			resolveFailed(j, e)
+		}
+		for _, h := range hosts {
+			resolved[j.index] = append(resolved[j.index], net.JoinHostPort(h, p))
+		}
+	})
 	if err != nil {
-		log.Debugf("TCPing normalizeAddress failed: %v", err)
 		return err
 	}
+	runTCPPingLoop(uniqueAddresses(resolved))
+	log.Debugf("TCPing done")
+	return nil
+}
 
-	// iterate over returned IPs
-	t := new(TCPing)
-	for _, ip := range ips {
-		dst := net.JoinHostPort(ip.String(), queryPort)
-		_ = t.Run(dst)
-		t.Log()
+// checkPingLoopFlags validates --count and --interval of the tcp, icmp and http commands
+func checkPingLoopFlags() error {
+	if pingCount < 0 {
+		return fmt.Errorf("invalid count %d, use 0 to run until interrupted", pingCount)
+	}
+	if pingInterval < 0 {
+		return fmt.Errorf("invalid interval %g", pingInterval)
 	}
-	log.Debugf("TCPing done")
 	return nil
 }
 
+// runTCPPingLoop probes all addresses repeatedly and prints a summary per address.
+// The addresses of a round are probed with --parallel concurrent connections.
+// It stops after pingCount rounds or, if pingCount is 0, on interrupt.
+func runTCPPingLoop(addrs []string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	interval := time.Duration(pingInterval * float64(time.Second))
+	stats := make([]*PingStats, len(addrs))
+	for i, a := range addrs {
+		stats[i] = NewPingStats(a)
+	}
+	log.Debugf("TCPing loop with count %d interval %v", pingCount, interval)
+	for seq := 1; pingCount == 0 || seq <= pingCount; seq++ {
+		round := make([]*TCPing, len(stats))
+		runParallel(len(stats), func(i int) {
+			t := new(TCPing)
+			_ = t.RunContext(ctx, stats[i].Address)
+			round[i] = t
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		for i, t := range round {
+			stats[i].Add(t.Duration, t.Code == 0)
+			emit(t.Record(), t.Log)
+		}
+		if seq == pingCount {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+	logStatsSummary("TCP", stats)
+}
+
+// isPortList reports whether s is a port number or a port list
+func isPortList(s string) bool {
+	_, err := parsePorts(s)
+	return err == nil && s != ""
+}
+
 func normalizeAddress() (ips []net.IP, err error) {
 	ips = []net.IP{}
 	var host string
@@ -183,166 +228,114 @@ func normalizeAddress() (ips []net.IP, err error) {
 
 // Run sends a TCP request to a given address and returns the status of the connection
 func (t *TCPing) Run(address string) (msg string) {
+	return t.RunContext(context.Background(), address)
+}
+
+// RunContext is like Run but aborts the connection attempt when ctx is done
+func (t *TCPing) RunContext(ctx context.Context, address string) (msg string) {
 	log.Debugf("TCPing started for %s", address)
 	timeout := time.Duration(pingTimeout) * time.Second
 	t.Address = address
-	d := net.Dialer{Timeout: timeout}
-	_, err := d.Dial("tcp", address)
+	t.Proxy = relayHost()
+	start := time.Now()
+	conn, err := dialTCP(ctx, address, timeout)
+	t.Duration = time.Since(start)
+	t.RTT = durationMS(t.Duration)
 	if err != nil {
 		log.Debugf("TCPing dial message: %v", err)
-		match, _ := regexp.MatchString("refused", err.Error())
-		if match {
-			// Closed
-			msg = "REFUSED/CLOSED"
-			t.Code = 1
-			t.Msg = msg
-			return
-		}
-		match, _ = regexp.MatchString("timeout", err.Error())
-		if match {
-			// Timeout
-			t.Code = 2
-			msg = "TIMEOUT/BLOCKED"
-			t.Msg = msg
-			return
+		t.setResult(classifyDialError(err, address), err)
+		return t.Msg
+	}
+	t.Source = localSource(conn)
+	defer func() { _ = conn.Close() }()
+	if expectScript != nil {
+		steps, e := expectScript.Run(conn)
+		t.Steps = steps
+		if e != nil {
+			log.Debugf("TCPing script failed: %v", e)
+			t.setResult(tcpCodeExpectFailed, e)
+			return t.Msg
 		}
-		// Default
-		t.Code = 2
-		msg = fmt.Sprintf("ERROR: %v", err)
-		t.Msg = msg
-		return
 	}
-	// Open
-	t.Code = 0
-	msg = "OPEN"
-	t.Msg = msg
-	return
+	t.setResult(tcpCodeOpen, nil)
+	return t.Msg
 }
 
-// Log logs the tcping results
-func (t *TCPing) Log() {
-	log.Debugf("enter TCPing Log with %s code %d message: %v", t.Address, t.Code, t.Msg)
-	switch t.Code {
-	case 0:
-		fmt.Printf("%s%s%s\n", cyan("%-7s", "TCP"), green("%-10s", t.Msg), t.Address)
-	case 1:
-		fmt.Printf("%s%s%s\n", cyan("%-7s", "TCP"), yellow("%-10s", t.Msg), t.Address)
-	case 2:
-		fmt.Printf("%s%s\n", cyan("%-7s", "TCP"), red("%-10s", t.Msg))
+// setResult sets the code and message of the probe, err is kept as detail of errors
+// without a specific code
+func (t *TCPing) setResult(code int, err error) {
+	t.Code = code
+	t.Msg = tcpStates[code].msg
+	t.Detail = ""
+	var targetErr *ProxyTargetError
+	if err != nil && (code == tcpCodeError || code == tcpCodeDNSError || code == tcpCodeProxyError ||
+		code == tcpCodeExpectFailed || errors.As(err, &targetErr)) {
+		t.Detail = err.Error()
 	}
 }
 
-// Log logs the ping results
-func (i *ICMPing) Log(err error) {
-	log.Debugf("enter ICMPing Log %s", i.IP.String())
-	if err != nil {
-		match, _ := regexp.MatchString("operation not permitted", err.Error())
-		if match {
-			fmt.Printf("%s%s%s\n",
-				cyan("%-7s", "ICMP"),
-				red("%-10s", "ERROR"),
-				red("No privileges"))
-		} else {
-			fmt.Printf("%s%s%s\n",
-				cyan("%-7s", "ICMP"),
-				red("%-10s", "ERROR"), err)
-		}
-		log.Debugf("result ICMPing to %s: ERROR (%v)", i.IP.String(), err)
+// resolveFailed reports a DNS failure of a target as probe result with the target address,
+// other errors like an invalid target fail the job
+func resolveFailed(j *targetJob, err error) {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		j.err = err
 		return
 	}
-	log.Debugf("result ICMPing to %s: OPEN", i.IP.String())
-	fmt.Printf("%s%s%-30s    %s ms\n",
-		cyan("%-7s", "ICMP"),
-		green("%-10s", "OPEN"), i.IP.String(),
-		fmt.Sprintf("%.1f", float64(i.Duration.Microseconds())/1000))
+	t := &TCPing{Address: j.target}
+	t.setResult(tcpCodeDNSError, err)
+	j.emit(t.Record(), t.Log)
 }
 
-// Run sends an ICMP echo request to a given address and returns the time it took to get a reply
-func (i *ICMPing) Run(host string) (err error) {
-	// Check ip type
-	// Resolve address
-	var dst *net.IPAddr
-	var c *icmp.PacketConn
-	log.Debugf("ICMPing Run to %s", host)
-	dst, err = net.ResolveIPAddr("ip4", host)
-	if err != nil {
-		log.Debugf("ICMPing ResolveIPAddr ip4 failed: %v", err)
-		dst, err = net.ResolveIPAddr("ip6", host)
-		if err != nil {
-			log.Debugf("ICMPing ResolveIPAddr ip6 failed: %v", err)
-			return
+// Record returns the serializable result of the probe
+func (t *TCPing) Record() Result {
+	var err error
+	if t.Code != tcpCodeOpen {
+		err = errors.New(t.Msg)
+		if t.Detail != "" {
+			err = fmt.Errorf("%s: %s", t.Msg, t.Detail)
 		}
-		i.IPType = IPType6
-	} else {
-		i.IPType = IPType4
-	}
-	i.IP = dst
-	log.Debugf("prepare ICMPing to IP %s type %s", i.IP.String(), i.IPType.Type)
-	// Start listening for icmp replies
-	c, err = icmp.ListenPacket(i.IPType.ICMPNetwork, i.IPType.ListenAddr)
-	if err != nil {
-		log.Debugf("ICMPing ListenPacket failed: %v", err)
-		return err
-	}
-	defer func(c *icmp.PacketConn) {
-		_ = c.Close()
-	}(c)
-
-	// Make a new ICMP message
-	m := icmp.Message{
-		Type: i.IPType.RequestMessageType,
-		Code: 0,
-		Body: &icmp.Echo{
-			ID: os.Getpid() & 0xffff, Seq: 1,
-			Data: []byte(""),
-		},
-	}
-	b, err := m.Marshal(nil)
-	if err != nil {
-		return err
-	}
-
-	// Send it
-	start := time.Now()
-	n, err := c.WriteTo(b, dst)
-	if err != nil {
-		log.Debugf("ICMPing WriteTo failed: %v", err)
-		return err
-	} else if n != len(b) {
-		log.Debugf("ICMPing WriteTo failed: got %v; want %v", n, len(b))
-		return fmt.Errorf("got %v; want %v", n, len(b))
 	}
+	return newResult("tcp", t.Address, tcpStates[t.Code].status, err, t)
+}
 
-	// Wait for a reply
-	log.Debugf("ICMPing waiting for reply")
-	reply := make([]byte, 1500)
-	err = c.SetReadDeadline(time.Now().Add(3 * time.Second))
-	if err != nil {
-		log.Debugf("ICMPing SetReadDeadline failed: %v", err)
-		return err
-	}
-	n, peer, err := c.ReadFrom(reply)
-	if err != nil {
-		log.Debugf("ICMPing ReadFrom failed: %v", err)
-		return err
+// Log logs the tcping results
+func (t *TCPing) Log() {
+	log.Debugf("enter TCPing Log with %s code %d message: %v", t.Address, t.Code, t.Msg)
+	via := ""
+	if t.Proxy != "" {
+		via = "  via " + t.Proxy
 	}
-	duration := time.Since(start)
-
-	// Pack it up boys, we're done here
-	rm, err := icmp.ParseMessage(i.IPType.ProtocolNumber, reply[:n])
-	if err != nil {
-		log.Debugf("ICMPing ParseMessage failed: %v", err)
-		return err
+	switch t.Code {
+	case tcpCodeOpen:
+		from := ""
+		if sourceSet() && t.Source != "" {
+			from = "  from " + t.Source
+		}
+		fmt.Printf("%s%s%-30s    %s ms%s%s\n", cyan("%-7s", "TCP"), green("%-10s", t.Msg), t.Address,
+			fmt.Sprintf("%.1f", float64(t.Duration.Microseconds())/1000), from, via)
+	case tcpCodeRefused:
+		fmt.Printf("%s%s %s%s\n", cyan("%-7s", "TCP"), yellow("%-10s", t.Msg), t.Address, via)
+	default:
+		if t.Detail == "" {
+			fmt.Printf("%s%s %s%s\n", cyan("%-7s", "TCP"), red("%-10s", t.Msg), t.Address, via)
+		} else {
+			fmt.Printf("%s%s %-30s    %s\n", cyan("%-7s", "TCP"), red("%-10s", t.Msg), t.Address, t.Detail)
+		}
 	}
+	t.logSteps()
+}
 
-	// return dst, duration, nil
-	switch rm.Type {
-	case i.IPType.ReplyMessageType:
-		i.Duration = duration
-		log.Debugf("ICMPing ReplyMessageType received, duration %v", i.Duration)
-		return nil
-	default:
-		log.Debugf("ICMPing ReplyMessageType not received: got %+v from %v; want echo reply", rm, peer)
-		return fmt.Errorf("got %+v from %v; want echo reply", rm, peer)
+// logSteps logs the steps of the send/expect script with their duration and the matched text or the error
+func (t *TCPing) logSteps() {
+	for _, s := range t.Steps {
+		state, text := green("%-5s", "ok"), ""
+		switch {
+		case s.Error != "":
+			state, text = red("%-5s", "FAIL"), s.Error
+		case s.Match != "":
+			text = strconv.Quote(s.Match)
+		}
+		fmt.Printf("%s%-11s%-30q %8.1f ms  %s%s\n", cyan("%-7s", fmt.Sprintf("#%d", s.Step)), s.Action, s.Arg, s.RTT, state, text)
 	}
 }
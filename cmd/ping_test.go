@@ -29,6 +29,54 @@ func TestTCPPing(t *testing.T) {
 	})
 }
 
+func TestTCPPingCount(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	t.Cleanup(func() {
+		pingCount = 1
+		pingInterval = 1
+	})
+
+	t.Run("CMD TCP count", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			flagAddress, "127.0.0.1",
+			"-p", port,
+			"-c", "3",
+			"-i", "0.1",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoErrorf(t, err, "TCP command should not return an error:%s", err)
+		assert.Contains(t, out, "TCPing loop with count 3", "TCP command should run a loop")
+		assert.Contains(t, out, "statistics for 127.0.0.1:"+port+": sent 3 ok 3 failed 0", "TCP command should log statistics")
+		assert.Containsf(t, out, "TCPing done", "TCP command should contain TCPing done")
+		t.Log(out)
+	})
+	for _, command := range []string{"tcp", "icmp", "http"} {
+		t.Run("CMD "+command+" negative count", func(t *testing.T) {
+			_, err := common.CmdRun(RootCmd, []string{command, "127.0.0.1:" + port, "-c", "-1", flagUnitTest})
+			assert.ErrorContains(t, err, "invalid count -1")
+			_, err = common.CmdRun(RootCmd, []string{command, "127.0.0.1:" + port, "-c", "2", "-i", "-0.5", flagUnitTest})
+			assert.ErrorContains(t, err, "invalid interval -0.5")
+		})
+	}
+}
+
 func TestICMPPing(t *testing.T) {
 	if os.Getenv("SKIP_ICMP") != "" {
 		t.Skip("SKIP_ICMP set")
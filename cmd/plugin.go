@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// plugin states and exit codes of the monitoring-plugins specification
+const (
+	pluginOK       = 0
+	pluginWarning  = 1
+	pluginCritical = 2
+	pluginUnknown  = 3
+)
+
+var pluginStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+var (
+	pluginMode     = false
+	pluginWarnFlag string
+	pluginCritFlag string
+	pluginExitCode = pluginUnknown
+	pluginOKStatus = map[string]bool{"OPEN": true, "VALID": true, "INFO": true, "OK": true, "STATS": true,
+		"IPV4-ONLY": true, "IPV6-ONLY": true, "READY": true}
+)
+
+// pluginRange is a threshold range of the monitoring-plugins specification:
+// "10" alerts outside 0..10, "10:" below 10, "~:10" above 10, "10:20" outside and "@10:20" inside 10..20
+type pluginRange struct {
+	start  float64
+	end    float64
+	inside bool
+	raw    string
+}
+
+// pluginMetric is a perfdata value of a result. Index selects the threshold of the comma separated list.
+type pluginMetric struct {
+	label string
+	value float64
+	uom   string
+	index int
+}
+
+// parsePluginRange parses a single threshold range, a trailing unit like % or ms is ignored
+func parsePluginRange(s string) (*pluginRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	r := &pluginRange{start: 0, end: math.Inf(1)}
+	v := strings.TrimRight(s, "%ms")
+	r.raw = v
+	if strings.HasPrefix(v, "@") {
+		r.inside = true
+		v = v[1:]
+	}
+	lo, hi, found := strings.Cut(v, ":")
+	if !found {
+		hi, lo = lo, ""
+	}
+	var err error
+	switch lo {
+	case "":
+	case "~":
+		r.start = math.Inf(-1)
+	default:
+		if r.start, err = strconv.ParseFloat(lo, 64); err != nil {
+			return nil, fmt.Errorf("invalid threshold range %s", s)
+		}
+	}
+	if hi != "" {
+		if r.end, err = strconv.ParseFloat(hi, 64); err != nil {
+			return nil, fmt.Errorf("invalid threshold range %s", s)
+		}
+	}
+	if r.start > r.end {
+		return nil, fmt.Errorf("invalid threshold range %s, start is greater than end", s)
+	}
+	return r, nil
+}
+
+// alert reports whether the value violates the range
+func (r *pluginRange) alert(v float64) bool {
+	if r == nil {
+		return false
+	}
+	in := v >= r.start && v <= r.end
+	return in == r.inside
+}
+
+// parseThresholds parses a comma separated list of ranges
+func parseThresholds(s string) ([]*pluginRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var list []*pluginRange
+	for _, part := range strings.Split(s, ",") {
+		r, err := parsePluginRange(part)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// thresholdAt returns the range for a metric index or nil
+func thresholdAt(list []*pluginRange, i int) *pluginRange {
+	if i < len(list) {
+		return list[i]
+	}
+	return nil
+}
+
+// pluginMetrics extracts the threshold relevant values of a result
+func pluginMetrics(r Result) []pluginMetric {
+	switch d := r.Data.(type) {
+	case *TCPing:
+		if r.Status == "OPEN" {
+			return []pluginMetric{{label: r.Target + " rtt", value: d.RTT, uom: "ms"}}
+		}
+	case *ICMPing:
+		if r.Status == "OPEN" {
+			return []pluginMetric{{label: r.Target + " rtt", value: d.RTT, uom: "ms"}}
+		}
+	case StatsSummary:
+		m := []pluginMetric{{label: r.Target + " loss", value: d.Loss, uom: "%", index: 1}}
+		if d.OK > 0 {
+			m = append([]pluginMetric{{label: r.Target + " rtt", value: d.Avg, uom: "ms"}}, m...)
+		}
+		return m
+	case *HTTPing:
+		label := r.Target
+		if httpAllIPs {
+			label += " " + d.Remote
+		}
+		return []pluginMetric{{label: label + " time", value: d.Timings.Total, uom: "ms"}}
+	case HTTPStatsSummary:
+		m := []pluginMetric{{label: r.Target + " loss", value: d.Loss, uom: "%", index: 1}}
+		for _, p := range d.Phases {
+			if p.Phase == "total" {
+				m = append([]pluginMetric{{label: r.Target + " time", value: p.Avg, uom: "ms"}}, m...)
+			}
+		}
+		return m
+	case *TLSResult:
+		if len(d.Certs) > 0 {
+			return []pluginMetric{{label: r.Target + " days", value: float64(d.Certs[0].DaysLeft)}}
+		}
+	case CertInfo:
+		return []pluginMetric{{label: r.Target + " days", value: float64(d.DaysLeft)}}
+	case *TLSConnInfo:
+		if d.Certificate != nil {
+			return []pluginMetric{{label: r.Target + " days", value: float64(d.Certificate.DaysLeft)}}
+		}
+	case ReportMTR:
+		if n := len(d.Hops); n > 0 {
+			last := d.Hops[n-1]
+			return []pluginMetric{
+				{label: r.Target + " rtt", value: last.Avg, uom: "ms"},
+				{label: r.Target + " loss", value: last.Loss, uom: "%", index: 1},
+			}
+		}
+	case *DualStack:
+		if d.WinnerAddress != "" {
+			return []pluginMetric{{label: r.Target + " race", value: d.RaceTime, uom: "ms"}}
+		}
+	case *MultipathReport:
+		var m []pluginMetric
+		for i, p := range d.Paths {
+			m = append(m, pluginMetric{label: fmt.Sprintf("%s path%d loss", r.Target, i+1), value: p.Loss, uom: "%", index: 1})
+		}
+		return m
+	}
+	return nil
+}
+
+// evaluatePlugin returns the plugin state, the status text and the perfdata of all results
+func evaluatePlugin(list []Result, warn, crit []*pluginRange) (state int, text string, perf string) {
+	if len(list) == 0 {
+		return pluginUnknown, "no results", ""
+	}
+	state = pluginOK
+	var texts, perfs []string
+	for _, r := range pluginSummaries(list) {
+		rs := pluginOK
+		if !pluginOKStatus[r.Status] || allFailed(r) {
+			rs = pluginCritical
+		}
+		var values []string
+		for _, m := range pluginMetrics(r) {
+			w := thresholdAt(warn, m.index)
+			c := thresholdAt(crit, m.index)
+			switch {
+			case c.alert(m.value):
+				rs = max(rs, pluginCritical)
+			case w.alert(m.value):
+				rs = max(rs, pluginWarning)
+			}
+			values = append(values, fmt.Sprintf("%s%s", formatPerfValue(m.value), m.uom))
+			perfs = append(perfs, fmt.Sprintf("'%s'=%s%s;%s;%s", m.label, formatPerfValue(m.value), m.uom, rangeText(w), rangeText(c)))
+		}
+		t := fmt.Sprintf("%s %s", r.Target, r.Status)
+		if len(values) > 0 {
+			t += " " + strings.Join(values, "/")
+		}
+		if r.Error != "" {
+			t += " (" + r.Error + ")"
+		}
+		texts = append(texts, t)
+		log.Debugf("plugin result %s %s state %s", r.Target, r.Status, pluginStateNames[rs])
+		state = max(state, rs)
+	}
+	return state, strings.Join(texts, ", "), strings.Join(perfs, " ")
+}
+
+// allFailed reports whether every probe of a STATS record failed, the loss thresholds only rate partial loss
+func allFailed(r Result) bool {
+	switch d := r.Data.(type) {
+	case StatsSummary:
+		return d.Sent > 0 && d.OK == 0
+	case HTTPStatsSummary:
+		return d.Sent > 0 && d.OK == 0
+	}
+	return false
+}
+
+// pluginSummaries replaces the single probes of repeated probes by their STATS record, it covers
+// them with the loss and keeps the perfdata labels unique. Records of targets without a STATS
+// record like DNS errors are kept.
+func pluginSummaries(list []Result) []Result {
+	covered := map[string]bool{}
+	for _, r := range list {
+		if r.Status == "STATS" {
+			covered[r.Target] = true
+		}
+	}
+	if len(covered) == 0 {
+		return list
+	}
+	var summaries []Result
+	for _, r := range list {
+		if r.Status == "STATS" || !covered[r.Target] {
+			summaries = append(summaries, r)
+		}
+	}
+	return summaries
+}
+
+// writePlugin prints the one line plugin status and returns the exit code
+func writePlugin(w io.Writer, command string, list []Result) int {
+	warn, err := parseThresholds(pluginWarnFlag)
+	if err == nil {
+		var crit []*pluginRange
+		crit, err = parseThresholds(pluginCritFlag)
+		if err == nil {
+			state, text, perf := evaluatePlugin(list, warn, crit)
+			line := fmt.Sprintf("%s %s - %s", strings.ToUpper(command), pluginStateNames[state], text)
+			if perf != "" {
+				line += " | " + perf
+			}
+			_, _ = fmt.Fprintln(w, line)
+			log.Debugf("plugin state %s", pluginStateNames[state])
+			return state
+		}
+	}
+	_, _ = fmt.Fprintf(w, "%s UNKNOWN - %s\n", strings.ToUpper(command), err)
+	return pluginUnknown
+}
+
+func rangeText(r *pluginRange) string {
+	if r == nil {
+		return ""
+	}
+	return r.raw
+}
+
+func formatPerfValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
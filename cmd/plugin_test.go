@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func TestPluginRange(t *testing.T) {
+	for _, tc := range []struct {
+		spec  string
+		ok    []float64
+		alert []float64
+	}{
+		{"10", []float64{0, 5, 10}, []float64{-1, 10.5, 20}},
+		{"10:", []float64{10, 100}, []float64{0, 9.9}},
+		{"~:10", []float64{-100, 10}, []float64{11}},
+		{"10:20", []float64{10, 15, 20}, []float64{9, 21}},
+		{"@10:20", []float64{9, 21}, []float64{10, 15, 20}},
+		{"5%", []float64{5}, []float64{6}},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			r, err := parsePluginRange(tc.spec)
+			require.NoError(t, err)
+			for _, v := range tc.ok {
+				assert.False(t, r.alert(v), "%v should not alert", v)
+			}
+			for _, v := range tc.alert {
+				assert.True(t, r.alert(v), "%v should alert", v)
+			}
+		})
+	}
+	t.Run("invalid", func(t *testing.T) {
+		for _, spec := range []string{"abc", "20:10", "1:x"} {
+			_, err := parsePluginRange(spec)
+			assert.Error(t, err, spec)
+		}
+	})
+	t.Run("list", func(t *testing.T) {
+		list, err := parseThresholds("100,~:5")
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.True(t, math.IsInf(list[1].start, -1))
+		assert.Nil(t, thresholdAt(list, 2))
+		assert.False(t, thresholdAt(nil, 0).alert(1e9), "missing threshold never alerts")
+	})
+}
+
+func TestEvaluatePlugin(t *testing.T) {
+	warn, err := parseThresholds("100,10")
+	require.NoError(t, err)
+	crit, err := parseThresholds("200,50")
+	require.NoError(t, err)
+	open := func(rtt float64) Result {
+		return (&TCPing{Address: "127.0.0.1:80", Msg: "OPEN", RTT: rtt}).Record()
+	}
+	t.Run("ok", func(t *testing.T) {
+		state, text, perf := evaluatePlugin([]Result{open(1.5)}, warn, crit)
+		assert.Equal(t, pluginOK, state)
+		assert.Equal(t, "127.0.0.1:80 OPEN 1.5ms", text)
+		assert.Equal(t, "'127.0.0.1:80 rtt'=1.5ms;100;200", perf)
+	})
+	t.Run("warning", func(t *testing.T) {
+		state, _, _ := evaluatePlugin([]Result{open(1.5), open(150)}, warn, crit)
+		assert.Equal(t, pluginWarning, state)
+	})
+	t.Run("critical", func(t *testing.T) {
+		state, _, _ := evaluatePlugin([]Result{open(250)}, warn, crit)
+		assert.Equal(t, pluginCritical, state)
+	})
+	t.Run("refused", func(t *testing.T) {
+		refused := (&TCPing{Address: "127.0.0.1:81", Msg: "REFUSED/CLOSED", Code: 1}).Record()
+		state, text, perf := evaluatePlugin([]Result{refused}, nil, nil)
+		assert.Equal(t, pluginCritical, state)
+		assert.Contains(t, text, "REFUSED")
+		assert.Empty(t, perf)
+	})
+	t.Run("loss", func(t *testing.T) {
+		stats := NewPingStats("127.0.0.1:80")
+		stats.Add(time.Millisecond, true)
+		stats.Add(0, false)
+		list := []Result{open(1), (&TCPing{Address: "127.0.0.1:80", Msg: "TIMEOUT", Code: 2}).Record(), stats.Record("TCP")}
+		state, text, perf := evaluatePlugin(list, warn, crit)
+		assert.Equal(t, pluginWarning, state, "50% loss is outside 0..10 but inside 0..50, single probes are covered by the summary")
+		assert.Equal(t, "127.0.0.1:80 STATS 1ms/50%", text)
+		assert.Equal(t, "'127.0.0.1:80 rtt'=1ms;100;200 '127.0.0.1:80 loss'=50%;10;50", perf)
+	})
+	t.Run("total loss", func(t *testing.T) {
+		stats := NewPingStats("127.0.0.1:81")
+		stats.Add(0, false)
+		stats.Add(0, false)
+		state, text, _ := evaluatePlugin([]Result{stats.Record("TCP")}, nil, nil)
+		assert.Equal(t, pluginCritical, state, "100% loss is critical without thresholds")
+		assert.Equal(t, "127.0.0.1:81 STATS 100%", text)
+		h := NewHTTPStats("http://127.0.0.1:81/")
+		h.Add(nil, errors.New("refused"))
+		state, _, _ = evaluatePlugin([]Result{h.Record()}, warn, crit)
+		assert.Equal(t, pluginCritical, state)
+	})
+	t.Run("unresolvable with loop", func(t *testing.T) {
+		stats := NewPingStats("127.0.0.1:80")
+		stats.Add(time.Millisecond, true)
+		dns := &TCPing{Address: "nonexistent.invalid:80"}
+		dns.setResult(tcpCodeDNSError, &net.DNSError{Err: "no such host", Name: "nonexistent.invalid", IsNotFound: true})
+		list := []Result{dns.Record(), open(1), stats.Record("TCP")}
+		state, text, _ := evaluatePlugin(list, nil, nil)
+		assert.Equal(t, pluginCritical, state, "a target without STATS record keeps its error")
+		assert.Contains(t, text, "nonexistent.invalid:80 DNS-ERROR")
+		assert.Contains(t, text, "127.0.0.1:80 STATS")
+		assert.NotContains(t, text, "127.0.0.1:80 OPEN")
+	})
+	t.Run("wait", func(t *testing.T) {
+		ready := newResult("wait", "tcp://db:5432", waitReady, nil, &WaitTarget{Target: "tcp://db:5432", Ready: true})
+		state, text, _ := evaluatePlugin([]Result{ready}, nil, nil)
+		assert.Equal(t, pluginOK, state)
+		assert.Equal(t, "tcp://db:5432 READY", text)
+		notReady := newResult("wait", "tcp://cache:6379", waitNotReady, errors.New("REFUSED/CLOSED"),
+			&WaitTarget{Target: "tcp://cache:6379"})
+		state, _, _ = evaluatePlugin([]Result{ready, notReady}, nil, nil)
+		assert.Equal(t, pluginCritical, state)
+	})
+	t.Run("cert days", func(t *testing.T) {
+		w, _ := parseThresholds("30:")
+		c, _ := parseThresholds("7:")
+		r := newResult("tls", "example.com:443", "VALID", nil, CertInfo{DaysLeft: 20})
+		state, _, perf := evaluatePlugin([]Result{r}, w, c)
+		assert.Equal(t, pluginWarning, state)
+		assert.Equal(t, "'example.com:443 days'=20;30:;7:", perf)
+	})
+	t.Run("empty", func(t *testing.T) {
+		state, _, _ := evaluatePlugin(nil, warn, crit)
+		assert.Equal(t, pluginUnknown, state)
+	})
+}
+
+func TestWritePlugin(t *testing.T) {
+	t.Cleanup(func() {
+		pluginWarnFlag = ""
+		pluginCritFlag = ""
+	})
+	pluginWarnFlag = "100"
+	var b bytes.Buffer
+	state := writePlugin(&b, "tcp", []Result{(&TCPing{Address: "127.0.0.1:80", Msg: "OPEN", RTT: 2}).Record()})
+	assert.Equal(t, pluginOK, state)
+	assert.Equal(t, "TCP OK - 127.0.0.1:80 OPEN 2ms | '127.0.0.1:80 rtt'=2ms;100;\n", b.String())
+}
+
+func TestPluginFlag(t *testing.T) {
+	t.Cleanup(func() {
+		pluginMode = false
+		pluginWarnFlag = ""
+		pluginCritFlag = ""
+		pluginExitCode = pluginUnknown
+		pingCount = 1
+		pingInterval = 1
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	t.Run("CMD TCP open", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			flagAddress, "127.0.0.1",
+			"-p", fmt.Sprintf("%d", port),
+			"--plugin",
+			"--warning", "1000",
+			"--critical", "2000",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Contains(t, out, "plugin state OK")
+		assert.Equal(t, pluginOK, pluginExitCode)
+		t.Log(out)
+	})
+	t.Run("CMD TCP count unresolvable", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", port),
+			"nonexistent.invalid:80",
+			"-c", "2",
+			"-i", "0",
+			"--plugin",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Contains(t, out, "plugin result nonexistent.invalid:80 DNS-ERROR state CRITICAL")
+		assert.Contains(t, out, "plugin state CRITICAL")
+		assert.Equal(t, pluginCritical, pluginExitCode)
+		t.Log(out)
+	})
+	pingCount = 1
+	_ = l.Close()
+	t.Run("CMD TCP closed", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			flagAddress, "127.0.0.1",
+			"-p", fmt.Sprintf("%d", port),
+			"--plugin",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Contains(t, out, "plugin state CRITICAL")
+		assert.Equal(t, pluginCritical, pluginExitCode)
+		t.Log(out)
+	})
+	t.Run("invalid threshold", func(t *testing.T) {
+		args := []string{
+			"version",
+			"--plugin",
+			"--warning", "20:10",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// port scan states derived from the TCPing result codes
+const (
+	portOpen     = "open"
+	portClosed   = "closed"
+	portFiltered = "filtered"
+	portError    = "error"
+)
+
+// scanDefaultParallel is the number of concurrent connections of a scan if --parallel is not set
+const scanDefaultParallel = 32
+
+var (
+	portNames string
+	// namedPorts are the port lists selectable with --ports
+	namedPorts = map[string]string{
+		"ssh":     "22",
+		"web":     "80,443,8080,8443",
+		"mail":    "25,110,143,465,587,993,995",
+		"dns":     "53",
+		"ldap":    "389,636,3268,3269",
+		"db":      "1433,1521,3306,5432,6379,27017",
+		"oracle":  "1521,1522,1630,2483,2484,3872,4889,4903,5500,7001,7002,7803",
+		"windows": "135,139,445,3389,5985,5986",
+		"k8s":     "2379,2380,6443,10250",
+	}
+)
+
+// scanAddress is an address of a scan target with the ports to probe
+type scanAddress struct {
+	ip    string
+	ports []int
+}
+
+// parsePorts parses a comma separated list of ports and port ranges like 22,80,8000-8100
+func parsePorts(spec string) ([]int, error) {
+	var list []int
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(f, "-")
+		first, err := parsePortNumber(from)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parsePortNumber(to); err != nil {
+				return nil, err
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid port range %s", f)
+			}
+		}
+		for p := first; p <= last; p++ {
+			list = append(list, p)
+		}
+	}
+	return uniquePorts(list), nil
+}
+
+// parsePortNumber converts a single port of a port list
+func parsePortNumber(s string) (int, error) {
+	p, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %s", s)
+	}
+	return p, nil
+}
+
+// parsePortNames returns the ports of a comma separated list of named port lists
+func parsePortNames(names string) ([]int, error) {
+	var list []int
+	for _, n := range strings.Split(names, ",") {
+		n = strings.ToLower(strings.TrimSpace(n))
+		if n == "" {
+			continue
+		}
+		spec, ok := namedPorts[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown port list %s, available: %s", n, strings.Join(portListNames(), ", "))
+		}
+		ports, err := parsePorts(spec)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ports...)
+	}
+	return uniquePorts(list), nil
+}
+
+// portListNames returns the sorted names of the port lists
+func portListNames() []string {
+	names := make([]string, 0, len(namedPorts))
+	for n := range namedPorts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// uniquePorts sorts the ports and removes duplicates
+func uniquePorts(list []int) []int {
+	sort.Ints(list)
+	out := list[:0]
+	for i, p := range list {
+		if i == 0 || p != list[i-1] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// scanPorts returns the ports of the port flag and the named port lists.
+// scan is true if more than a single port was requested.
+func scanPorts(port, names string) (ports []int, scan bool, err error) {
+	if port != "" {
+		if ports, err = parsePorts(port); err != nil {
+			return nil, false, err
+		}
+	}
+	if names != "" {
+		named, e := parsePortNames(names)
+		if e != nil {
+			return nil, false, e
+		}
+		ports = uniquePorts(append(ports, named...))
+		if len(ports) == 0 {
+			return nil, false, fmt.Errorf("no ports in --ports %s", names)
+		}
+	}
+	return ports, names != "" || len(ports) > 1, nil
+}
+
+// portState maps a TCPing result to open, closed, filtered or error. Like nmap, ICMP unreachable
+// and prohibited answers count as filtered.
+func portState(t *TCPing) string {
+	switch t.Code {
+	case tcpCodeOpen:
+		return portOpen
+	case tcpCodeRefused:
+		return portClosed
+	case tcpCodeTimeout, tcpCodeHostUnreach, tcpCodeNetUnreach, tcpCodeProhibited:
+		return portFiltered
+	}
+	return portError
+}
+
+// runPortScan probes every port on every address of the targets with at most parallelJobs
+// concurrent connections and prints the results as port by address matrix.
+// A port embedded in a target is scanned on this target in addition to the port list.
+func runPortScan(targets []string, ports []int) error {
+	resolved := make([][]scanAddress, len(targets))
+	err := runTargets("tcp", targets, func(j *targetJob) {
+		host, p, e := splitProbeTarget(j.target, ports[0])
+		if e != nil {
+			j.err = e
+			return
+		}
+		hosts, e := lookupTargetHost(host)
+		if e != nil {
+			log.Debugf("TCP scan resolve %s failed: %v", j.target, e)
+			resolveFailed(j, e)
+			return
+		}
+		list := uniquePorts(append(append([]int(nil), ports...), p))
+		for _, h := range hosts {
+			resolved[j.index] = append(resolved[j.index], scanAddress{ip: h, ports: list})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// targets with the same address are scanned once with the ports of all of them
+	var addrs []scanAddress
+	seen := map[string]int{}
+	for _, l := range resolved {
+		for _, a := range l {
+			i, ok := seen[a.ip]
+			if !ok {
+				seen[a.ip] = len(addrs)
+				addrs = append(addrs, a)
+				continue
+			}
+			addrs[i].ports = uniquePorts(append(append([]int(nil), addrs[i].ports...), a.ports...))
+		}
+	}
+
+	// probe all address and port pairs
+	var probes []*TCPing
+	var jobs []string
+	for _, a := range addrs {
+		for _, p := range a.ports {
+			jobs = append(jobs, net.JoinHostPort(a.ip, strconv.Itoa(p)))
+			probes = append(probes, nil)
+		}
+	}
+	log.Debugf("TCP scan of %d ports on %d addresses with %d connections", len(jobs), len(addrs), parallelJobs)
+	runParallel(len(jobs), func(i int) {
+		t := new(TCPing)
+		_ = t.Run(jobs[i])
+		probes[i] = t
+	})
+
+	if !textOutput() {
+		for _, t := range probes {
+			emit(t.Record(), t.Log)
+		}
+		return nil
+	}
+	logPortMatrix(addrs, probes)
+	return nil
+}
+
+// logPortMatrix prints one row per port with the state on each address and a summary per address
+func logPortMatrix(addrs []scanAddress, probes []*TCPing) {
+	states := make([]map[int]string, len(addrs))
+	var all []int
+	n := 0
+	for i, a := range addrs {
+		states[i] = map[int]string{}
+		for _, p := range a.ports {
+			states[i][p] = portState(probes[n])
+			n++
+		}
+		all = append(all, a.ports...)
+	}
+	all = uniquePorts(all)
+	width := make([]int, len(addrs))
+	header := cyan("%-7s", "PORT")
+	for i, a := range addrs {
+		width[i] = len(a.ip) + 2
+		if width[i] < 10 {
+			width[i] = 10
+		}
+		header += cyan("%-*s", width[i], a.ip)
+	}
+	fmt.Println(header)
+	for _, p := range all {
+		line := fmt.Sprintf("%-7d", p)
+		for i := range addrs {
+			line += colorPortState(states[i][p], width[i])
+		}
+		fmt.Println(line)
+	}
+	fmt.Println()
+	for i, a := range addrs {
+		count := map[string]int{}
+		for _, s := range states[i] {
+			count[s]++
+		}
+		fmt.Printf("%s%-30s    open %d  closed %d  filtered %d  error %d\n", cyan("%-7s", "SCAN"), a.ip,
+			count[portOpen], count[portClosed], count[portFiltered], count[portError])
+	}
+}
+
+// colorPortState formats a matrix cell, ports not scanned on an address are shown as -
+func colorPortState(state string, width int) string {
+	switch state {
+	case portOpen:
+		return green("%-*s", width, state)
+	case portClosed:
+		return yellow("%-*s", width, state)
+	case portFiltered, portError:
+		return red("%-*s", width, state)
+	}
+	return fmt.Sprintf("%-*s", width, "-")
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func TestParsePorts(t *testing.T) {
+	for _, c := range []struct {
+		spec  string
+		ports []int
+		err   bool
+	}{
+		{"22", []int{22}, false},
+		{"443,22, 80", []int{22, 80, 443}, false},
+		{"8000-8003,8001,22", []int{22, 8000, 8001, 8002, 8003}, false},
+		{"65535", []int{65535}, false},
+		{"0", nil, true},
+		{"65536", nil, true},
+		{"80-70", nil, true},
+		{"http", nil, true},
+		{"1-", nil, true},
+	} {
+		t.Run(c.spec, func(t *testing.T) {
+			ports, err := parsePorts(c.spec)
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.ports, ports)
+		})
+	}
+}
+
+func TestScanPorts(t *testing.T) {
+	ports, scan, err := scanPorts("22", "")
+	require.NoError(t, err)
+	assert.False(t, scan)
+	assert.Equal(t, []int{22}, ports)
+
+	ports, scan, err = scanPorts("", "")
+	require.NoError(t, err)
+	assert.False(t, scan)
+	assert.Empty(t, ports)
+
+	ports, scan, err = scanPorts("22,8443", "WEB")
+	require.NoError(t, err)
+	assert.True(t, scan)
+	assert.Equal(t, []int{22, 80, 443, 8080, 8443}, ports)
+
+	ports, scan, err = scanPorts("", "ssh")
+	require.NoError(t, err)
+	assert.True(t, scan, "a named list is a scan even with one port")
+	assert.Equal(t, []int{22}, ports)
+
+	_, _, err = scanPorts("", ",")
+	assert.ErrorContains(t, err, "no ports")
+
+	_, _, err = scanPorts("", "web,nosuchlist")
+	assert.ErrorContains(t, err, "unknown port list nosuchlist")
+	for _, n := range portListNames() {
+		_, err = parsePortNames(n)
+		assert.NoError(t, err, "port list %s", n)
+	}
+}
+
+func TestPortState(t *testing.T) {
+	for code, state := range map[int]string{
+		tcpCodeOpen:         portOpen,
+		tcpCodeRefused:      portClosed,
+		tcpCodeTimeout:      portFiltered,
+		tcpCodeHostUnreach:  portFiltered,
+		tcpCodeNetUnreach:   portFiltered,
+		tcpCodeProhibited:   portFiltered,
+		tcpCodeNoRoute:      portError,
+		tcpCodeAddrNotAvail: portError,
+		tcpCodeError:        portError,
+	} {
+		assert.Equal(t, state, portState(&TCPing{Code: code}), "code %d", code)
+	}
+}
+
+func TestTCPPortScan(t *testing.T) {
+	resetTargets(t)
+	t.Cleanup(func() {
+		portNames = ""
+		pingCount = 1
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	open := l.Addr().(*net.TCPAddr).Port
+	c, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := c.Addr().(*net.TCPAddr).Port
+	_ = c.Close()
+	defer func() { _ = l.Close() }()
+
+	t.Run("CMD TCP port list", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			"127.0.0.1",
+			fmt.Sprintf("%d,%d", open, closed),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, fmt.Sprintf("record tcp 127.0.0.1:%d OPEN", open))
+		assert.Contains(t, out, fmt.Sprintf("record tcp 127.0.0.1:%d REFUSED", closed))
+		assert.Contains(t, out, fmt.Sprintf("with %d connections", scanDefaultParallel))
+	})
+	t.Run("CMD TCP port list same address", func(t *testing.T) {
+		m, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() { _ = m.Close() }()
+		extra := m.Addr().(*net.TCPAddr).Port
+		args := []string{
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", closed),
+			fmt.Sprintf("127.0.0.1:%d", extra),
+			"-p", fmt.Sprintf("%d,%d", open, closed),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "TCP scan of 3 ports on 1 addresses", "the port sets of both targets are merged")
+		assert.Contains(t, out, fmt.Sprintf("record tcp 127.0.0.1:%d OPEN", extra))
+		assert.Contains(t, out, fmt.Sprintf("record tcp 127.0.0.1:%d OPEN", open))
+		assert.Equal(t, 1, strings.Count(out, fmt.Sprintf("record tcp 127.0.0.1:%d REFUSED", closed)))
+	})
+	t.Run("CMD TCP port list unresolvable", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			"nosuchhost.invalid",
+			"127.0.0.1",
+			"-p", fmt.Sprintf("%d,%d", open, closed),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record tcp nosuchhost.invalid DNS-ERROR")
+		assert.Contains(t, out, fmt.Sprintf("record tcp 127.0.0.1:%d OPEN", open))
+	})
+	t.Run("CMD TCP port list with count", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			"127.0.0.1",
+			"-p", fmt.Sprintf("%d-%d", open, open+1),
+			"-c", "2",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "--count")
+	})
+	t.Run("CMD TCP unknown port list", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			"127.0.0.1",
+			"--ports", "nosuchlist",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.Error(t, err)
+	})
+}
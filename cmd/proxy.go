@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// proxy URL schemes of --proxy
+const (
+	proxySOCKS5  = "socks5"
+	proxySOCKS5H = "socks5h"
+	proxyHTTP    = "http"
+)
+
+var (
+	proxyAddress string
+	// proxyURL is the parsed --proxy flag, nil for direct connections
+	proxyURL *url.URL
+)
+
+// ProxyError is a failure of the proxy itself: the connection to the proxy, the authentication or the protocol
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// ProxyTargetError is a failure the proxy reports for its connection to the target, Code is the TCP result code
+type ProxyTargetError struct {
+	Proxy  string
+	Target string
+	Reason string
+	Code   int
+}
+
+func (e *ProxyTargetError) Error() string {
+	return fmt.Sprintf("proxy %s: target %s: %s", e.Proxy, e.Target, e.Reason)
+}
+
+// checkProxyFlag parses --proxy, the port defaults to 1080 for SOCKS5 and 8080 for HTTP proxies
+func checkProxyFlag() error {
+	proxyURL = nil
+	if proxyAddress == "" {
+		return nil
+	}
+	u, err := url.Parse(proxyAddress)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy %s, use socks5://[user:pass@]host:port or http://[user:pass@]host:port", proxyAddress)
+	}
+	port := "1080"
+	switch u.Scheme {
+	case proxySOCKS5, proxySOCKS5H:
+	case proxyHTTP:
+		port = "8080"
+	default:
+		return fmt.Errorf("unsupported proxy scheme %s (use %s, %s or %s)", u.Scheme, proxySOCKS5, proxySOCKS5H, proxyHTTP)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	proxyURL = u
+	return nil
+}
+
+// proxyHost returns the address of the proxy or an empty string without proxy
+func proxyHost() string {
+	if proxyURL == nil {
+		return ""
+	}
+	return proxyURL.Host
+}
+
+// proxyResolves reports whether target names are passed to the proxy instead of being resolved locally.
+// socks5:// resolves locally like curl, socks5h:// and HTTP proxies resolve on the proxy.
+func proxyResolves() bool {
+	return proxyURL != nil && proxyURL.Scheme != proxySOCKS5
+}
+
+// dialTCP opens a TCP connection to address, through the SSH bastion of --ssh-jump or the proxy of --proxy
+func dialTCP(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	switch {
+	case sshHost != "":
+		return sshDial(ctx, address, timeout)
+	case proxyURL != nil:
+		return proxyDial(ctx, address, timeout)
+	}
+	return newDialer(timeout).DialContext(ctx, "tcp", address)
+}
+
+// dialTLS opens a TCP connection with dialTCP and runs the TLS handshake within timeout or until ctx is done
+func dialTLS(ctx context.Context, address string, cfg *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := dialTCP(ctx, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// proxyDial connects to the proxy and asks it to connect to address
+func proxyDial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	p := proxyURL.Host
+	log.Debugf("connect to %s via %s proxy %s", address, proxyURL.Scheme, p)
+	conn, err := newDialer(timeout).DialContext(ctx, "tcp", p)
+	if err != nil {
+		return nil, &ProxyError{Proxy: p, Err: err}
+	}
+	deadline, ok := ctx.Deadline()
+	if timeout > 0 && (!ok || time.Now().Add(timeout).Before(deadline)) {
+		deadline, ok = time.Now().Add(timeout), true
+	}
+	if ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if proxyURL.Scheme == proxyHTTP {
+		conn, err = httpConnect(conn, proxyURL, address)
+	} else {
+		err = socks5Connect(conn, proxyURL, address)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyFailed wraps an error of the proxy conversation, a timeout while the proxy connects to the target
+// is reported as target timeout
+func proxyFailed(p, target string, err error, waitTarget bool) error {
+	var netErr net.Error
+	if waitTarget && errors.As(err, &netErr) && netErr.Timeout() {
+		return &ProxyTargetError{Proxy: p, Target: target, Reason: "connect timeout", Code: tcpCodeTimeout}
+	}
+	return &ProxyError{Proxy: p, Err: err}
+}
+
+// socks5Replies maps the SOCKS5 reply codes of RFC 1928 for target failures to TCP result codes
+var socks5Replies = map[byte]struct {
+	reason string
+	code   int
+}{
+	0x02: {"connection not allowed by ruleset", tcpCodeProhibited},
+	0x03: {"network unreachable", tcpCodeNetUnreach},
+	0x04: {"host unreachable", tcpCodeHostUnreach},
+	0x05: {"connection refused", tcpCodeRefused},
+	0x06: {"TTL expired", tcpCodeTimeout},
+}
+
+// socks5Connect runs the SOCKS5 handshake with optional username/password authentication (RFC 1929)
+// and the CONNECT request for address
+func socks5Connect(conn net.Conn, u *url.URL, address string) error {
+	p := u.Host
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+	methods := []byte{0x00}
+	if u.User != nil {
+		methods = []byte{0x02}
+	}
+	if _, err = conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return proxyFailed(p, address, err, false)
+	}
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return proxyFailed(p, address, err, false)
+	}
+	if buf[0] != 0x05 {
+		return &ProxyError{Proxy: p, Err: fmt.Errorf("no SOCKS5 server (version %d)", buf[0])}
+	}
+	switch buf[1] {
+	case 0x00:
+	case 0x02:
+		if u.User == nil {
+			return &ProxyError{Proxy: p, Err: errors.New("authentication required")}
+		}
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return &ProxyError{Proxy: p, Err: errors.New("username or password too long")}
+		}
+		req := append([]byte{0x01, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err = conn.Write(req); err != nil {
+			return proxyFailed(p, address, err, false)
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return proxyFailed(p, address, err, false)
+		}
+		if buf[1] != 0x00 {
+			return &ProxyError{Proxy: p, Err: errors.New("authentication failed")}
+		}
+	default:
+		return &ProxyError{Proxy: p, Err: errors.New("no acceptable authentication method")}
+	}
+
+	// CONNECT request, names are resolved locally with socks5://
+	if u.Scheme == proxySOCKS5 && net.ParseIP(host) == nil {
+		ips, e := lookupProbeHost(host)
+		if e != nil {
+			return e
+		}
+		host = ips[0].String()
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		req = append(append(req, 0x01), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, 0x04), ip.To16()...)
+	case len(host) > 255:
+		return fmt.Errorf("host name %s too long", host)
+	default:
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return proxyFailed(p, address, err, false)
+	}
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return proxyFailed(p, address, err, true)
+	}
+	if reply[1] != 0x00 {
+		if r, ok := socks5Replies[reply[1]]; ok {
+			return &ProxyTargetError{Proxy: p, Target: address, Reason: r.reason, Code: r.code}
+		}
+		return &ProxyError{Proxy: p, Err: fmt.Errorf("SOCKS5 reply code %d", reply[1])}
+	}
+	// skip the bound address
+	n := 0
+	switch reply[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x04:
+		n = net.IPv6len
+	case 0x03:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return proxyFailed(p, address, err, false)
+		}
+		n = int(buf[0])
+	default:
+		return &ProxyError{Proxy: p, Err: fmt.Errorf("invalid SOCKS5 address type %d", reply[3])}
+	}
+	if _, err = io.ReadFull(conn, make([]byte, n+2)); err != nil {
+		return proxyFailed(p, address, err, false)
+	}
+	return nil
+}
+
+// httpConnect sends an HTTP CONNECT request with optional basic authentication. Data the target sent
+// after the proxy response, like an SMTP greeting, is kept in the returned connection.
+func httpConnect(conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	p := u.Host
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return conn, proxyFailed(p, address, err, false)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, proxyFailed(p, address, err, true)
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return conn, &ProxyError{Proxy: p, Err: errors.New(resp.Status)}
+	case resp.StatusCode == http.StatusForbidden:
+		return conn, &ProxyTargetError{Proxy: p, Target: address, Reason: resp.Status, Code: tcpCodeProhibited}
+	case resp.StatusCode == http.StatusGatewayTimeout:
+		return conn, &ProxyTargetError{Proxy: p, Target: address, Reason: resp.Status, Code: tcpCodeTimeout}
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable:
+		return conn, &ProxyTargetError{Proxy: p, Target: address, Reason: resp.Status, Code: tcpCodeError}
+	default:
+		return conn, &ProxyError{Proxy: p, Err: errors.New(resp.Status)}
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection with data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -36,15 +36,15 @@ func init() {
 
 // IPInfo is the struct of IP information
 type IPInfo struct {
-	IP        string
-	Continent string  `json:"Continent"`
-	Country   string  `json:"Country"`
-	City      string  `json:"City"`
-	Latitude  float64 `json:"Latitude"`
-	Longitude float64 `json:"Longitude"`
-	TimeZone  string  `json:"TimeZone"`
-	ASN       uint    `json:"ASN"`
-	ORG       string  `json:"Organization"`
+	IP        string  `json:"IP" yaml:"IP"`
+	Continent string  `json:"Continent" yaml:"Continent"`
+	Country   string  `json:"Country" yaml:"Country"`
+	City      string  `json:"City" yaml:"City"`
+	Latitude  float64 `json:"Latitude" yaml:"Latitude"`
+	Longitude float64 `json:"Longitude" yaml:"Longitude"`
+	TimeZone  string  `json:"TimeZone" yaml:"TimeZone"`
+	ASN       uint    `json:"ASN" yaml:"ASN"`
+	ORG       string  `json:"Organization" yaml:"Organization"`
 }
 
 func runQuery(_ *cobra.Command, args []string) error {
@@ -68,7 +68,7 @@ func runQuery(_ *cobra.Command, args []string) error {
 			continue
 		}
 		info.IP = a
-		logQuery(info)
+		emit(newResult("query", a, "OK", nil, info), func() { logQuery(info) })
 	}
 	log.Debugf("Query done")
 	return nil
@@ -2,6 +2,7 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -22,6 +23,8 @@ var (
       It may also run an httptrace and ip traces (using system mtr installation).
       You can also use it to query IP network information from https://ifconfig.is.
       it has an echo server and client function to check not yet available service ports`,
+		PersistentPreRunE:  checkGlobalFlags,
+		PersistentPostRunE: flushResults,
 	}
 
 	debugFlag      = false
@@ -49,22 +52,62 @@ func init() {
 	RootCmd.PersistentFlags().BoolVarP(&infoFlag, "info", "", false, "reduced info output")
 	RootCmd.PersistentFlags().BoolVar(&unitTestFlag, "unit-test", false, "redirect output for unit tests")
 	RootCmd.PersistentFlags().BoolVar(&noLogColorFlag, "no-color", false, "disable colored log output")
+	RootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", outputText, "output format: text, json, yaml or csv")
+	RootCmd.PersistentFlags().BoolVar(&pluginMode, "plugin", false, "monitoring plugin mode: one status line with perfdata and exit code 0-3")
+	RootCmd.PersistentFlags().StringVar(&pluginWarnFlag, "warning", "", "plugin warning thresholds: latency ms[,loss%] for tcp/icmp/mtr, total ms for http, days left for tls (e.g. 30:)")
+	RootCmd.PersistentFlags().StringVar(&pluginCritFlag, "critical", "", "plugin critical thresholds, same format as --warning")
 	RootCmd.PersistentFlags().BoolVar(&dnsTCP, "dnsTCP", false, "Query DNS with TCP instead of UDP")
 	RootCmd.PersistentFlags().BoolVar(&dnsIPv4Only, "dnsIPv4", false, "return only IPv4 Addresses from DNS Server")
 	RootCmd.PersistentFlags().IntVar(&dnsTimeout, "dnsTimeout", 0, "DNS Timeout in sec")
 	RootCmd.PersistentFlags().IntVar(&dnsPort, "dnsPort", 0, "DNS Server Port Address")
 	RootCmd.PersistentFlags().StringVar(&dnsServer, "dnsServer", "", "DNS Server IP Address to query")
+	RootCmd.PersistentFlags().StringVar(&sourceAddress, "source", "", "local source IP address of the probes")
+	RootCmd.PersistentFlags().IntVar(&sourcePort, "source-port", 0, "local source port of TCP connections")
+	RootCmd.PersistentFlags().StringVar(&sourceInterface, "interface", "", "bind the probes to a network interface (Linux)")
+	RootCmd.PersistentFlags().StringVar(&proxyAddress, "proxy", "", "connect tcp, tls, http and echo probes through a proxy: socks5://, socks5h:// or http://[user:pass@]host:port")
+	RootCmd.PersistentFlags().StringVar(&netnsName, "netns", "", "run the probes in a named network namespace or namespace file (Linux)")
+	RootCmd.PersistentFlags().StringVar(&vrfName, "vrf", "", "run the probes in a VRF (Linux)")
+	RootCmd.PersistentFlags().StringVar(&sshJump, "ssh-jump", "", "tunnel tcp, tls, http and echo probes through an SSH bastion: [user@]host[:port]")
+	RootCmd.PersistentFlags().StringVar(&sshKeyFile, "ssh-key", "", "private key file for --ssh-jump, default ~/.ssh/id_ed25519, id_ecdsa and id_rsa")
 	cobra.OnInitialize(initConfig)
 }
 
 // Execute run application
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	err := RootCmd.Execute()
+	if pluginMode {
+		// monitoring plugins report failures as UNKNOWN
+		if err != nil {
+			fmt.Printf("UNKNOWN - %s\n", err)
+			os.Exit(pluginUnknown)
+		}
+		os.Exit(pluginExitCode)
+	}
+	if err != nil {
 		// fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+// checkGlobalFlags validates the global flags before a command runs and enters the network namespace
+func checkGlobalFlags(cmd *cobra.Command, args []string) error {
+	if err := checkOutputFormat(cmd, args); err != nil {
+		return err
+	}
+	if err := checkProxyFlag(); err != nil {
+		return err
+	}
+	if err := checkSSHJumpFlag(); err != nil {
+		return err
+	}
+	if netnsName != "" {
+		if err := enterNetns(netnsName); err != nil {
+			return err
+		}
+	}
+	return checkSourceFlags()
+}
+
 func initConfig() {
 	// logger settings
 	log.SetLevel(log.ErrorLevel)
@@ -89,10 +132,16 @@ func initConfig() {
 	if noLogColorFlag {
 		color.NoColor = true
 	}
-	// DNS settings
+	// DNS settings, inside a network namespace the resolv.conf of ip netns is used
+	if dnsServer == "" && netnsName != "" && os.Getenv(netnsEnv) == netnsName {
+		dnsServer = netnsNameserver(netnsName)
+	}
 	dnsConfig = netlib.NewResolver(dnsServer, dnsPort, dnsTCP)
 	dnsConfig.IPv4Only = dnsIPv4Only
 	if dnsTimeout > 0 {
 		dnsConfig.Timeout = time.Duration(dnsTimeout) * time.Second
 	}
+	if vrfName != "" {
+		dnsConfig.Resolver = vrfResolver(dnsConfig)
+	}
 }
@@ -0,0 +1,488 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tommi2day/gomodules/common"
+	"gopkg.in/yaml.v3"
+)
+
+// probe types of the serve configuration
+const (
+	probeTypeTCP  = "tcp"
+	probeTypeICMP = "icmp"
+	probeTypeHTTP = "http"
+	probeTypeTLS  = "tls"
+	probeTypeEcho = "echo"
+)
+
+const (
+	serveDefaultListen   = ":9115"
+	serveDefaultInterval = time.Minute
+	serveDefaultTimeout  = 5 * time.Second
+	serveTLSPort         = 443
+	metricNamespace      = "tcping2_"
+)
+
+var (
+	serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Run scheduled probes and export Prometheus metrics",
+		Long: `Reads probe definitions (tcp, icmp, http, tls, echo) from a YAML config file, runs them
+continuously in their interval and exposes the results on /metrics in the Prometheus text format.
+On demand probes are available on /probe?module=<module>&target=<target> like the blackbox exporter.`,
+		RunE:         runServe,
+		SilenceUsage: true,
+	}
+	serveConfigFile string
+	serveListen     = serveDefaultListen
+	serveOnce       = false
+)
+
+// ServeConfig is the configuration file of the serve command
+type ServeConfig struct {
+	Listen   string        `yaml:"listen"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Probes   []ProbeConfig `yaml:"probes"`
+	// Modules are the probe templates of the /probe endpoint, the target is taken from the request
+	Modules map[string]ProbeConfig `yaml:"modules"`
+}
+
+// ProbeConfig defines one scheduled probe or a module. Interval and Timeout default to the global values of the file.
+type ProbeConfig struct {
+	Name     string        `yaml:"name"`
+	Type     string        `yaml:"type"`
+	Target   string        `yaml:"target"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	RootCA   string        `yaml:"rootca"`
+	StartTLS string        `yaml:"starttls"`
+	pool     *x509.CertPool
+}
+
+// probeOutcome is the result of one probe run
+type probeOutcome struct {
+	success  bool
+	duration time.Duration
+	timings  *HTTPTimings
+	status   int
+	cert     *CertInfo
+	expiry   time.Time
+	err      error
+}
+
+func init() {
+	serveCmd.Flags().StringVarP(&serveConfigFile, "config", "f", "", "YAML file with the probe and module definitions")
+	serveCmd.Flags().StringVarP(&serveListen, "listen", "l", serveListen, "listen address of the metrics endpoint, overrides the config file")
+	serveCmd.Flags().BoolVar(&serveOnce, "once", false, "run all probes once, print the metrics and exit")
+	RootCmd.AddCommand(serveCmd)
+}
+
+func runServe(cmd *cobra.Command, _ []string) error {
+	cfg, err := loadServeConfig(serveConfigFile)
+	if err != nil {
+		return err
+	}
+	listen := serveListen
+	if !cmd.Flags().Changed("listen") && cfg.Listen != "" {
+		listen = cfg.Listen
+	}
+	reg := newMetricRegistry()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if serveOnce {
+		if len(cfg.Probes) == 0 {
+			return fmt.Errorf("no probes to run, please specify a config file with probes")
+		}
+		for i := range cfg.Probes {
+			reg.record(&cfg.Probes[i], cfg.Probes[i].run(ctx, 1))
+		}
+		log.Debugf("serve once done")
+		return reg.write(os.Stdout)
+	}
+
+	var wg sync.WaitGroup
+	for i := range cfg.Probes {
+		p := &cfg.Probes[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.loop(ctx, reg)
+		}()
+	}
+	err = serveMetrics(ctx, listen, reg, cfg.Modules)
+	stop()
+	wg.Wait()
+	log.Debugf("serve done")
+	return err
+}
+
+// serveMetrics runs the HTTP endpoint until ctx is done
+func serveMetrics(ctx context.Context, listen string, reg *metricRegistry, modules map[string]ProbeConfig) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := reg.write(w); err != nil {
+			log.Debugf("write metrics failed: %v", err)
+		}
+	})
+	mux.Handle("/probe", probeHandler(modules))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "<html><head><title>tcping2 exporter</title></head><body><h1>tcping2 exporter</h1>"+
+			"<p><a href=\"/metrics\">Metrics</a></p><p><a href=\"/probe?module=tcp_connect&amp;target=localhost:22\">Probe localhost:22</a></p>"+
+			"<p>%s</p></body></html>\n", GetVersion(false))
+	})
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("failed to create listener: %w", err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	fmt.Printf("listening on %s, terminate with CTRL-C\n", l.Addr())
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdown)
+	}()
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// loadServeConfig reads and validates the probe definitions. Without a path only the built-in modules are available.
+func loadServeConfig(path string) (*ServeConfig, error) {
+	cfg := &ServeConfig{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = serveDefaultInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = serveDefaultTimeout
+	}
+	for i := range cfg.Probes {
+		if err := cfg.Probes[i].prepare(cfg); err != nil {
+			return nil, fmt.Errorf("probe %d: %w", i+1, err)
+		}
+	}
+	modules := defaultModules()
+	for name, m := range cfg.Modules {
+		modules[name] = m
+	}
+	for name, m := range modules {
+		m.Name = name
+		if err := m.prepareModule(cfg); err != nil {
+			return nil, fmt.Errorf("module %s: %w", name, err)
+		}
+		modules[name] = m
+	}
+	cfg.Modules = modules
+	log.Debugf("loaded %d probes and %d modules from %s", len(cfg.Probes), len(cfg.Modules), path)
+	return cfg, nil
+}
+
+// defaultModules are the built-in modules of the /probe endpoint
+func defaultModules() map[string]ProbeConfig {
+	return map[string]ProbeConfig{
+		"tcp_connect":  {Type: probeTypeTCP},
+		"icmp":         {Type: probeTypeICMP},
+		"http_trace":   {Type: probeTypeHTTP},
+		"tls_validate": {Type: probeTypeTLS},
+		"echo":         {Type: probeTypeEcho},
+	}
+}
+
+// prepare checks the probe and applies the defaults of the config file
+func (p *ProbeConfig) prepare(cfg *ServeConfig) (err error) {
+	if p.Target == "" {
+		return fmt.Errorf("missing target")
+	}
+	if p.Name == "" {
+		p.Name = p.Target
+	}
+	if err = p.prepareModule(cfg); err != nil {
+		return err
+	}
+	switch p.Type {
+	case probeTypeTCP, probeTypeEcho:
+		_, _, err = splitProbeTarget(p.Target, 0)
+	case probeTypeTLS:
+		_, _, err = splitProbeTarget(p.Target, serveTLSPort)
+	}
+	return err
+}
+
+// prepareModule checks the target independent settings and loads the trust store
+func (p *ProbeConfig) prepareModule(cfg *ServeConfig) (err error) {
+	if p.Interval <= 0 {
+		p.Interval = cfg.Interval
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = cfg.Timeout
+	}
+	switch p.Type {
+	case probeTypeTLS:
+		p.pool, err = buildCertPool(p.RootCA)
+	case probeTypeTCP, probeTypeEcho, probeTypeICMP, probeTypeHTTP:
+	default:
+		return fmt.Errorf("invalid probe type %q, use tcp, icmp, http, tls or echo", p.Type)
+	}
+	return err
+}
+
+// loop runs the probe in its interval until ctx is done
+func (p *ProbeConfig) loop(ctx context.Context, reg *metricRegistry) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		reg.record(p, p.run(ctx, seq))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run executes the probe once with the probe logic of the CLI commands
+func (p *ProbeConfig) run(ctx context.Context, seq int) (o probeOutcome) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	switch p.Type {
+	case probeTypeTCP:
+		o = p.runTCP(ctx)
+	case probeTypeICMP:
+		o = p.runICMP(ctx, seq)
+	case probeTypeHTTP:
+		h := new(HTTPing)
+		o.err = h.RunContext(ctx, p.Target)
+		t := h.phaseTimings()
+		o.timings = &t
+		o.duration = time.Duration(h.Total)
+		o.status = h.Status
+	case probeTypeTLS:
+		o = p.runTLS(ctx)
+	case probeTypeEcho:
+		o = p.runEcho(ctx)
+	}
+	o.success = o.err == nil
+	return
+}
+
+func (p *ProbeConfig) runTCP(ctx context.Context) (o probeOutcome) {
+	addr, err := resolveProbeTarget(p.Target, 0)
+	if err != nil {
+		o.err = err
+		return
+	}
+	t := new(TCPing)
+	_ = t.RunContext(ctx, addr)
+	o.duration = t.Duration
+	if t.Code != 0 {
+		o.err = errors.New(t.Msg)
+	}
+	return
+}
+
+func (p *ProbeConfig) runICMP(ctx context.Context, seq int) (o probeOutcome) {
+	host := p.Target
+	if net.ParseIP(host) == nil {
+		if h, _, err := common.GetHostPort(host); err == nil {
+			host = h
+		}
+	}
+	ips, err := lookupProbeHost(host)
+	if err != nil {
+		o.err = err
+		return
+	}
+	// every address is pinged with its own echo id, the slowest reply is the duration of the probe
+	errs := make([]error, len(ips))
+	durations := make([]time.Duration, len(ips))
+	var wg sync.WaitGroup
+	for n, ip := range ips {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i := &ICMPing{ID: (os.Getpid() + n) & 0xffff}
+			if errs[n] = i.Open(ip.String()); errs[n] != nil {
+				errs[n] = fmt.Errorf("%s: %w", ip, errs[n])
+				return
+			}
+			defer i.Close()
+			if errs[n] = i.Ping(ctx, seq); errs[n] != nil {
+				errs[n] = fmt.Errorf("%s: %w", ip, errs[n])
+			}
+			durations[n] = i.Duration
+		}()
+	}
+	wg.Wait()
+	for _, d := range durations {
+		o.duration = max(o.duration, d)
+	}
+	o.err = errors.Join(errs...)
+	return
+}
+
+func (p *ProbeConfig) runTLS(ctx context.Context) (o probeOutcome) {
+	host, port, err := splitProbeTarget(p.Target, serveTLSPort)
+	if err != nil {
+		o.err = err
+		return
+	}
+	result := &TLSResult{Address: net.JoinHostPort(host, strconv.Itoa(port)), Host: host}
+	start := time.Now()
+	o.err = tlsDialProto(ctx, result, host, strconv.Itoa(port), p.pool, p.StartTLS, p.Timeout)
+	o.duration = time.Since(start)
+	if len(result.PeerCerts) > 0 {
+		c := newCertInfo(result.PeerCerts[0], time.Now())
+		o.cert = &c
+		for _, pc := range result.PeerCerts {
+			if o.expiry.IsZero() || pc.NotAfter.Before(o.expiry) {
+				o.expiry = pc.NotAfter
+			}
+		}
+	}
+	return
+}
+
+// runEcho connects to an echo server and checks the answer. The duration is the connect latency,
+// a tcping2 echo server is not asked to terminate.
+func (p *ProbeConfig) runEcho(ctx context.Context) (o probeOutcome) {
+	addr, err := resolveProbeTarget(p.Target, 0)
+	if err != nil {
+		o.err = err
+		return
+	}
+	start := time.Now()
+	conn, err := dialTCP(ctx, addr, 0)
+	o.duration = time.Since(start)
+	if err != nil {
+		o.err = err
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(p.Timeout))
+	_, o.err = echoExchange(conn, false)
+	return
+}
+
+// splitProbeTarget returns host and port of a target, defaultPort is used if the target has none
+func splitProbeTarget(target string, defaultPort int) (host string, port int, err error) {
+	if net.ParseIP(target) != nil {
+		host = target
+	} else if host, port, err = common.GetHostPort(target); err != nil {
+		return "", 0, fmt.Errorf("invalid target %s: %w", target, err)
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	if port == 0 {
+		return "", 0, fmt.Errorf("target %s needs a port", target)
+	}
+	return host, port, nil
+}
+
+// resolveProbeTarget returns the first address of the target as ip:port
+func resolveProbeTarget(target string, defaultPort int) (string, error) {
+	host, port, err := splitProbeTarget(target, defaultPort)
+	if err != nil {
+		return "", err
+	}
+	ips, err := lookupProbeHost(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), strconv.Itoa(port)), nil
+}
+
+// lookupProbeHost resolves a host name with the configured DNS settings
+func lookupProbeHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := dnsConfig.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no IP addresses found", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// record updates the metrics of a probe with its latest outcome
+func (r *metricRegistry) record(p *ProbeConfig, o probeOutcome) {
+	labels := []string{"probe", p.Name, "type", p.Type, "target", p.Target}
+	result := "success"
+	success := 0.0
+	if o.success {
+		success = 1
+	} else {
+		result = "failure"
+		log.Infof("probe %s %s failed: %v", p.Name, p.Type, o.err)
+	}
+	log.Debugf("probe %s %s %s success %v duration %v", p.Name, p.Type, p.Target, o.success, o.duration)
+	seconds := o.duration.Seconds()
+	r.setGauge(metricNamespace+"probe_success", "Whether the last probe was successful", success, labels...)
+	r.setGauge(metricNamespace+"probe_duration_seconds", "Duration of the last probe: connect latency for tcp and echo, round trip time for icmp, total time for http, handshake time for tls", seconds, labels...)
+	r.addCounter(metricNamespace+"probes_total", "Number of probe runs by result", 1, append(labels, "result", result)...)
+	if o.success {
+		r.observe(metricNamespace+"probe_latency_seconds", "Latency of the successful probes", latencyBuckets, seconds, labels...)
+	}
+	// the phases are complete when the server answered, also if the status or an assertion failed
+	if o.timings != nil && o.status != 0 {
+		for _, ph := range []struct {
+			name string
+			ms   float64
+		}{
+			{"dns", o.timings.DNS},
+			{"tcp", o.timings.TCP},
+			{"tls", o.timings.TLS},
+			{"process", o.timings.Process},
+			{"transfer", o.timings.Transfer},
+		} {
+			phaseLabels := append(labels, "phase", ph.name)
+			if o.success {
+				r.setGauge(metricNamespace+"http_phase_seconds", "Duration of the HTTP request phases of the last probe", ph.ms/1000, phaseLabels...)
+			}
+			r.observe(metricNamespace+"http_phase_duration_seconds", "Duration of the HTTP request phases of all answered probes", latencyBuckets, ph.ms/1000, phaseLabels...)
+		}
+	}
+	if o.cert != nil {
+		r.setGauge(metricNamespace+"tls_cert_days_left", "Days until the server certificate expires", float64(o.cert.DaysLeft), labels...)
+		r.setGauge(metricNamespace+"tls_cert_not_after_seconds", "Expiry of the server certificate as unix timestamp", float64(o.cert.NotAfter.Unix()), labels...)
+	}
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scrapeTimeoutOffset is subtracted from the Prometheus scrape timeout to leave time for the response
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// probeHandler runs a module against the target of a /probe?module=&target= request and returns
+// the metrics of this single run, following the contract of the Prometheus blackbox exporter
+func probeHandler(modules map[string]ProbeConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("module")
+		if name == "" {
+			name = "tcp_connect"
+		}
+		m, ok := modules[name]
+		if !ok {
+			http.Error(w, "Unknown module "+strconv.Quote(name), http.StatusBadRequest)
+			return
+		}
+		target := q.Get("target")
+		if target == "" {
+			http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		m.Target = target
+		m.Timeout = scrapeTimeout(r, m.Timeout)
+		reg := newMetricRegistry()
+		start := time.Now()
+		o := m.run(r.Context(), 1)
+		reg.recordProbe(&m, o, time.Since(start))
+		log.Debugf("probe request module %s target %s success %v", name, target, o.success)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := reg.write(w); err != nil {
+			log.Debugf("write probe metrics failed: %v", err)
+		}
+	})
+}
+
+// scrapeTimeout limits the module timeout to the timeout Prometheus sends with the scrape
+func scrapeTimeout(r *http.Request, timeout time.Duration) time.Duration {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return timeout
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec <= 0 {
+		return timeout
+	}
+	scrape := time.Duration(sec*float64(time.Second)) - scrapeTimeoutOffset
+	if scrape > 0 && scrape < timeout {
+		return scrape
+	}
+	return timeout
+}
+
+// recordProbe sets the blackbox exporter metrics of a single probe run
+func (r *metricRegistry) recordProbe(p *ProbeConfig, o probeOutcome, total time.Duration) {
+	success := 0.0
+	if o.success {
+		success = 1
+	} else {
+		log.Infof("probe %s %s failed: %v", p.Name, p.Target, o.err)
+	}
+	r.setGauge("probe_success", "Displays whether or not the probe was a success", success)
+	r.setGauge("probe_duration_seconds", "Returns how long the probe took to complete in seconds", total.Seconds())
+	switch p.Type {
+	case probeTypeTCP, probeTypeEcho:
+		r.setGauge("probe_connect_duration_seconds", "Duration of the TCP connect in seconds", o.duration.Seconds())
+	case probeTypeICMP:
+		r.setGauge("probe_icmp_duration_seconds", "Duration of icmp request by phase", o.duration.Seconds(), "phase", "rtt")
+	case probeTypeHTTP:
+		if o.timings != nil {
+			for _, ph := range []struct {
+				name string
+				ms   float64
+			}{
+				{"resolve", o.timings.DNS},
+				{"connect", o.timings.TCP},
+				{"tls", o.timings.TLS},
+				{"processing", o.timings.Process},
+				{"transfer", o.timings.Transfer},
+			} {
+				r.setGauge("probe_http_duration_seconds", "Duration of http request by phase, summed over all redirects", ph.ms/1000, "phase", ph.name)
+			}
+		}
+	}
+	if o.cert != nil {
+		r.setGauge("probe_ssl_earliest_cert_expiry", "Returns last SSL chain expiry in unixtime", float64(o.expiry.Unix()))
+		r.setGauge("probe_tls_cert_days_left", "Days until the server certificate expires", float64(o.cert.DaysLeft))
+	}
+}
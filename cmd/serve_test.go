@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func writeServeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "serve.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+// startEchoServer answers the version greeting like a tcping2 echo server
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+					_, _ = fmt.Fprintf(conn, "%s Server test\n", echoPrefix)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMetricRegistry(t *testing.T) {
+	reg := newMetricRegistry()
+	reg.setGauge("test_up", "Up state", 1, "probe", "a\"b")
+	reg.addCounter("test_runs_total", "Runs", 1, "probe", "a")
+	reg.addCounter("test_runs_total", "Runs", 2, "probe", "a")
+	reg.observe("test_latency_seconds", "Latency", []float64{0.1, 1}, 0.05, "probe", "a")
+	reg.observe("test_latency_seconds", "Latency", []float64{0.1, 1}, 0.5, "probe", "a")
+	var b bytes.Buffer
+	require.NoError(t, reg.write(&b))
+	expected := `# HELP test_latency_seconds Latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{probe="a",le="0.1"} 1
+test_latency_seconds_bucket{probe="a",le="1"} 2
+test_latency_seconds_bucket{probe="a",le="+Inf"} 2
+test_latency_seconds_sum{probe="a"} 0.55
+test_latency_seconds_count{probe="a"} 2
+# HELP test_runs_total Runs
+# TYPE test_runs_total counter
+test_runs_total{probe="a"} 3
+# HELP test_up Up state
+# TYPE test_up gauge
+test_up{probe="a\"b"} 1
+`
+	assert.Equal(t, expected, b.String())
+}
+
+func TestServeConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		path := writeServeConfig(t, `
+listen: 127.0.0.1:9999
+timeout: 2s
+probes:
+  - type: tcp
+    target: 127.0.0.1:22
+    interval: 10s
+  - name: web
+    type: http
+    target: https://example.com
+  - type: tls
+    target: example.com
+`)
+		cfg, err := loadServeConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1:9999", cfg.Listen)
+		require.Len(t, cfg.Probes, 3)
+		assert.Equal(t, "127.0.0.1:22", cfg.Probes[0].Name)
+		assert.Equal(t, 10*time.Second, cfg.Probes[0].Interval)
+		assert.Equal(t, 2*time.Second, cfg.Probes[0].Timeout)
+		assert.Equal(t, serveDefaultInterval, cfg.Probes[1].Interval)
+		assert.Equal(t, "web", cfg.Probes[1].Name)
+		assert.Contains(t, cfg.Modules, "tls_validate", "built-in modules")
+	})
+	t.Run("modules only", func(t *testing.T) {
+		cfg, err := loadServeConfig(writeServeConfig(t, `
+modules:
+  smtp_starttls:
+    type: tls
+    starttls: smtp
+    timeout: 3s
+`))
+		require.NoError(t, err)
+		assert.Empty(t, cfg.Probes)
+		m := cfg.Modules["smtp_starttls"]
+		assert.Equal(t, "smtp", m.StartTLS)
+		assert.Equal(t, 3*time.Second, m.Timeout)
+		assert.Equal(t, "smtp_starttls", m.Name)
+		assert.Len(t, cfg.Modules, len(defaultModules())+1)
+	})
+	t.Run("no config file", func(t *testing.T) {
+		cfg, err := loadServeConfig("")
+		require.NoError(t, err)
+		assert.Len(t, cfg.Modules, len(defaultModules()))
+	})
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"invalid type", "probes:\n  - type: ftp\n    target: x:21\n"},
+		{"missing target", "probes:\n  - type: tcp\n"},
+		{"missing port", "probes:\n  - type: tcp\n    target: localhost\n"},
+		{"unknown field", "probes:\n  - type: tcp\n    target: x:1\n    port: 2\n"},
+		{"invalid module", "modules:\n  smtp:\n    type: smtp\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadServeConfig(writeServeConfig(t, tc.content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestServeProbes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprintln(w, "ok")
+	}))
+	defer web.Close()
+	secure := httptest.NewTLSServer(http.NotFoundHandler())
+	defer secure.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: pemCertType, Bytes: secure.Certificate().Raw}), 0o600))
+	secureAddr := strings.TrimPrefix(secure.URL, "https://")
+
+	cfg := &ServeConfig{Interval: time.Minute, Timeout: 3 * time.Second, Probes: []ProbeConfig{
+		{Name: "port", Type: probeTypeTCP, Target: l.Addr().String()},
+		{Name: "closed", Type: probeTypeTCP, Target: "127.0.0.1:1"},
+		{Name: "web", Type: probeTypeHTTP, Target: web.URL},
+		{Name: "cert", Type: probeTypeTLS, Target: secureAddr, RootCA: ca},
+		{Name: "echo", Type: probeTypeEcho, Target: startEchoServer(t)},
+	}}
+	reg := newMetricRegistry()
+	for i := range cfg.Probes {
+		p := &cfg.Probes[i]
+		require.NoError(t, p.prepare(cfg))
+		o := p.run(context.Background(), 1)
+		assert.Equal(t, p.Name != "closed", o.success, "probe %s: %v", p.Name, o.err)
+		reg.record(p, o)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = reg.write(w)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var b bytes.Buffer
+	_, err = b.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	out := b.String()
+	t.Log(out)
+	assert.Contains(t, out, fmt.Sprintf("tcping2_probe_success{probe=\"port\",type=\"tcp\",target=\"%s\"} 1", l.Addr()))
+	assert.Contains(t, out, "tcping2_probe_success{probe=\"closed\",type=\"tcp\",target=\"127.0.0.1:1\"} 0")
+	assert.Contains(t, out, "tcping2_probes_total{probe=\"closed\",type=\"tcp\",target=\"127.0.0.1:1\",result=\"failure\"} 1")
+	assert.Contains(t, out, fmt.Sprintf("tcping2_http_phase_seconds{probe=\"web\",type=\"http\",target=\"%s\",phase=\"transfer\"}", web.URL))
+	assert.Contains(t, out, "# TYPE tcping2_http_phase_duration_seconds histogram")
+	for _, phase := range []string{"dns", "tcp", "tls", "process", "transfer"} {
+		assert.Contains(t, out, fmt.Sprintf("tcping2_http_phase_duration_seconds_bucket{probe=\"web\",type=\"http\",target=\"%s\",phase=\"%s\",le=\"+Inf\"} 1", web.URL, phase))
+		assert.Contains(t, out, fmt.Sprintf("tcping2_http_phase_duration_seconds_count{probe=\"web\",type=\"http\",target=\"%s\",phase=\"%s\"} 1", web.URL, phase))
+	}
+	assert.Contains(t, out, fmt.Sprintf("tcping2_tls_cert_days_left{probe=\"cert\",type=\"tls\",target=\"%s\"}", secureAddr))
+	assert.Contains(t, out, "tcping2_probe_success{probe=\"echo\"")
+	assert.Contains(t, out, fmt.Sprintf("tcping2_probe_latency_seconds_count{probe=\"port\",type=\"tcp\",target=\"%s\"} 1", l.Addr()))
+}
+
+func TestServeTLSCancel(t *testing.T) {
+	// the server accepts but never answers, only the probe context ends the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = c.Close() }()
+		}
+	}()
+	for _, starttls := range []string{"", protoSMTP} {
+		t.Run("starttls "+starttls, func(t *testing.T) {
+			p := &ProbeConfig{Name: "stall", Type: probeTypeTLS, Target: l.Addr().String(), StartTLS: starttls, Timeout: time.Minute}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			o := p.runTLS(ctx)
+			assert.Error(t, o.err)
+			assert.Less(t, time.Since(start), 10*time.Second, "probe must end with its context")
+		})
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	secure := httptest.NewTLSServer(http.NotFoundHandler())
+	defer secure.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: pemCertType, Bytes: secure.Certificate().Raw}), 0o600))
+	cfg, err := loadServeConfig(writeServeConfig(t, fmt.Sprintf("modules:\n  tls_company:\n    type: tls\n    rootca: %s\n", ca)))
+	require.NoError(t, err)
+	srv := httptest.NewServer(probeHandler(cfg.Modules))
+	defer srv.Close()
+
+	get := func(t *testing.T, query string) (int, string) {
+		resp, err := http.Get(srv.URL + "/probe?" + query)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var b bytes.Buffer
+		_, err = b.ReadFrom(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, b.String()
+	}
+	t.Run("tcp_connect", func(t *testing.T) {
+		code, out := get(t, "module=tcp_connect&target="+l.Addr().String())
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, out, "\nprobe_success 1\n")
+		assert.Contains(t, out, "# TYPE probe_duration_seconds gauge")
+		assert.Contains(t, out, "probe_connect_duration_seconds ")
+	})
+	t.Run("closed port", func(t *testing.T) {
+		_, out := get(t, "module=tcp_connect&target=127.0.0.1:1")
+		assert.Contains(t, out, "\nprobe_success 0\n")
+	})
+	t.Run("tls custom root", func(t *testing.T) {
+		target := strings.TrimPrefix(secure.URL, "https://")
+		_, out := get(t, "module=tls_company&target="+target)
+		assert.Contains(t, out, "\nprobe_success 1\n")
+		assert.Contains(t, out, "probe_ssl_earliest_cert_expiry ")
+		_, out = get(t, "module=tls_validate&target="+target)
+		assert.Contains(t, out, "\nprobe_success 0\n", "test certificate is not in the system trust store")
+	})
+	t.Run("unknown module", func(t *testing.T) {
+		code, _ := get(t, "module=nope&target=127.0.0.1:1")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+	t.Run("missing target", func(t *testing.T) {
+		code, _ := get(t, "module=icmp")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/probe", nil)
+	assert.Equal(t, 5*time.Second, scrapeTimeout(r, 5*time.Second))
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "3")
+	assert.Equal(t, 2500*time.Millisecond, scrapeTimeout(r, 5*time.Second))
+	assert.Equal(t, time.Second, scrapeTimeout(r, time.Second))
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "x")
+	assert.Equal(t, 5*time.Second, scrapeTimeout(r, 5*time.Second))
+}
+
+func TestServeCmd(t *testing.T) {
+	t.Cleanup(func() {
+		serveConfigFile = ""
+		serveOnce = false
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	path := writeServeConfig(t, fmt.Sprintf("probes:\n  - name: local\n    type: tcp\n    target: %s\n", l.Addr()))
+
+	t.Run("CMD serve once", func(t *testing.T) {
+		args := []string{
+			"serve",
+			"--config", path,
+			"--once",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Contains(t, out, fmt.Sprintf("probe local tcp %s success true", l.Addr()))
+		t.Log(out)
+	})
+	t.Run("CMD serve without config", func(t *testing.T) {
+		serveConfigFile = ""
+		args := []string{
+			"serve",
+			"--once",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.Error(t, err)
+	})
+}
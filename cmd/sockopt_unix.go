@@ -0,0 +1,18 @@
+//go:build !windows
+
+package cmd
+
+import "syscall"
+
+// setSocketTTL sets the unicast TTL (IPv4) or hop limit (IPv6) of a socket
+func setSocketTTL(fd uintptr, v6 bool, ttl int) error {
+	if v6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
+
+// setReuseAddr allows binding a local address that is still in use by a closed connection
+func setReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	sourceAddress   string
+	sourcePort      int
+	sourceInterface string
+)
+
+// checkSourceFlags validates --source, --source-port, --interface and --vrf
+func checkSourceFlags() error {
+	if sourceAddress != "" && net.ParseIP(sourceAddress) == nil {
+		return fmt.Errorf("invalid source address %s", sourceAddress)
+	}
+	if sourcePort < 0 || sourcePort > 65535 {
+		return fmt.Errorf("invalid source port %d", sourcePort)
+	}
+	if sourceInterface != "" {
+		if _, err := net.InterfaceByName(sourceInterface); err != nil {
+			return fmt.Errorf("invalid interface %s: %w", sourceInterface, err)
+		}
+		if !bindToDeviceSupported {
+			return fmt.Errorf("--interface is only supported on Linux")
+		}
+	}
+	if vrfName != "" {
+		if sourceInterface != "" {
+			return fmt.Errorf("--interface and --vrf can not be combined")
+		}
+		if _, err := net.InterfaceByName(vrfName); err != nil {
+			return fmt.Errorf("invalid VRF %s: %w", vrfName, err)
+		}
+		if !bindToDeviceSupported {
+			return fmt.Errorf("--vrf is only supported on Linux")
+		}
+	}
+	return nil
+}
+
+// sourceSet reports whether any source option is given, the local address is shown then
+func sourceSet() bool {
+	return sourceAddress != "" || sourcePort != 0 || bindDevice() != ""
+}
+
+// localSource returns the local address of a probe connection. Behind a proxy or an SSH bastion it
+// is not the source of the probe, an SSH channel has only a placeholder, so it is empty then.
+func localSource(conn net.Conn) string {
+	if relayHost() != "" {
+		return ""
+	}
+	return conn.LocalAddr().String()
+}
+
+// newDialer returns a dialer bound to the source address, port and interface
+func newDialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if sourceAddress != "" || sourcePort != 0 {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceAddress), Port: sourcePort}
+	}
+	if bindDevice() != "" || sourcePort != 0 {
+		d.Control = sourceControl
+	}
+	return d
+}
+
+// sourceControl binds the socket to the interface or VRF and allows reusing a fixed source port
+func sourceControl(_, _ string, c syscall.RawConn) error {
+	if sourcePort != 0 {
+		cerr := c.Control(func(fd uintptr) {
+			if e := setReuseAddr(fd); e != nil {
+				log.Debugf("set SO_REUSEADDR failed: %v", e)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+	}
+	return controlDevice(c, bindDevice())
+}
+
+// controlDevice binds a socket to a device, an empty device leaves the socket unbound
+func controlDevice(c syscall.RawConn, dev string) error {
+	if dev == "" {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) { err = bindToDevice(fd, dev) }); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("bind to device %s: %w", dev, err)
+	}
+	return nil
+}
+
+// bindPacketConn binds an already opened packet socket to the interface or VRF
+func bindPacketConn(c net.PacketConn) error {
+	dev := bindDevice()
+	if dev == "" {
+		return nil
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("socket can not be bound to device %s", dev)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return controlDevice(rc, dev)
+}
+
+// newTransport returns a copy of the default HTTP transport dialing with newDialer and resolving
+// with the global DNS settings
+func newTransport(timeout time.Duration) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = httpDialContext(timeout)
+	switch {
+	case sshHost != "":
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialTCP(ctx, relayAddress(addr), timeout)
+		}
+	case proxyURL != nil:
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	return tr
+}
+
+// sourceListenAddr returns the local address of an ICMP socket for the IP family:
+// the source address, the first address of the interface or the unspecified address
+func sourceListenAddr(t IPType) (string, error) {
+	v6 := t.Type == IPType6.Type
+	if sourceAddress != "" {
+		ip := net.ParseIP(sourceAddress)
+		if (ip.To4() == nil) != v6 {
+			return "", fmt.Errorf("source address %s does not match the IPv%s target", sourceAddress, t.Type)
+		}
+		return sourceAddress, nil
+	}
+	if sourceInterface != "" {
+		return interfaceAddr(sourceInterface, v6)
+	}
+	return t.ListenAddr, nil
+}
+
+// interfaceAddr returns the first address of the interface of the given family,
+// IPv6 link local addresses are skipped
+func interfaceAddr(name string, v6 bool) (string, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || (n.IP.To4() == nil) != v6 || (v6 && n.IP.IsLinkLocalUnicast()) {
+			continue
+		}
+		return n.IP.String(), nil
+	}
+	family := "IPv4"
+	if v6 {
+		family = "IPv6"
+	}
+	return "", errors.New("interface " + name + " has no " + family + " address")
+}
+
+// localIP returns the IP of a local socket address
+func localIP(a net.Addr) string {
+	switch v := a.(type) {
+	case *net.IPAddr:
+		return v.IP.String()
+	case *net.UDPAddr:
+		return v.IP.String()
+	}
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package cmd
+
+import "syscall"
+
+// bindToDeviceSupported reports whether sockets can be bound to an interface
+const bindToDeviceSupported = true
+
+// bindToDevice binds a socket to a network interface with SO_BINDTODEVICE
+func bindToDevice(fd uintptr, name string) error {
+	return syscall.BindToDevice(int(fd), name)
+}
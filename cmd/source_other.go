@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cmd
+
+import "errors"
+
+// bindToDeviceSupported reports whether sockets can be bound to an interface
+const bindToDeviceSupported = false
+
+// bindToDevice is only available on Linux
+func bindToDevice(_ uintptr, _ string) error {
+	return errors.New("binding to an interface is only supported on Linux")
+}
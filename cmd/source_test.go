@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func resetSource(t *testing.T) {
+	t.Cleanup(func() {
+		sourceAddress = ""
+		sourcePort = 0
+		sourceInterface = ""
+	})
+}
+
+// freePort returns a local TCP port that is not in use
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	return port
+}
+
+func TestCheckSourceFlags(t *testing.T) {
+	resetSource(t)
+	for _, c := range []struct {
+		name    string
+		address string
+		port    int
+		iface   string
+		err     bool
+	}{
+		{"none", "", 0, "", false},
+		{"ipv4", "127.0.0.1", 0, "", false},
+		{"ipv6 and port", "::1", 40000, "", false},
+		{"invalid address", "localhost", 0, "", true},
+		{"invalid port", "", 70000, "", true},
+		{"unknown interface", "", 0, "nosuchif0", true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sourceAddress, sourcePort, sourceInterface = c.address, c.port, c.iface
+			err := checkSourceFlags()
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestNewDialer(t *testing.T) {
+	resetSource(t)
+	d := newDialer(0)
+	assert.Nil(t, d.LocalAddr)
+	assert.Nil(t, d.Control)
+	assert.False(t, sourceSet())
+
+	sourceAddress = "127.0.0.1"
+	sourcePort = 40000
+	d = newDialer(0)
+	assert.Equal(t, "127.0.0.1:40000", d.LocalAddr.String())
+	assert.NotNil(t, d.Control, "a fixed source port needs SO_REUSEADDR")
+	assert.True(t, sourceSet())
+}
+
+func TestSourceListenAddr(t *testing.T) {
+	resetSource(t)
+	addr, err := sourceListenAddr(IPType4)
+	require.NoError(t, err)
+	assert.Equal(t, IPType4.ListenAddr, addr)
+
+	sourceAddress = "127.0.0.1"
+	addr, err = sourceListenAddr(IPType4)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addr)
+	_, err = sourceListenAddr(IPType6)
+	assert.Error(t, err, "IPv4 source for IPv6 target")
+
+	sourceAddress = ""
+	lo := loopbackInterface(t)
+	sourceInterface = lo
+	addr, err = sourceListenAddr(IPType4)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addr)
+}
+
+// loopbackInterface returns the name of the loopback interface
+func loopbackInterface(t *testing.T) string {
+	list, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, ifi := range list {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestSourceTCP(t *testing.T) {
+	resetSource(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	addr := l.Addr().String()
+
+	t.Run("source address and port", func(t *testing.T) {
+		sourceAddress = "127.0.0.1"
+		sourcePort = freePort(t)
+		tp := new(TCPing)
+		_ = tp.Run(addr)
+		assert.Equal(t, tcpCodeOpen, tp.Code, tp.Detail)
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", sourcePort), tp.Source)
+	})
+	t.Run("interface", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("SO_BINDTODEVICE is Linux only")
+		}
+		sourceAddress = ""
+		sourcePort = 0
+		sourceInterface = loopbackInterface(t)
+		tp := new(TCPing)
+		_ = tp.Run(addr)
+		if tp.Code == tcpCodeProhibited {
+			t.Skipf("binding to an interface not permitted: %s", tp.Msg)
+		}
+		assert.Equal(t, tcpCodeOpen, tp.Code, tp.Detail)
+		assert.True(t, strings.HasPrefix(tp.Source, "127.0.0.1:"))
+	})
+	t.Run("CMD TCP invalid source", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			addr,
+			"--source", "nosuchhost",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "invalid source address")
+		sourceAddress = ""
+	})
+}
+
+func TestSourceHTTP(t *testing.T) {
+	resetSource(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	sourceAddress = "127.0.0.1"
+	sourcePort = freePort(t)
+	h := new(HTTPing)
+	require.NoError(t, h.Run(srv.URL))
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", sourcePort), h.Source)
+}
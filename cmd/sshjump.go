@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDefaultTimeout limits the connection to the bastion host if the probe has no timeout
+const sshDefaultTimeout = 10 * time.Second
+
+var (
+	sshJump    string
+	sshKeyFile string
+	// sshUser and sshHost are the parsed --ssh-jump flag
+	sshUser string
+	sshHost string
+
+	sshMu     sync.Mutex
+	sshClient *ssh.Client
+)
+
+// sshDefaultKeys are the private keys tried without --ssh-key, relative to ~/.ssh
+var sshDefaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// checkSSHJumpFlag parses --ssh-jump user@host[:port], the user defaults to the local user and the port to 22
+func checkSSHJumpFlag() error {
+	closeJumpClient()
+	sshUser, sshHost = "", ""
+	if sshJump == "" {
+		return nil
+	}
+	host := sshJump
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		sshUser, host = host[:i], host[i+1:]
+	}
+	if sshUser == "" {
+		u, err := user.Current()
+		if err != nil {
+			return fmt.Errorf("no user in --ssh-jump %s: %w", sshJump, err)
+		}
+		sshUser = u.Username
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	if h, _, _ := net.SplitHostPort(host); h == "" {
+		return fmt.Errorf("invalid --ssh-jump %s, use user@host[:port]", sshJump)
+	}
+	sshHost = host
+	return nil
+}
+
+// sshJumpName returns the bastion as ssh://user@host:port
+func sshJumpName() string {
+	return "ssh://" + sshUser + "@" + sshHost
+}
+
+// relayHost returns the SSH bastion or proxy the probes connect through, empty for direct connections
+func relayHost() string {
+	if sshHost != "" {
+		return sshJumpName()
+	}
+	return proxyHost()
+}
+
+// sshDial opens a direct-tcpip channel from the bastion to address. The target name is resolved by the bastion.
+func sshDial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	client, err := jumpClient(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	log.Debugf("connect to %s via %s", address, sshJumpName())
+	conn, err := client.DialContext(ctx, "tcp", address)
+	if err == nil {
+		return conn, nil
+	}
+	var chErr *ssh.OpenChannelError
+	switch {
+	case errors.As(err, &chErr):
+		return nil, &ProxyTargetError{Proxy: sshJumpName(), Target: address, Reason: chErr.Message, Code: sshChannelCode(chErr)}
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, &ProxyTargetError{Proxy: sshJumpName(), Target: address, Reason: "connect timeout", Code: tcpCodeTimeout}
+	}
+	return nil, &ProxyError{Proxy: sshJumpName(), Err: err}
+}
+
+// sshChannelCode maps a rejected direct-tcpip channel to a TCP result code. OpenSSH only reports
+// the strerror text of the failed connect.
+func sshChannelCode(e *ssh.OpenChannelError) int {
+	if e.Reason == ssh.Prohibited {
+		return tcpCodeProhibited
+	}
+	msg := strings.ToLower(e.Message)
+	switch {
+	case strings.Contains(msg, "refused"):
+		return tcpCodeRefused
+	case strings.Contains(msg, "timed out") || strings.Contains(msg, "timeout"):
+		return tcpCodeTimeout
+	case strings.Contains(msg, "no route"):
+		return tcpCodeNoRoute
+	case strings.Contains(msg, "network is unreachable"):
+		return tcpCodeNetUnreach
+	case strings.Contains(msg, "unreachable"):
+		return tcpCodeHostUnreach
+	case strings.Contains(msg, "not known") || strings.Contains(msg, "resolve"):
+		return tcpCodeDNSError
+	}
+	return tcpCodeError
+}
+
+// jumpClient returns the SSH connection to the bastion, it is opened on first use and shared by all probes.
+// A closed connection is opened again, so a long running serve survives a restart of the bastion.
+func jumpClient(ctx context.Context, timeout time.Duration) (*ssh.Client, error) {
+	sshMu.Lock()
+	defer sshMu.Unlock()
+	if sshClient != nil {
+		return sshClient, nil
+	}
+	if timeout <= 0 {
+		timeout = sshDefaultTimeout
+	}
+	cfg, agentConn, err := sshClientConfig(timeout)
+	if err != nil {
+		return nil, &ProxyError{Proxy: sshJumpName(), Err: err}
+	}
+	// the agent signs during the handshake only
+	if agentConn != nil {
+		defer func() { _ = agentConn.Close() }()
+	}
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = proxyDial(ctx, sshHost, timeout)
+	} else {
+		conn, err = newDialer(timeout).DialContext(ctx, "tcp", sshHost)
+	}
+	if err != nil {
+		return nil, &ProxyError{Proxy: sshJumpName(), Err: err}
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, sshHost, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, &ProxyError{Proxy: sshJumpName(), Err: err}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	// the flags may be reset by the next command while the connection closes
+	name := sshJumpName()
+	log.Debugf("connected to %s", name)
+	sshClient = client
+	go func() {
+		_ = client.Wait()
+		sshMu.Lock()
+		if sshClient == client {
+			sshClient = nil
+		}
+		sshMu.Unlock()
+		log.Debugf("connection to %s closed", name)
+	}()
+	return client, nil
+}
+
+// closeJumpClient closes the connection to the bastion
+func closeJumpClient() {
+	sshMu.Lock()
+	c := sshClient
+	sshClient = nil
+	sshMu.Unlock()
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+// sshClientConfig authenticates with the SSH agent and the private key files and checks the bastion
+// host key against ~/.ssh/known_hosts. The connection to the agent is returned open for the handshake,
+// the caller closes it.
+func sshClientConfig(timeout time.Duration) (*ssh.ClientConfig, net.Conn, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("known_hosts: %w", err)
+	}
+	signers, agentConn, err := sshSigners(home)
+	if err == nil && len(signers) == 0 {
+		err = errors.New("no SSH agent and no private key found")
+	}
+	if err != nil {
+		if agentConn != nil {
+			_ = agentConn.Close()
+		}
+		return nil, nil, err
+	}
+	return &ssh.ClientConfig{
+		User:              sshUser,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: knownHostAlgorithms(hostKeys, sshHost),
+		Timeout:           timeout,
+	}, agentConn, nil
+}
+
+// sshSigners returns the keys of the SSH agent and of --ssh-key or the default key files.
+// Default keys protected by a passphrase are skipped, they can be used through the agent.
+// The agent keys sign through the returned agent connection.
+func sshSigners(home string) (signers []ssh.Signer, agentConn net.Conn, err error) {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c, err := net.Dial("unix", sock); err == nil {
+			if s, err := agent.NewClient(c).Signers(); err == nil && len(s) > 0 {
+				log.Debugf("SSH agent offers %d keys", len(s))
+				signers = append(signers, s...)
+				agentConn = c
+			} else {
+				_ = c.Close()
+			}
+		} else {
+			log.Debugf("SSH agent not available: %v", err)
+		}
+	}
+	if sshKeyFile != "" {
+		s, err := readSSHKey(sshKeyFile)
+		if err != nil {
+			return nil, agentConn, err
+		}
+		return append(signers, s), agentConn, nil
+	}
+	for _, name := range sshDefaultKeys {
+		s, err := readSSHKey(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			log.Debugf("SSH key %s skipped: %v", name, err)
+			continue
+		}
+		signers = append(signers, s)
+	}
+	return signers, agentConn, nil
+}
+
+// readSSHKey reads an unencrypted private key file
+func readSSHKey(file string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(file) //nolint:gosec // key file given by the user
+	if err != nil {
+		return nil, err
+	}
+	s, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("SSH key %s: %w", file, err)
+	}
+	return s, nil
+}
+
+// knownHostAlgorithms returns the host key algorithms of the known keys of host, so the server offers
+// a key known_hosts can verify. Without known keys the defaults are used and the check fails later.
+func knownHostAlgorithms(hostKeys ssh.HostKeyCallback, host string) []string {
+	var keyErr *knownhosts.KeyError
+	err := hostKeys(host, &net.TCPAddr{IP: net.IPv4zero}, unknownHostKey{})
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, k := range keyErr.Want {
+		switch t := k.Key.Type(); t {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, t)
+		default:
+			algos = append(algos, t)
+		}
+	}
+	return algos
+}
+
+// unknownHostKey is a public key matching no known host key, checking it returns the known keys of a host
+type unknownHostKey struct{}
+
+func (unknownHostKey) Type() string                        { return "probe" }
+func (unknownHostKey) Marshal() []byte                     { return []byte("probe") }
+func (unknownHostKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key") }
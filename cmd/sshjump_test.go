@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func resetSSHJump(t *testing.T) {
+	t.Cleanup(func() {
+		sshJump = ""
+		sshKeyFile = ""
+		_ = checkSSHJumpFlag()
+	})
+}
+
+// sshBastion runs an SSH server on localhost accepting the returned client key and forwarding
+// direct-tcpip channels. HOME is set to a directory with the known_hosts entry of the server.
+func sshBastion(t *testing.T) (addr string, keyFile string) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	require.NoError(t, err)
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authorized, err := ssh.NewPublicKey(clientPub)
+	require.NoError(t, err)
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(m ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if m.User() == "ops" && string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", m.User())
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(c, cfg)
+		}
+	}()
+	addr = l.Addr().String()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".ssh"), 0700))
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey.PublicKey())
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line+"\n"), 0600))
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	require.NoError(t, err)
+	keyFile = filepath.Join(home, "ops.key")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+	return addr, keyFile
+}
+
+// serveSSH forwards the direct-tcpip channels of a client connection
+func serveSSH(c net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			_ = nc.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+			_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		tc, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			_ = nc.Reject(ssh.ConnectionFailed, "Connection refused")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			_ = tc.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			defer func() { _ = ch.Close() }()
+			relay(ch, tc)
+		}()
+	}
+}
+
+func TestCheckSSHJumpFlag(t *testing.T) {
+	resetSSHJump(t)
+	for _, c := range []struct {
+		jump string
+		name string
+		err  bool
+	}{
+		{"ops@bastion", "ssh://ops@bastion:22", false},
+		{"ops@bastion.example.com:2222", "ssh://ops@bastion.example.com:2222", false},
+		{"ops@[2001:db8::1]", "ssh://ops@[2001:db8::1]:22", false},
+		{"ops@", "", true},
+	} {
+		sshJump = c.jump
+		err := checkSSHJumpFlag()
+		if c.err {
+			assert.Error(t, err, c.jump)
+			continue
+		}
+		require.NoError(t, err, c.jump)
+		assert.Equal(t, c.name, relayHost())
+	}
+	sshJump = "bastion"
+	require.NoError(t, checkSSHJumpFlag())
+	assert.NotEmpty(t, sshUser, "local user is the default")
+}
+
+func TestSSHChannelCode(t *testing.T) {
+	for msg, code := range map[string]int{
+		"Connection refused":           tcpCodeRefused,
+		"Connection timed out":         tcpCodeTimeout,
+		"No route to host":             tcpCodeNoRoute,
+		"Network is unreachable":       tcpCodeNetUnreach,
+		"Host is unreachable":          tcpCodeHostUnreach,
+		"Name or service not known":    tcpCodeDNSError,
+		"open failed":                  tcpCodeError,
+		"administratively prohibited:": tcpCodeError,
+	} {
+		assert.Equal(t, code, sshChannelCode(&ssh.OpenChannelError{Reason: ssh.ConnectionFailed, Message: msg}), msg)
+	}
+	assert.Equal(t, tcpCodeProhibited, sshChannelCode(&ssh.OpenChannelError{Reason: ssh.Prohibited}))
+}
+
+func TestSSHDial(t *testing.T) {
+	resetSSHJump(t)
+	bastion, key := sshBastion(t)
+	target := echoListener(t)
+	closed := freePort(t)
+
+	t.Run("tunnel", func(t *testing.T) {
+		sshJump, sshKeyFile = "ops@"+bastion, key
+		require.NoError(t, checkSSHJumpFlag())
+		conn, err := dialTCP(context.Background(), target, 2*time.Second)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("ping\n"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping\n", string(buf))
+		_ = conn.Close()
+	})
+	t.Run("tcp source", func(t *testing.T) {
+		p := new(TCPing)
+		p.Run(target)
+		assert.Equal(t, tcpCodeOpen, p.Code, p.Msg)
+		assert.Equal(t, "ssh://ops@"+bastion, p.Proxy)
+		assert.Empty(t, p.Source, "the local address of an SSH channel is a placeholder")
+	})
+	t.Run("target refused", func(t *testing.T) {
+		a := fmt.Sprintf("127.0.0.1:%d", closed)
+		_, err := dialTCP(context.Background(), a, 2*time.Second)
+		require.Error(t, err)
+		assert.Equal(t, tcpCodeRefused, classifyDialError(err, a))
+		assert.ErrorContains(t, err, "target "+a)
+	})
+	t.Run("wrong user", func(t *testing.T) {
+		sshJump = "root@" + bastion
+		require.NoError(t, checkSSHJumpFlag())
+		_, err := dialTCP(context.Background(), target, 2*time.Second)
+		require.Error(t, err)
+		assert.Equal(t, tcpCodeProxyError, classifyDialError(err, target))
+		assert.ErrorContains(t, err, "unable to authenticate")
+	})
+	t.Run("unknown host key", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), nil, 0600))
+		sshJump = "ops@" + bastion
+		require.NoError(t, checkSSHJumpFlag())
+		_, err := dialTCP(context.Background(), target, 2*time.Second)
+		require.Error(t, err)
+		assert.Equal(t, tcpCodeProxyError, classifyDialError(err, target))
+		assert.ErrorContains(t, err, "key is unknown")
+	})
+}
+
+func TestSSHAgent(t *testing.T) {
+	resetSSHJump(t)
+	closeJumpClient()
+	t.Cleanup(closeJumpClient)
+	bastion, key := sshBastion(t)
+	pemKey, err := os.ReadFile(key) //nolint:gosec // test key
+	require.NoError(t, err)
+	priv, err := ssh.ParseRawPrivateKey(pemKey)
+	require.NoError(t, err)
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: priv}))
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	served := make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_ = agent.ServeAgent(keyring, c)
+		close(served)
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	sshJump = "ops@" + bastion
+	require.NoError(t, checkSSHJumpFlag())
+	_, err = jumpClient(context.Background(), 2*time.Second)
+	require.NoError(t, err, "authenticated with the agent key")
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent connection is still open after the handshake")
+	}
+}
+
+func TestSSHJumpTCP(t *testing.T) {
+	resetSSHJump(t)
+	resetTargets(t)
+	bastion, key := sshBastion(t)
+	target := echoListener(t)
+	args := []string{
+		"tcp",
+		target,
+		"--ssh-jump", "ops@" + bastion,
+		"--ssh-key", key,
+		"-o", "json",
+		flagUnitTest,
+		flagDebug,
+	}
+	out, err := common.CmdRun(RootCmd, args)
+	assert.NoError(t, err)
+	t.Log(out)
+	assert.Contains(t, out, "record tcp "+target+" OPEN")
+	assert.Contains(t, out, "via ssh://ops@"+bastion)
+}
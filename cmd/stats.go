@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PingStats collects the latency samples of repeated probes to one address
+type PingStats struct {
+	Address    string
+	Sent       int
+	OK         int
+	Failed     int
+	Duplicates int
+	OutOfOrder int
+	RTTs       []time.Duration
+}
+
+// NewPingStats returns an empty statistics record for the given address
+func NewPingStats(address string) *PingStats {
+	return &PingStats{Address: address}
+}
+
+// Add records the outcome of a single probe
+func (s *PingStats) Add(rtt time.Duration, ok bool) {
+	s.Sent++
+	if !ok {
+		s.Failed++
+		return
+	}
+	s.OK++
+	s.RTTs = append(s.RTTs, rtt)
+}
+
+// Loss returns the percentage of failed probes
+func (s *PingStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Failed) * 100 / float64(s.Sent)
+}
+
+// Min returns the smallest recorded latency
+func (s *PingStats) Min() time.Duration {
+	var m time.Duration
+	for i, d := range s.RTTs {
+		if i == 0 || d < m {
+			m = d
+		}
+	}
+	return m
+}
+
+// Max returns the largest recorded latency
+func (s *PingStats) Max() time.Duration {
+	var m time.Duration
+	for _, d := range s.RTTs {
+		if d > m {
+			m = d
+		}
+	}
+	return m
+}
+
+// Avg returns the arithmetic mean of the recorded latencies
+func (s *PingStats) Avg() time.Duration {
+	if len(s.RTTs) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range s.RTTs {
+		sum += d
+	}
+	return sum / time.Duration(len(s.RTTs))
+}
+
+// StdDev returns the population standard deviation of the recorded latencies
+func (s *PingStats) StdDev() time.Duration {
+	if len(s.RTTs) == 0 {
+		return 0
+	}
+	avg := float64(s.Avg())
+	var sum float64
+	for _, d := range s.RTTs {
+		diff := float64(d) - avg
+		sum += diff * diff
+	}
+	return time.Duration(math.Sqrt(sum / float64(len(s.RTTs))))
+}
+
+// Jitter returns the mean absolute difference between consecutive latencies
+func (s *PingStats) Jitter() time.Duration {
+	if len(s.RTTs) < 2 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 1; i < len(s.RTTs); i++ {
+		d := s.RTTs[i] - s.RTTs[i-1]
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / time.Duration(len(s.RTTs)-1)
+}
+
+// Percentile returns the nearest-rank percentile p (0-100) of the recorded latencies
+func (s *PingStats) Percentile(p float64) time.Duration {
+	if len(s.RTTs) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(s.RTTs))
+	copy(sorted, s.RTTs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// mergeStats combines several statistics records into a new one labeled with address
+func mergeStats(address string, list []*PingStats) *PingStats {
+	m := NewPingStats(address)
+	for _, s := range list {
+		m.Sent += s.Sent
+		m.OK += s.OK
+		m.Failed += s.Failed
+		m.Duplicates += s.Duplicates
+		m.OutOfOrder += s.OutOfOrder
+		m.RTTs = append(m.RTTs, s.RTTs...)
+	}
+	return m
+}
+
+// familyStats groups statistics by IP family and returns the merged IPv4 and IPv6 records.
+// A family without any address is returned as nil.
+func familyStats(list []*PingStats) (v4, v6 *PingStats) {
+	var l4, l6 []*PingStats
+	for _, s := range list {
+		host, _, err := net.SplitHostPort(s.Address)
+		if err != nil {
+			host = s.Address
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil:
+			l4 = append(l4, s)
+		default:
+			l6 = append(l6, s)
+		}
+	}
+	if len(l4) > 0 {
+		v4 = mergeStats("IPv4", l4)
+	}
+	if len(l6) > 0 {
+		v6 = mergeStats("IPv6", l6)
+	}
+	return
+}
+
+// StatsSummary is the serializable summary of a statistics record, latencies are in milliseconds
+type StatsSummary struct {
+	Address    string  `json:"address" yaml:"address"`
+	Sent       int     `json:"sent" yaml:"sent"`
+	OK         int     `json:"ok" yaml:"ok"`
+	Failed     int     `json:"failed" yaml:"failed"`
+	Loss       float64 `json:"loss_pct" yaml:"loss_pct"`
+	Duplicates int     `json:"duplicates" yaml:"duplicates"`
+	OutOfOrder int     `json:"out_of_order" yaml:"out_of_order"`
+	Min        float64 `json:"min_ms" yaml:"min_ms"`
+	Avg        float64 `json:"avg_ms" yaml:"avg_ms"`
+	Max        float64 `json:"max_ms" yaml:"max_ms"`
+	StdDev     float64 `json:"stddev_ms" yaml:"stddev_ms"`
+	P50        float64 `json:"p50_ms" yaml:"p50_ms"`
+	P95        float64 `json:"p95_ms" yaml:"p95_ms"`
+	P99        float64 `json:"p99_ms" yaml:"p99_ms"`
+	Jitter     float64 `json:"jitter_ms" yaml:"jitter_ms"`
+}
+
+// Summary returns the computed values of the statistics record
+func (s *PingStats) Summary() StatsSummary {
+	return StatsSummary{
+		Address:    s.Address,
+		Sent:       s.Sent,
+		OK:         s.OK,
+		Failed:     s.Failed,
+		Loss:       s.Loss(),
+		Duplicates: s.Duplicates,
+		OutOfOrder: s.OutOfOrder,
+		Min:        durationMS(s.Min()),
+		Avg:        durationMS(s.Avg()),
+		Max:        durationMS(s.Max()),
+		StdDev:     durationMS(s.StdDev()),
+		P50:        durationMS(s.Percentile(50)),
+		P95:        durationMS(s.Percentile(95)),
+		P99:        durationMS(s.Percentile(99)),
+		Jitter:     durationMS(s.Jitter()),
+	}
+}
+
+// Record returns the summary as serializable result of the command proto
+func (s *PingStats) Record(proto string) Result {
+	return newResult(strings.ToLower(proto), s.Address, "STATS", nil, s.Summary())
+}
+
+// ms formats a duration as milliseconds with two decimals
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.2f", float64(d.Microseconds())/1000)
+}
+
+// Log prints the summary of the statistics record
+func (s *PingStats) Log(proto string) {
+	log.Debugf("statistics for %s: sent %d ok %d failed %d", s.Address, s.Sent, s.OK, s.Failed)
+	lossFn := green
+	switch {
+	case s.OK == 0:
+		lossFn = red
+	case s.Failed > 0:
+		lossFn = yellow
+	}
+	fmt.Printf("%s%s%s\n", cyan("%-7s", proto), cyan("%-10s", "STATS"), s.Address)
+	fmt.Printf("       sent %d  ok %d  failed %d  %s\n", s.Sent, s.OK, s.Failed, lossFn("loss %.1f%%", s.Loss()))
+	if s.Duplicates > 0 || s.OutOfOrder > 0 {
+		fmt.Printf("       %s\n", yellow("duplicates %d  out of order %d", s.Duplicates, s.OutOfOrder))
+	}
+	if s.OK == 0 {
+		return
+	}
+	// ping calls the standard deviation mdev
+	dev := "stddev"
+	if proto == "ICMP" {
+		dev = "mdev  "
+	}
+	fmt.Printf("       min/avg/max/%s = %s/%s/%s/%s ms\n", dev, ms(s.Min()), ms(s.Avg()), ms(s.Max()), ms(s.StdDev()))
+	fmt.Printf("       p50/p95/p99        = %s/%s/%s ms\n", ms(s.Percentile(50)), ms(s.Percentile(95)), ms(s.Percentile(99)))
+	fmt.Printf("       jitter             = %s ms\n", ms(s.Jitter()))
+}
+
+// logStatsSummary prints all per-address statistics and, if both IP families
+// were probed, an additional summary per family
+func logStatsSummary(proto string, list []*PingStats) {
+	if textOutput() {
+		fmt.Println()
+	}
+	v4, v6 := familyStats(list)
+	if v4 != nil && v6 != nil {
+		list = append(list[:len(list):len(list)], v4, v6)
+	}
+	for _, s := range list {
+		emit(s.Record(proto), func() { s.Log(proto) })
+	}
+}
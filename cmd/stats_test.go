@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingStats(t *testing.T) {
+	s := NewPingStats("127.0.0.1:80")
+	for _, d := range []int{10, 20, 30, 40} {
+		s.Add(time.Duration(d)*time.Millisecond, true)
+	}
+	s.Add(0, false)
+
+	assert.Equal(t, 5, s.Sent)
+	assert.Equal(t, 4, s.OK)
+	assert.Equal(t, 1, s.Failed)
+	assert.InDelta(t, 20.0, s.Loss(), 0.001)
+	assert.Equal(t, 10*time.Millisecond, s.Min())
+	assert.Equal(t, 40*time.Millisecond, s.Max())
+	assert.Equal(t, 25*time.Millisecond, s.Avg())
+	assert.Equal(t, 11180339*time.Nanosecond, s.StdDev().Truncate(time.Nanosecond))
+	assert.Equal(t, 20*time.Millisecond, s.Percentile(50))
+	assert.Equal(t, 40*time.Millisecond, s.Percentile(95))
+	assert.Equal(t, 10*time.Millisecond, s.Percentile(0))
+	s.Log("TCP")
+}
+
+func TestPingStatsEmpty(t *testing.T) {
+	s := NewPingStats("127.0.0.1:80")
+	assert.Zero(t, s.Loss())
+	assert.Zero(t, s.Avg())
+	assert.Zero(t, s.StdDev())
+	assert.Zero(t, s.Percentile(99))
+	s.Add(0, false)
+	assert.InDelta(t, 100.0, s.Loss(), 0.001)
+	s.Log("TCP")
+}
+
+func TestFamilyStats(t *testing.T) {
+	a := NewPingStats("127.0.0.1:80")
+	a.Add(time.Millisecond, true)
+	b := NewPingStats("[::1]:80")
+	b.Add(2*time.Millisecond, true)
+	c := NewPingStats("10.0.0.1:80")
+	c.Add(0, false)
+
+	v4, v6 := familyStats([]*PingStats{a, b, c})
+	assert.NotNil(t, v4)
+	assert.NotNil(t, v6)
+	assert.Equal(t, 2, v4.Sent)
+	assert.Equal(t, 1, v4.Failed)
+	assert.Equal(t, 1, v6.Sent)
+
+	v4, v6 = familyStats([]*PingStats{a})
+	assert.NotNil(t, v4)
+	assert.Nil(t, v6)
+	logStatsSummary("TCP", []*PingStats{a, b})
+}
+
+func TestPingStatsJitter(t *testing.T) {
+	s := NewPingStats("127.0.0.1")
+	assert.Zero(t, s.Jitter())
+	s.RTTs = []time.Duration{10 * time.Millisecond, 14 * time.Millisecond, 12 * time.Millisecond}
+	assert.Equal(t, 3*time.Millisecond, s.Jitter())
+	s.OK = 3
+	s.Sent = 4
+	s.Failed = 1
+	s.Duplicates = 1
+	s.Log("ICMP")
+}
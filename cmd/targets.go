@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tommi2day/gomodules/common"
+)
+
+var (
+	targetsFile  string
+	parallelJobs = 1
+	// targetsStdin is read for the target "-", replaced in tests
+	targetsStdin io.Reader = os.Stdin
+)
+
+// targetJob collects the output of one target, so parallel jobs can be printed in target order
+type targetJob struct {
+	target string
+	index  int
+	items  []targetItem
+	err    error
+}
+
+type targetItem struct {
+	r    Result
+	text func()
+}
+
+// emit keeps a record and its text renderer until the job is printed
+func (j *targetJob) emit(r Result, text func()) {
+	j.items = append(j.items, targetItem{r: r, text: text})
+}
+
+// addTargetFlags adds the multi-target flags to a command
+func addTargetFlags(c *cobra.Command) {
+	c.Flags().StringVar(&targetsFile, "targets-file", "", "file with one target per line, - reads stdin")
+	c.Flags().IntVarP(&parallelJobs, "parallel", "P", parallelJobs, "number of targets probed concurrently")
+}
+
+// collectTargets returns the sorted unique targets of the address flag, the arguments and the
+// targets file. The argument or file name "-" reads the targets from stdin.
+func collectTargets(args []string) ([]string, error) {
+	if parallelJobs < 1 {
+		return nil, fmt.Errorf("invalid parallel value %d, must be at least 1", parallelJobs)
+	}
+	var list []string
+	if queryAddress != "" {
+		list = append(list, queryAddress)
+	}
+	stdinRead := false
+	readStdin := func() error {
+		if stdinRead {
+			return nil
+		}
+		stdinRead = true
+		l, err := readTargets(targetsStdin)
+		list = append(list, l...)
+		return err
+	}
+	for _, a := range args {
+		if a == "-" {
+			if err := readStdin(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		list = append(list, a)
+	}
+	switch targetsFile {
+	case "":
+	case "-":
+		if err := readStdin(); err != nil {
+			return nil, err
+		}
+	default:
+		f, err := os.Open(targetsFile)
+		if err != nil {
+			return nil, err
+		}
+		l, err := readTargets(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read targets file %s: %w", targetsFile, err)
+		}
+		list = append(list, l...)
+	}
+	list = uniqueTargets(list)
+	log.Debugf("collected %d targets", len(list))
+	return list, nil
+}
+
+// readTargets reads one target per line, empty lines and # comments are skipped
+func readTargets(r io.Reader) ([]string, error) {
+	var list []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if f := strings.Fields(line); len(f) > 0 {
+			list = append(list, f[0])
+		}
+	}
+	return list, s.Err()
+}
+
+// uniqueTargets sorts the targets and removes duplicates
+func uniqueTargets(list []string) []string {
+	sort.SliceStable(list, func(a, b int) bool { return targetLess(list[a], list[b]) })
+	out := list[:0]
+	for i, t := range list {
+		if i == 0 || t != list[i-1] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// targetLess orders IP targets numerically by address and port and all others by name
+func targetLess(a, b string) bool {
+	ha, pa, _ := splitProbeTarget(a, 0)
+	hb, pb, _ := splitProbeTarget(b, 0)
+	ia, ib := net.ParseIP(ha), net.ParseIP(hb)
+	switch {
+	case ia != nil && ib != nil:
+		if c := bytes.Compare(ia.To16(), ib.To16()); c != 0 {
+			return c < 0
+		}
+		return pa < pb
+	case ia != nil:
+		return true
+	case ib != nil:
+		return false
+	}
+	return a < b
+}
+
+// uniqueAddresses joins the resolved addresses of all targets in target order without duplicates
+func uniqueAddresses(resolved [][]string) []string {
+	var list []string
+	seen := map[string]bool{}
+	for _, addrs := range resolved {
+		for _, a := range addrs {
+			if !seen[a] {
+				seen[a] = true
+				list = append(list, a)
+			}
+		}
+	}
+	return list
+}
+
+// resolveTarget returns the addresses of a host:port target, defaultPort is used if the target has none
+func resolveTarget(target string, defaultPort int) (hosts []string, port string, err error) {
+	host, p, err := splitProbeTarget(target, defaultPort)
+	if err != nil {
+		return nil, "", err
+	}
+	hosts, err = lookupTargetHost(host)
+	return hosts, strconv.Itoa(p), err
+}
+
+// lookupTargetHost returns the IP addresses of a host, the name itself if the SSH bastion or the proxy resolves it
+func lookupTargetHost(host string) ([]string, error) {
+	if sshHost != "" || proxyResolves() {
+		return []string{host}, nil
+	}
+	ips, err := lookupProbeHost(host)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(ips))
+	for i, ip := range ips {
+		hosts[i] = ip.String()
+	}
+	return hosts, nil
+}
+
+// targetHost returns the host of a target that may contain a port or be a URL
+func targetHost(target string) string {
+	if net.ParseIP(target) != nil {
+		return target
+	}
+	if h, _, err := common.GetHostPort(target); err == nil {
+		return h
+	}
+	return target
+}
+
+// runTargets runs fn for every target with at most parallelJobs concurrent workers. The collected
+// output of a target is emitted in target order as soon as all preceding targets are done.
+// A failed single target returns its error like before, with several targets an ERROR record
+// of command is emitted and the others continue.
+func runTargets(command string, targets []string, fn func(j *targetJob)) error {
+	jobs := make([]*targetJob, len(targets))
+	for i, t := range targets {
+		jobs[i] = &targetJob{target: t, index: i}
+	}
+	done := make([]chan struct{}, len(jobs))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	// start the jobs in target order, so the output can be printed early
+	go runParallel(len(jobs), func(i int) {
+		fn(jobs[i])
+		close(done[i])
+	})
+	for i, j := range jobs {
+		<-done[i]
+		for _, it := range j.items {
+			emit(it.r, it.text)
+		}
+		if j.err != nil && len(jobs) > 1 {
+			log.Debugf("target %s failed: %v", j.target, j.err)
+			emitTargetError(command, j.target, j.err)
+		}
+	}
+	if len(jobs) == 1 {
+		return jobs[0].err
+	}
+	return nil
+}
+
+// runParallel calls fn for 0..n-1 with at most parallelJobs concurrent calls and waits for all
+func runParallel(n int, fn func(i int)) {
+	sem := make(chan struct{}, parallelJobs)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// emitTargetError reports a target that could not be probed at all
+func emitTargetError(command, target string, err error) {
+	emit(newResult(command, target, "ERROR", err, nil), func() {
+		fmt.Printf("%s%s%-30s    %s\n", cyan("%-7s", strings.ToUpper(command)), red("%-10s", "ERROR"), target, err)
+	})
+}
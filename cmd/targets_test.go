@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func resetTargets(t *testing.T) {
+	t.Cleanup(func() {
+		queryAddress = ""
+		queryPort = ""
+		targetsFile = ""
+		parallelJobs = 1
+		targetsStdin = os.Stdin
+		outputFormat = outputText
+		results = nil
+	})
+	queryAddress = ""
+	queryPort = ""
+}
+
+func TestUniqueTargets(t *testing.T) {
+	list := []string{"web.example.com:443", "10.0.0.10:22", "10.0.0.2:22", "10.0.0.2:22", "::1", "db.example.com:5432", "10.0.0.2:8"}
+	assert.Equal(t, []string{"10.0.0.2:8", "10.0.0.2:22", "10.0.0.10:22", "::1", "db.example.com:5432", "web.example.com:443"}, uniqueTargets(list))
+	assert.Empty(t, uniqueTargets(nil))
+}
+
+func TestReadTargets(t *testing.T) {
+	in := "# targets\n10.0.0.1:22\n\n  host.example.com:443   web\n10.0.0.2:80 # comment\n"
+	list, err := readTargets(strings.NewReader(in))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:22", "host.example.com:443", "10.0.0.2:80"}, list)
+}
+
+func TestCollectTargets(t *testing.T) {
+	resetTargets(t)
+	file := filepath.Join(t.TempDir(), "targets.txt")
+	require.NoError(t, os.WriteFile(file, []byte("10.0.0.3:22\n10.0.0.1:22\n"), 0600))
+
+	t.Run("args and file", func(t *testing.T) {
+		queryAddress = "10.0.0.2:22"
+		targetsFile = file
+		list, err := collectTargets([]string{"10.0.0.1:22", "host:80"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1:22", "10.0.0.2:22", "10.0.0.3:22", "host:80"}, list)
+	})
+	t.Run("stdin", func(t *testing.T) {
+		queryAddress = ""
+		targetsFile = "-"
+		targetsStdin = strings.NewReader("10.0.0.5:22\n10.0.0.4:22\n")
+		list, err := collectTargets([]string{"-"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.4:22", "10.0.0.5:22"}, list)
+	})
+	t.Run("missing file", func(t *testing.T) {
+		targetsFile = filepath.Join(t.TempDir(), "missing.txt")
+		_, err := collectTargets(nil)
+		assert.Error(t, err)
+	})
+	t.Run("invalid parallel", func(t *testing.T) {
+		targetsFile = ""
+		parallelJobs = 0
+		_, err := collectTargets([]string{"10.0.0.1:22"})
+		assert.Error(t, err)
+		parallelJobs = 1
+	})
+}
+
+func TestRunTargets(t *testing.T) {
+	resetTargets(t)
+	outputFormat = outputJSON
+	parallelJobs = 3
+	targets := []string{"a", "b", "c", "d", "e"}
+
+	t.Run("ordered output", func(t *testing.T) {
+		results = nil
+		var running, peak int32
+		err := runTargets("tcp", targets, func(j *targetJob) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			// later targets finish first
+			time.Sleep(time.Duration(len(targets)-j.index) * 10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			if j.target == "c" {
+				j.err = errors.New("lookup failed")
+				return
+			}
+			j.emit(newResult("tcp", j.target, "OPEN", nil, nil), nil)
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 5)
+		var order []string
+		for _, r := range results {
+			order = append(order, r.Target+"="+r.Status)
+		}
+		assert.Equal(t, []string{"a=OPEN", "b=OPEN", "c=ERROR", "d=OPEN", "e=OPEN"}, order)
+		assert.LessOrEqual(t, peak, int32(3), "no more than --parallel jobs")
+		assert.Greater(t, peak, int32(1), "jobs should run concurrently")
+	})
+	t.Run("single target error", func(t *testing.T) {
+		results = nil
+		err := runTargets("tcp", targets[:1], func(j *targetJob) {
+			j.err = errors.New("lookup failed")
+		})
+		assert.Error(t, err)
+		assert.Empty(t, results)
+	})
+}
+
+func TestTCPMultiTarget(t *testing.T) {
+	resetTargets(t)
+	var ports []int
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer func() { _ = l.Close() }()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	file := filepath.Join(t.TempDir(), "targets.txt")
+	require.NoError(t, os.WriteFile(file, []byte(fmt.Sprintf("127.0.0.1:%d\n", ports[2])), 0600))
+
+	t.Run("CMD TCP parallel", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[1]),
+			fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			"--targets-file", file,
+			"--parallel", "4",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		t.Log(out)
+		sorted := append([]int(nil), ports...)
+		sort.Ints(sorted)
+		var last int
+		for _, p := range sorted {
+			line := fmt.Sprintf("record tcp 127.0.0.1:%d OPEN", p)
+			i := strings.Index(out, line)
+			if assert.GreaterOrEqual(t, i, 0, "missing %s", line) {
+				assert.Greater(t, i, last, "records should be sorted by target")
+				last = i
+			}
+		}
+	})
+	t.Run("CMD TCP invalid parallel", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			"--parallel", "0",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.Error(t, err)
+		parallelJobs = 1
+	})
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// TCP probe result codes, stable for scripting
+const (
+	tcpCodeOpen = iota
+	tcpCodeRefused
+	tcpCodeTimeout
+	tcpCodeHostUnreach
+	tcpCodeNetUnreach
+	tcpCodeNoRoute
+	tcpCodeProhibited
+	tcpCodeAddrNotAvail
+	tcpCodeDNSError
+	tcpCodeError
+	tcpCodeProxyError
+	tcpCodeExpectFailed
+)
+
+// tcpStates are the record status and the message of each result code
+var tcpStates = []struct {
+	status string
+	msg    string
+}{
+	tcpCodeOpen:         {"OPEN", "OPEN"},
+	tcpCodeRefused:      {"REFUSED", "REFUSED/CLOSED"},
+	tcpCodeTimeout:      {"TIMEOUT", "TIMEOUT/BLOCKED"},
+	tcpCodeHostUnreach:  {"HOST-UNREACH", "HOST UNREACHABLE"},
+	tcpCodeNetUnreach:   {"NET-UNREACH", "NETWORK UNREACHABLE"},
+	tcpCodeNoRoute:      {"NO-ROUTE", "NO ROUTE"},
+	tcpCodeProhibited:   {"PROHIBITED", "ADMIN PROHIBITED"},
+	tcpCodeAddrNotAvail: {"ADDR-NOTAVAIL", "ADDRESS NOT AVAILABLE"},
+	tcpCodeDNSError:     {"DNS-ERROR", "DNS FAILURE"},
+	tcpCodeError:        {"ERROR", "ERROR"},
+	tcpCodeProxyError:   {"PROXY-ERROR", "PROXY FAILURE"},
+	tcpCodeExpectFailed: {"EXPECT-FAILED", "EXPECT FAILED"},
+}
+
+// classifyDialError maps a dial error to a result code by its type and errno.
+// Unreachable errors are reported as no route if the local routing table has no route to address.
+// Errors of a proxy connection use the code the proxy reported for the target or the proxy error code.
+func classifyDialError(err error, address string) int {
+	var targetErr *ProxyTargetError
+	if errors.As(err, &targetErr) {
+		return targetErr.Code
+	}
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		return tcpCodeProxyError
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return tcpCodeDNSError
+	}
+	var netErr net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return tcpCodeTimeout
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return tcpCodeError
+	}
+	code, ok := dialErrnos[errno]
+	if !ok {
+		return tcpCodeError
+	}
+	if (code == tcpCodeHostUnreach || code == tcpCodeNetUnreach) && !hasRoute(address) {
+		return tcpCodeNoRoute
+	}
+	return code
+}
+
+// hasRoute reports whether the system has a route to address from the source address, interface
+// or VRF of the probes. Connecting a UDP socket only looks up the route and does not send a packet.
+func hasRoute(address string) bool {
+	d := &net.Dialer{Control: func(_, _ string, c syscall.RawConn) error {
+		return controlDevice(c, bindDevice())
+	}}
+	if sourceAddress != "" {
+		d.LocalAddr = &net.UDPAddr{IP: net.ParseIP(sourceAddress)}
+	}
+	c, err := d.Dial("udp", address)
+	if err != nil {
+		return false
+	}
+	_ = c.Close()
+	return true
+}
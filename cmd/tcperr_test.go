@@ -0,0 +1,108 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	const local = "127.0.0.1:1"
+	for _, c := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"refused", dialError(syscall.ECONNREFUSED), tcpCodeRefused},
+		{"timeout errno", dialError(syscall.ETIMEDOUT), tcpCodeTimeout},
+		{"deadline", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, tcpCodeTimeout},
+		{"host unreachable", dialError(syscall.EHOSTUNREACH), tcpCodeHostUnreach},
+		{"host down", dialError(syscall.EHOSTDOWN), tcpCodeHostUnreach},
+		{"network unreachable", dialError(syscall.ENETUNREACH), tcpCodeNetUnreach},
+		{"prohibited", dialError(syscall.EACCES), tcpCodeProhibited},
+		{"not permitted", dialError(syscall.EPERM), tcpCodeProhibited},
+		{"address not available", dialError(syscall.EADDRNOTAVAIL), tcpCodeAddrNotAvail},
+		{"dns", &net.DNSError{Err: "no such host", Name: "nosuchhost.invalid", IsNotFound: true}, tcpCodeDNSError},
+		{"other errno", dialError(syscall.EINVAL), tcpCodeError},
+		{"other", errors.New("something else"), tcpCodeError},
+		{"proxy", &ProxyError{Proxy: "socks5://127.0.0.1:1080", Err: dialError(syscall.ECONNREFUSED)}, tcpCodeProxyError},
+		{"proxy target", &ProxyTargetError{Proxy: "socks5://127.0.0.1:1080", Target: local, Code: tcpCodeRefused}, tcpCodeRefused},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.code, classifyDialError(c.err, local))
+		})
+	}
+	assert.True(t, hasRoute(local), "loopback should be routable")
+	assert.False(t, hasRoute("invalid"), "invalid address has no route")
+}
+
+func TestHasRouteSource(t *testing.T) {
+	resetSource(t)
+	sourceAddress = "127.0.0.1"
+	assert.True(t, hasRoute("127.0.0.1:1"), "route from the source address")
+	sourceAddress = "::1"
+	assert.False(t, hasRoute("127.0.0.1:1"), "no IPv4 route from an IPv6 source")
+	sourceAddress = ""
+	sourceInterface = "nosuchdev0"
+	assert.False(t, hasRoute("127.0.0.1:1"), "no route through a missing interface")
+}
+
+func TestTCPingResult(t *testing.T) {
+	tp := &TCPing{Address: "10.0.0.1:22"}
+	tp.setResult(tcpCodeNoRoute, dialError(syscall.EHOSTUNREACH))
+	r := tp.Record()
+	assert.Equal(t, "NO-ROUTE", r.Status)
+	assert.Equal(t, "10.0.0.1:22", r.Target)
+	assert.Equal(t, "NO ROUTE", r.Error)
+	assert.Empty(t, tp.Detail, "classified errors need no detail")
+
+	tp.setResult(tcpCodeError, errors.New("something else"))
+	r = tp.Record()
+	assert.Equal(t, tcpCodeError, tp.Code)
+	assert.Equal(t, "ERROR: something else", r.Error)
+
+	assert.Len(t, tcpStates, tcpCodeExpectFailed+1, "every code needs a state")
+	for code, s := range tcpStates {
+		assert.NotEmpty(t, s.status, "status of code %d", code)
+	}
+	assert.Equal(t, "PROXY-ERROR", tcpStates[tcpCodeProxyError].status)
+	assert.Equal(t, "EXPECT-FAILED", tcpStates[tcpCodeExpectFailed].status)
+}
+
+func TestTCPDNSFailure(t *testing.T) {
+	resetTargets(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = l.Close() }()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	t.Run("CMD TCP unresolvable", func(t *testing.T) {
+		args := []string{
+			"tcp",
+			"nosuchhost.invalid:80",
+			fmt.Sprintf("127.0.0.1:%d", port),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, fmt.Sprintf("record tcp 127.0.0.1:%d OPEN", port))
+		assert.Contains(t, out, "record tcp nosuchhost.invalid:80 DNS-ERROR")
+	})
+}
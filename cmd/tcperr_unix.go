@@ -0,0 +1,20 @@
+//go:build !windows
+
+package cmd
+
+import "syscall"
+
+// dialErrnos maps the errnos of a failed connect to result codes. Linux reports an ICMP
+// administratively prohibited reply as EHOSTUNREACH and keeps the ICMP message from TCP sockets,
+// so PROHIBITED only comes from local policy with EACCES and EPERM.
+var dialErrnos = map[syscall.Errno]int{
+	syscall.ECONNREFUSED:  tcpCodeRefused,
+	syscall.ETIMEDOUT:     tcpCodeTimeout,
+	syscall.EHOSTUNREACH:  tcpCodeHostUnreach,
+	syscall.EHOSTDOWN:     tcpCodeHostUnreach,
+	syscall.ENETUNREACH:   tcpCodeNetUnreach,
+	syscall.ENETDOWN:      tcpCodeNetUnreach,
+	syscall.EACCES:        tcpCodeProhibited,
+	syscall.EPERM:         tcpCodeProhibited,
+	syscall.EADDRNOTAVAIL: tcpCodeAddrNotAvail,
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package cmd
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// dialErrnos maps the Winsock errors of a failed connect to result codes
+var dialErrnos = map[syscall.Errno]int{
+	windows.WSAECONNREFUSED:  tcpCodeRefused,
+	windows.WSAETIMEDOUT:     tcpCodeTimeout,
+	windows.WSAEHOSTUNREACH:  tcpCodeHostUnreach,
+	windows.WSAEHOSTDOWN:     tcpCodeHostUnreach,
+	windows.WSAENETUNREACH:   tcpCodeNetUnreach,
+	windows.WSAENETDOWN:      tcpCodeNetUnreach,
+	windows.WSAEACCES:        tcpCodeProhibited,
+	windows.WSAEADDRNOTAVAIL: tcpCodeAddrNotAvail,
+}
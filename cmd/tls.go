@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
@@ -44,11 +46,26 @@ var (
 
 // TLSResult holds the result of a TLS validation
 type TLSResult struct {
-	Address   string
-	Host      string
-	PeerCerts []*x509.Certificate
-	Valid     bool
-	Err       error
+	Address   string              `json:"address" yaml:"address"`
+	Host      string              `json:"host" yaml:"host"`
+	PeerCerts []*x509.Certificate `json:"-" yaml:"-"`
+	Valid     bool                `json:"valid" yaml:"valid"`
+	Source    string              `json:"source,omitempty" yaml:"source,omitempty"`
+	Err       error               `json:"-" yaml:"-"`
+	Certs     []CertInfo          `json:"certificates,omitempty" yaml:"certificates,omitempty"`
+}
+
+// CertInfo is the serializable summary of a certificate
+type CertInfo struct {
+	Subject       string    `json:"subject" yaml:"subject"`
+	Issuer        string    `json:"issuer" yaml:"issuer"`
+	Signature     string    `json:"signature_algorithm" yaml:"signature_algorithm"`
+	WeakSignature bool      `json:"weak_signature" yaml:"weak_signature"`
+	NotBefore     time.Time `json:"not_before" yaml:"not_before"`
+	NotAfter      time.Time `json:"not_after" yaml:"not_after"`
+	DaysLeft      int       `json:"days_left" yaml:"days_left"`
+	SANs          []string  `json:"sans,omitempty" yaml:"sans,omitempty"`
+	Serial        string    `json:"serial" yaml:"serial"`
 }
 
 var tlsCmd = &cobra.Command{
@@ -58,7 +75,7 @@ var tlsCmd = &cobra.Command{
 }
 
 var tlsValidateCertCmd = &cobra.Command{
-	Use:          tlsValidateCertCmdName,
+	Use:          tlsValidateCertCmdName + " [host[:port] ...]",
 	Aliases:      []string{"validate"},
 	Short:        "Validate a TLS connection or local certificate",
 	Long:         "Connect to a server and validate its TLS certificate against the system trust store or a custom CA. Use --certfile to check a local certificate file instead.",
@@ -83,6 +100,7 @@ func init() {
 	tlsCmd.PersistentFlags().IntVarP(&tlsTimeout, "timeout", "t", 5, "connection timeout in seconds")
 
 	tlsValidateCertCmd.Flags().StringVarP(&tlsCertFile, "certfile", "f", "", "validate a local certificate file instead of connecting")
+	addTargetFlags(tlsValidateCertCmd)
 
 	tlsShowCmd.Flags().BoolVar(&tlsShowChain, "chain", false, "show full certificate chain")
 
@@ -91,36 +109,38 @@ func init() {
 	RootCmd.AddCommand(tlsCmd)
 }
 
-// runTLSValidate validates a TLS connection or a local certificate file.
+// runTLSValidate validates TLS connections to all targets or a local certificate file.
 func runTLSValidate(cmd *cobra.Command, args []string) error {
-	if len(args) > 0 && queryAddress == "" {
-		queryAddress = args[0]
-	}
-
 	if common.CmdFlagChanged(cmd, "certfile") && tlsCertFile != "" {
 		return validateCertFile(tlsCertFile)
 	}
 
-	if queryAddress == "" {
-		return fmt.Errorf("please specify an address to connect to")
-	}
-
-	host, port, err := parseTLSAddress()
+	targets, err := collectTargets(args)
 	if err != nil {
 		return err
 	}
+	if len(targets) == 0 {
+		return fmt.Errorf("please specify an address to connect to")
+	}
 
 	pool, err := buildCertPool(tlsRootCA)
 	if err != nil {
 		return err
 	}
 
-	result := &TLSResult{Address: net.JoinHostPort(host, port), Host: host}
-	result.Err = tlsDial(result, host, port, pool)
-	result.Valid = result.Err == nil
-	result.LogValidate()
+	err = runTargets("tls", targets, func(j *targetJob) {
+		host, port, e := parseTLSTarget(j.target)
+		if e != nil {
+			j.err = e
+			return
+		}
+		result := &TLSResult{Address: net.JoinHostPort(host, port), Host: host}
+		result.Err = tlsDial(result, host, port, pool)
+		result.Valid = result.Err == nil
+		j.emit(result.Record(), result.LogValidate)
+	})
 	log.Debugf("TLS validate done")
-	return nil
+	return err
 }
 
 // runTLSShow connects and prints certificate details.
@@ -145,30 +165,43 @@ func runTLSShow(_ *cobra.Command, args []string) error {
 	result := &TLSResult{Address: net.JoinHostPort(host, port), Host: host}
 	result.Err = tlsDial(result, host, port, pool)
 	result.Valid = result.Err == nil
-	result.LogShow(tlsShowChain)
+	emit(result.Record(), func() { result.LogShow(tlsShowChain) })
 	log.Debugf("TLS show done")
 	return nil
 }
 
 // parseTLSAddress resolves the host and port from flags and args.
+func parseTLSAddress() (string, string, error) {
+	return parseTLSTarget(queryAddress)
+}
+
+// parseTLSTarget resolves the host and port of a target, the port flag is used if it has none.
 // GetHostPort errors are intentionally discarded: they mean no port was embedded in the address,
 // so we fall back to the port flag value.
-func parseTLSAddress() (string, string, error) {
-	addr := queryAddress
+func parseTLSTarget(target string) (string, string, error) {
+	addr := target
 	if tlsPort != "443" {
-		addr = fmt.Sprintf("%s:%s", queryAddress, tlsPort)
+		addr = fmt.Sprintf("%s:%s", target, tlsPort)
 	}
 	h, p, _ := common.GetHostPort(addr)
 	if p == 0 {
-		return queryAddress, tlsPort, nil
+		return target, tlsPort, nil
 	}
 	return h, fmt.Sprintf("%d", p), nil
 }
 
 // tlsDial establishes a TLS connection, optionally via STARTTLS.
 func tlsDial(result *TLSResult, host, port string, pool *x509.CertPool) error {
-	timeout := time.Duration(tlsTimeout) * time.Second
-	addr := net.JoinHostPort(host, port)
+	return tlsDialProto(context.Background(), result, host, port, pool, tlsStartTLS, time.Duration(tlsTimeout)*time.Second)
+}
+
+// tlsDialProto is like tlsDial with a context, an explicit STARTTLS protocol and timeout
+func tlsDialProto(ctx context.Context, result *TLSResult, host, port string, pool *x509.CertPool, starttls string, timeout time.Duration) error {
+	return tlsDialAddr(ctx, result, net.JoinHostPort(host, port), host, pool, starttls, timeout)
+}
+
+// tlsDialAddr connects to addr and validates the certificate for the server name host
+func tlsDialAddr(ctx context.Context, result *TLSResult, addr, host string, pool *x509.CertPool, starttls string, timeout time.Duration) error {
 	cfg := &tls.Config{
 		ServerName: host,
 		RootCAs:    pool,
@@ -177,35 +210,30 @@ func tlsDial(result *TLSResult, host, port string, pool *x509.CertPool) error {
 	var tlsConn *tls.Conn
 	var err error
 
-	if tlsStartTLS != "" {
-		tlsConn, err = startTLS(addr, tlsStartTLS, cfg, timeout)
+	if starttls != "" {
+		tlsConn, err = startTLS(ctx, addr, starttls, cfg, timeout)
 	} else {
-		dialer := &tls.Dialer{
-			NetDialer: &net.Dialer{Timeout: timeout},
-			Config:    cfg,
-		}
-		conn, e := dialer.Dial("tcp", addr)
-		if e != nil {
-			return e
-		}
-		tlsConn = conn.(*tls.Conn)
+		tlsConn, err = dialTLS(ctx, addr, cfg, timeout)
 	}
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tlsConn.Close() }()
 
+	result.Source = localSource(tlsConn)
 	result.PeerCerts = tlsConn.ConnectionState().PeerCertificates
 	return nil
 }
 
-// startTLS performs a plaintext connection then upgrades via STARTTLS.
-func startTLS(addr, proto string, cfg *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+// startTLS performs a plaintext connection then upgrades via STARTTLS. Cancelling ctx aborts the exchange.
+func startTLS(ctx context.Context, addr, proto string, cfg *tls.Config, timeout time.Duration) (*tls.Conn, error) {
 	proto = strings.ToLower(proto)
-	conn, err := net.DialTimeout("tcp", addr, timeout)
+	conn, err := dialTCP(ctx, addr, timeout)
 	if err != nil {
 		return nil, err
 	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
 
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 
@@ -236,7 +264,7 @@ func startTLS(addr, proto string, cfg *tls.Config, timeout time.Duration) (*tls.
 	}
 
 	tlsConn := tls.Client(conn, cfg)
-	if err = tlsConn.Handshake(); err != nil {
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
 		_ = tlsConn.Close()
 		return nil, fmt.Errorf("TLS handshake failed: %w", err)
 	}
@@ -291,27 +319,62 @@ func ftpStartTLS(rw *bufio.ReadWriter) error {
 
 // sendRecv writes a command and reads until a line containing the expected prefix.
 func sendRecv(rw *bufio.ReadWriter, cmd, expect string) (string, error) {
-	if _, err := fmt.Fprint(rw.Writer, cmd); err != nil {
-		return "", err
-	}
-	if err := rw.Flush(); err != nil {
+	if err := sendData(rw.Writer, []byte(cmd)); err != nil {
 		return "", err
 	}
 	return readResponse(rw.Reader, expect)
 }
 
+// sendData writes data and flushes the writer
+func sendData(w *bufio.Writer, data []byte) error {
+	log.Debugf("> %q", data)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
 // readResponse reads lines until one contains the expected prefix (or error).
 func readResponse(r *bufio.Reader, expect string) (string, error) {
-	var last string
+	line, err := readMatch(r, func(buf []byte) (string, int) {
+		for start := 0; ; {
+			i := bytes.IndexByte(buf[start:], '\n')
+			if i < 0 {
+				return "", -1
+			}
+			line := strings.TrimSpace(string(buf[start : start+i]))
+			start += i + 1
+			if strings.Contains(line, expect) {
+				return line, start
+			}
+		}
+	})
+	if err != nil {
+		return strings.TrimSpace(line), fmt.Errorf("read error waiting for %q: %w", expect, err)
+	}
+	return line, nil
+}
+
+// readMatch reads from r until match finds the end of a match in the received data and consumes
+// the data up to it, the rest is kept for the next read. The size of r limits the data waiting
+// for a match. On error the unmatched data is returned.
+func readMatch(r *bufio.Reader, match func(buf []byte) (string, int)) (string, error) {
 	for {
-		line, err := r.ReadString('\n')
-		last = strings.TrimSpace(line)
-		if err != nil {
-			return last, fmt.Errorf("read error waiting for %q: %w", expect, err)
+		buf, _ := r.Peek(r.Buffered())
+		if m, end := match(buf); end >= 0 {
+			_, _ = r.Discard(end)
+			return m, nil
 		}
-		log.Debugf("< %s", last)
-		if strings.Contains(last, expect) {
-			return last, nil
+		if len(buf) == r.Size() {
+			return string(buf), fmt.Errorf("no match within %d bytes", len(buf))
+		}
+		_, err := r.Peek(len(buf) + 1)
+		if got, _ := r.Peek(r.Buffered()); len(got) > len(buf) {
+			log.Debugf("< %q", got[len(buf):])
+			buf = got
+		}
+		if err != nil {
+			return string(buf), err
 		}
 	}
 }
@@ -604,7 +667,7 @@ func validateCertFile(path string) error {
 		if err != nil {
 			return fmt.Errorf("no valid certificate found in %s", path)
 		}
-		logCertValidation(path, cert, now)
+		emit(certRecord(path, cert, now), func() { logCertValidation(path, cert, now) })
 		return nil
 	}
 
@@ -615,7 +678,7 @@ func validateCertFile(path string) error {
 			if err != nil {
 				log.Debugf("skipping unparseable cert: %v", err)
 			} else {
-				logCertValidation(path, cert, now)
+				emit(certRecord(path, cert, now), func() { logCertValidation(path, cert, now) })
 				count++
 			}
 		}
@@ -641,6 +704,47 @@ func isWeakSigAlg(alg x509.SignatureAlgorithm) bool {
 	return weakSigAlgorithms[alg]
 }
 
+// newCertInfo returns the serializable summary of cert.
+func newCertInfo(cert *x509.Certificate, now time.Time) CertInfo {
+	return CertInfo{
+		Subject:       cert.Subject.String(),
+		Issuer:        cert.Issuer.String(),
+		Signature:     cert.SignatureAlgorithm.String(),
+		WeakSignature: isWeakSigAlg(cert.SignatureAlgorithm),
+		NotBefore:     cert.NotBefore.UTC(),
+		NotAfter:      cert.NotAfter.UTC(),
+		DaysLeft:      int(cert.NotAfter.Sub(now).Hours() / 24),
+		SANs:          certSANs(cert),
+		Serial:        cert.SerialNumber.Text(16),
+	}
+}
+
+// certSANs returns DNS names, IP addresses and email addresses of a certificate.
+func certSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return append(sans, cert.EmailAddresses...)
+}
+
+// certRecord returns the serializable validation result of a local certificate.
+func certRecord(source string, cert *x509.Certificate, now time.Time) Result {
+	var err error
+	status := "VALID"
+	switch {
+	case now.After(cert.NotAfter):
+		err = fmt.Errorf("expired on %s", cert.NotAfter.UTC().Format("2006-01-02"))
+	case now.Before(cert.NotBefore):
+		err = fmt.Errorf("not valid before %s", cert.NotBefore.UTC().Format("2006-01-02"))
+	}
+	if err != nil {
+		status = "INVALID"
+	}
+	return newResult(tlsCmdName, source, status, err, newCertInfo(cert, now))
+}
+
 // logCertValidation prints validation status for a single certificate.
 func logCertValidation(source string, cert *x509.Certificate, now time.Time) {
 	expired := now.After(cert.NotAfter)
@@ -673,6 +777,20 @@ func logCertValidation(source string, cert *x509.Certificate, now time.Time) {
 	}
 }
 
+// Record returns the serializable validation result including all peer certificates.
+func (r *TLSResult) Record() Result {
+	now := time.Now()
+	r.Certs = nil
+	for _, c := range r.PeerCerts {
+		r.Certs = append(r.Certs, newCertInfo(c, now))
+	}
+	status := "VALID"
+	if !r.Valid {
+		status = "INVALID"
+	}
+	return newResult(tlsCmdName, r.Address, status, r.Err, r)
+}
+
 // LogValidate prints the TLS validation result.
 func (r *TLSResult) LogValidate() {
 	label := cyan("%-7s", "TLS")
@@ -680,9 +798,13 @@ func (r *TLSResult) LogValidate() {
 		leaf := r.leafCert()
 		daysLeft := int(time.Until(leaf.NotAfter).Hours() / 24)
 		log.Debugf("TLS VALID %s expires %s %d days", r.Address, leaf.NotAfter.UTC().Format("2006-01-02"), daysLeft)
-		fmt.Printf("%s%s%s  (expires %s, %d days)\n",
+		from := ""
+		if sourceSet() && r.Source != "" {
+			from = "  from " + r.Source
+		}
+		fmt.Printf("%s%s%s  (expires %s, %d days)%s\n",
 			label, green("%-10s", "VALID"), r.Address,
-			leaf.NotAfter.UTC().Format("2006-01-02"), daysLeft)
+			leaf.NotAfter.UTC().Format("2006-01-02"), daysLeft, from)
 		if isWeakSigAlg(leaf.SignatureAlgorithm) {
 			log.Debugf("TLS WEAK signature algorithm: %s", leaf.SignatureAlgorithm)
 			fmt.Printf("       %s%s\n",
@@ -756,13 +878,7 @@ func printCertDetails(cert *x509.Certificate, indent string) {
 	fmt.Printf("%s%-14s %s\n", indent, "Not After:",
 		expiryColor("%s  (%d days)", cert.NotAfter.UTC().Format("2006-01-02 15:04:05 UTC"), daysLeft))
 
-	var sans []string
-	sans = append(sans, cert.DNSNames...)
-	for _, ip := range cert.IPAddresses {
-		sans = append(sans, ip.String())
-	}
-	sans = append(sans, cert.EmailAddresses...)
-	if len(sans) > 0 {
+	if sans := certSANs(cert); len(sans) > 0 {
 		fmt.Printf("%s%-14s %s\n", indent, "SANs:", strings.Join(sans, ", "))
 	}
 	fmt.Printf("%s%-14s %s / SN %s\n", indent, "Serial:", cert.SerialNumber.Text(16), cert.SerialNumber.String())
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -15,18 +16,26 @@ var tlsInfoProbe bool
 
 // TLSConnInfo holds the result of a TLS connection info query.
 type TLSConnInfo struct {
-	Address         string
-	Host            string
-	Err             error
-	Version         uint16
-	CipherSuite     uint16
-	NegotiatedProto string
-	PeerCerts       []*x509.Certificate
-	HasOCSP         bool
-	HasSCT          bool
+	Address         string              `json:"address" yaml:"address"`
+	Host            string              `json:"host" yaml:"host"`
+	Err             error               `json:"-" yaml:"-"`
+	Version         uint16              `json:"-" yaml:"-"`
+	CipherSuite     uint16              `json:"-" yaml:"-"`
+	NegotiatedProto string              `json:"alpn,omitempty" yaml:"alpn,omitempty"`
+	Source          string              `json:"source,omitempty" yaml:"source,omitempty"`
+	PeerCerts       []*x509.Certificate `json:"-" yaml:"-"`
+	HasOCSP         bool                `json:"ocsp_stapling" yaml:"ocsp_stapling"`
+	HasSCT          bool                `json:"sct" yaml:"sct"`
 	// populated when --probe is set
-	SupportedVersions []uint16
-	SupportedCiphers  []uint16
+	SupportedVersions []uint16 `json:"-" yaml:"-"`
+	SupportedCiphers  []uint16 `json:"-" yaml:"-"`
+	// names for structured output, populated by Record
+	VersionName          string    `json:"version,omitempty" yaml:"version,omitempty"`
+	WeakVersion          bool      `json:"weak_version" yaml:"weak_version"`
+	CipherName           string    `json:"cipher_suite,omitempty" yaml:"cipher_suite,omitempty"`
+	Certificate          *CertInfo `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+	SupportedVersionList []string  `json:"supported_versions,omitempty" yaml:"supported_versions,omitempty"`
+	SupportedCipherList  []string  `json:"supported_ciphers,omitempty" yaml:"supported_ciphers,omitempty"`
 }
 
 var tlsInfoCmd = &cobra.Command{
@@ -70,7 +79,7 @@ func runTLSInfo(_ *cobra.Command, args []string) error {
 		probeCiphers(info, host, port, pool)
 	}
 
-	info.Log()
+	emit(info.Record(), info.Log)
 	log.Debugf("TLS info done")
 	return nil
 }
@@ -88,23 +97,16 @@ func tlsDialInfo(info *TLSConnInfo, host, port string, pool *x509.CertPool) erro
 	var err error
 
 	if tlsStartTLS != "" {
-		tlsConn, err = startTLS(addr, tlsStartTLS, cfg, timeout)
+		tlsConn, err = startTLS(context.Background(), addr, tlsStartTLS, cfg, timeout)
 	} else {
-		dialer := &tls.Dialer{
-			NetDialer: &net.Dialer{Timeout: timeout},
-			Config:    cfg,
-		}
-		conn, e := dialer.Dial("tcp", addr)
-		if e != nil {
-			return e
-		}
-		tlsConn = conn.(*tls.Conn)
+		tlsConn, err = dialTLS(context.Background(), addr, cfg, timeout)
 	}
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tlsConn.Close() }()
 
+	info.Source = localSource(tlsConn)
 	state := tlsConn.ConnectionState()
 	info.Version = state.Version
 	info.CipherSuite = state.CipherSuite
@@ -159,11 +161,7 @@ func probeVersions(info *TLSConnInfo, host, port string, pool *x509.CertPool) {
 			MinVersion: v,
 			MaxVersion: v,
 		}
-		dialer := &tls.Dialer{
-			NetDialer: &net.Dialer{Timeout: timeout},
-			Config:    cfg,
-		}
-		conn, err := dialer.Dial("tcp", addr)
+		conn, err := dialTLS(context.Background(), addr, cfg, timeout)
 		if err == nil {
 			_ = conn.Close()
 			info.SupportedVersions = append(info.SupportedVersions, v)
@@ -189,11 +187,7 @@ func probeCiphers(info *TLSConnInfo, host, port string, pool *x509.CertPool) {
 			MaxVersion:   tls.VersionTLS12,
 			CipherSuites: []uint16{suite.ID}, //nolint:gosec // intentional: probing for server-supported suites including potentially insecure ones
 		}
-		dialer := &tls.Dialer{
-			NetDialer: &net.Dialer{Timeout: timeout},
-			Config:    cfg,
-		}
-		conn, err := dialer.Dial("tcp", addr)
+		conn, err := dialTLS(context.Background(), addr, cfg, timeout)
 		if err == nil {
 			_ = conn.Close()
 			info.SupportedCiphers = append(info.SupportedCiphers, suite.ID)
@@ -202,6 +196,29 @@ func probeCiphers(info *TLSConnInfo, host, port string, pool *x509.CertPool) {
 	}
 }
 
+// Record returns the serializable connection parameters.
+func (info *TLSConnInfo) Record() Result {
+	if info.Err != nil {
+		return newResult(tlsCmdName, info.Address, "FAILED", info.Err, info)
+	}
+	info.VersionName = tlsVersionName(info.Version)
+	info.WeakVersion = weakTLSVersions[info.Version]
+	info.CipherName = tls.CipherSuiteName(info.CipherSuite)
+	if len(info.PeerCerts) > 0 {
+		c := newCertInfo(info.PeerCerts[0], time.Now())
+		info.Certificate = &c
+	}
+	info.SupportedVersionList = nil
+	for _, v := range info.SupportedVersions {
+		info.SupportedVersionList = append(info.SupportedVersionList, tlsVersionName(v))
+	}
+	info.SupportedCipherList = nil
+	for _, id := range info.SupportedCiphers {
+		info.SupportedCipherList = append(info.SupportedCipherList, tls.CipherSuiteName(id))
+	}
+	return newResult(tlsCmdName, info.Address, "INFO", nil, info)
+}
+
 // Log prints TLS connection parameters to stdout.
 func (info *TLSConnInfo) Log() {
 	label := cyan("%-7s", "TLS")
@@ -230,6 +247,9 @@ func (info *TLSConnInfo) logParams() {
 	fmt.Printf("%s%s%s\n", cyan("%-7s", "TLS"), cyan("%-10s", "INFO"), info.Address)
 	fmt.Printf("  %-16s %s\n", "Version:", versionFn(versionDisplay))
 	fmt.Printf("  %-16s %s\n", "Cipher suite:", cipherStr)
+	if sourceSet() && info.Source != "" {
+		fmt.Printf("  %-16s %s\n", "Source:", info.Source)
+	}
 
 	if info.NegotiatedProto != "" {
 		log.Debugf("TLS INFO ALPN %s", info.NegotiatedProto)
@@ -5,6 +5,7 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/binary"
 	"encoding/pem"
@@ -374,7 +375,7 @@ func TestStartTLSBannerErrors(t *testing.T) {
 			addr := ln.Addr().String()
 			tlsStartTLS = proto
 			t.Cleanup(resetStartTLSFlag)
-			_, err = startTLS(addr, proto, nil, 3*time.Second)
+			_, err = startTLS(context.Background(), addr, proto, nil, 3*time.Second)
 			assert.Error(t, err, "banner read should fail when server closes immediately")
 		})
 	}
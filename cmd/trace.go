@@ -0,0 +1,560 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommi2day/gomodules/common"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	traceEngineNative = "native"
+	traceEngineMTR    = "mtr"
+
+	traceProtoICMP = "icmp"
+	traceProtoUDP  = "udp"
+	traceProtoTCP  = "tcp"
+
+	traceUDPBasePort = 33434
+	tracePacketSize  = 64
+	traceUnknownHost = "???"
+)
+
+var (
+	traceEngine  = traceEngineNative
+	traceProto   = traceProtoICMP
+	traceCount   = 10
+	traceMaxHops = 30
+	traceTimeout = 2
+	traceNumeric = false
+)
+
+// traceProbe is a single probe packet sent with a given TTL
+type traceProbe struct {
+	flow     int
+	ttl      int
+	seq      int
+	round    int
+	sent     time.Time
+	host     string
+	rtt      time.Duration
+	ok       bool
+	reached  bool
+	final    bool
+	answered chan struct{}
+}
+
+// traceHop collects the answers of all probes sent with the same TTL
+type traceHop struct {
+	stats *PingStats
+	hosts map[string]int
+}
+
+// nativeTracer runs a traceroute to one destination using ICMP echo, UDP or TCP SYN probes
+// with increasing TTL and a raw ICMP socket to receive the answers of the routers
+type nativeTracer struct {
+	dst     net.IP
+	ipType  IPType
+	proto   string
+	port    int
+	timeout time.Duration
+	id      int
+	base    int
+	// span is the number of ports above base for the sequence numbers of udp and tcp probes
+	span    int
+	seq     int
+	rounds  int
+	conn    *icmp.PacketConn
+	udp     net.PacketConn
+	udpPort int
+	mu      sync.Mutex
+	pending map[int]*traceProbe
+	// multipath mode, see multipath.go
+	flows     int
+	flowConns []net.PacketConn
+	flowPorts map[int]int
+	srcIP     net.IP
+}
+
+// newNativeTracer opens the sockets needed to trace ip with the given probe protocol.
+// port is the destination port for TCP and the base destination port for UDP probes.
+func newNativeTracer(ip net.IP, proto string, port int) (t *nativeTracer, err error) {
+	t = &nativeTracer{
+		dst:     ip,
+		ipType:  IPType4,
+		proto:   proto,
+		port:    port,
+		timeout: time.Duration(traceTimeout) * time.Second,
+		id:      os.Getpid() & 0xffff,
+		pending: map[int]*traceProbe{},
+	}
+	if ip.To4() == nil {
+		t.ipType = IPType6
+	}
+	t.conn, err = icmp.ListenPacket(t.ipType.ICMPNetwork, t.ipType.ListenAddr)
+	if err != nil {
+		log.Debugf("trace ListenPacket %s failed: %v", t.ipType.ICMPNetwork, err)
+		return nil, fmt.Errorf("native traceroute needs a raw ICMP socket (root or CAP_NET_RAW): %w", err)
+	}
+	switch proto {
+	case traceProtoUDP:
+		t.base = traceUDPBasePort
+		if port > 0 {
+			t.base = port
+		}
+		t.udp, err = net.ListenPacket("udp"+t.ipType.Type, "")
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.udpPort = t.udp.LocalAddr().(*net.UDPAddr).Port
+	case traceProtoTCP:
+		// source ports identify the TCP probes in the quoted headers of ICMP errors
+		t.base = 40000 + rand.IntN(10000) //nolint:gosec // no security context
+	}
+	if t.base > 0 {
+		t.span = 65535 - t.base
+	}
+	log.Debugf("trace %s to %s via %s, id %d base port %d", proto, ip, t.ipType.ICMPNetwork, t.id, t.base)
+	return t, nil
+}
+
+// Close closes all sockets of the tracer
+func (t *nativeTracer) Close() {
+	if t.conn != nil {
+		_ = t.conn.Close()
+	}
+	if t.udp != nil {
+		_ = t.udp.Close()
+	}
+	for _, c := range t.flowConns {
+		_ = c.Close()
+	}
+}
+
+// Run sends count rounds of probes with TTL 1 up to maxHops and returns the statistics per hop
+func (t *nativeTracer) Run(count, maxHops int) []HopsMTR {
+	stop := make(chan struct{})
+	go t.receive(stop)
+	defer close(stop)
+
+	maxTTL := maxHops
+	hops := make([]*traceHop, maxHops+1)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		hops[ttl] = &traceHop{stats: NewPingStats(""), hosts: map[string]int{}}
+	}
+	for r := 1; r <= count; r++ {
+		probes := t.round(maxTTL)
+		for _, p := range probes {
+			h := hops[p.ttl]
+			h.stats.Add(p.rtt, p.ok)
+			if p.ok {
+				h.hosts[p.host]++
+			}
+			// the path ends at the destination or a router reporting it unreachable
+			if p.ok && (p.reached || p.final) && p.ttl < maxTTL {
+				maxTTL = p.ttl
+			}
+		}
+		log.Debugf("trace round %d done, path length %d", r, maxTTL)
+	}
+	return t.hopsReport(hops[1 : maxTTL+1])
+}
+
+// hopsReport converts the collected hop statistics into the mtr report format.
+// Silent hops at the end of an incomplete path are omitted.
+func (t *nativeTracer) hopsReport(hops []*traceHop) []HopsMTR {
+	last := len(hops)
+	for last > 1 && hops[last-1].stats.OK == 0 {
+		last--
+	}
+	report := make([]HopsMTR, 0, last)
+	for i, h := range hops[:last] {
+		s := h.stats
+		host := traceUnknownHost
+		ip := mostFrequent(h.hosts)
+		if ip != "" {
+			host = traceHostName(ip)
+		}
+		hop := HopsMTR{
+			Count: i + 1,
+			Host:  host,
+			IP:    ip,
+			Loss:  s.Loss(),
+			Snt:   s.Sent,
+		}
+		if s.OK > 0 {
+			hop.Last = durationMS(s.RTTs[len(s.RTTs)-1])
+			hop.Avg = durationMS(s.Avg())
+			hop.Best = durationMS(s.Min())
+			hop.Wrst = durationMS(s.Max())
+			hop.StDev = durationMS(s.StdDev())
+		}
+		report = append(report, hop)
+	}
+	return report
+}
+
+// round sends one probe for each TTL up to maxTTL and flow and waits for the answers until the timeout
+func (t *nativeTracer) round(maxTTL int) []*traceProbe {
+	probes := make([]*traceProbe, 0, maxTTL*max(t.flows, 1))
+	t.rounds++
+	for flow := 0; flow < max(t.flows, 1); flow++ {
+		for ttl := 1; ttl <= maxTTL; ttl++ {
+			p := &traceProbe{flow: flow, ttl: ttl, round: t.rounds, answered: make(chan struct{})}
+			if t.flows > 0 {
+				p.seq = probeKey(flow, ttl)
+			} else {
+				p.seq = t.nextSeq()
+			}
+			t.mu.Lock()
+			t.pending[p.seq] = p
+			p.sent = time.Now()
+			t.mu.Unlock()
+			if err := t.send(p); err != nil {
+				log.Debugf("trace send flow %d ttl %d failed: %v", flow, ttl, err)
+			}
+			probes = append(probes, p)
+			if t.flows > 0 {
+				// pace the many probes of a multipath round to stay below router ICMP rate limits
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	deadline := time.NewTimer(t.timeout)
+	defer deadline.Stop()
+wait:
+	for _, p := range probes {
+		select {
+		case <-p.answered:
+		case <-deadline.C:
+			break wait
+		}
+	}
+	t.mu.Lock()
+	for _, p := range probes {
+		delete(t.pending, p.seq)
+	}
+	t.mu.Unlock()
+	return probes
+}
+
+// answer records the answer to the pending probe seq
+func (t *nativeTracer) answer(seq int, host string, at time.Time, reached, final bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[seq]
+	if !ok || p.ok {
+		return
+	}
+	p.ok = true
+	p.host = host
+	p.rtt = at.Sub(p.sent)
+	p.reached = reached
+	p.final = final
+	close(p.answered)
+	log.Debugf("trace ttl %d seq %d answered by %s in %v reached=%v", p.ttl, seq, host, p.rtt, reached)
+}
+
+// send transmits the probe with the protocol of the tracer
+func (t *nativeTracer) send(p *traceProbe) error {
+	switch t.proto {
+	case traceProtoUDP:
+		return t.sendUDP(p)
+	case traceProtoTCP:
+		t.sendTCP(p)
+		return nil
+	default:
+		return t.sendICMP(p)
+	}
+}
+
+// setTTL sets the TTL / hop limit of a packet connection
+func (t *nativeTracer) setTTL(c net.PacketConn, ttl int) error {
+	if t.ipType.Type == IPType6.Type {
+		return ipv6.NewPacketConn(c).SetHopLimit(ttl)
+	}
+	return ipv4.NewPacketConn(c).SetTTL(ttl)
+}
+
+// payload returns the probe payload padding the IP packet to tracePacketSize
+func (t *nativeTracer) payload() []byte {
+	n := tracePacketSize - ipv4.HeaderLen - 8
+	if t.ipType.Type == IPType6.Type {
+		n = tracePacketSize - ipv6.HeaderLen - 8
+	}
+	return make([]byte, n)
+}
+
+func (t *nativeTracer) sendICMP(p *traceProbe) error {
+	data := t.payload()
+	if t.flows > 0 {
+		t.flowChecksum(p, data)
+	}
+	m := icmp.Message{
+		Type: t.ipType.RequestMessageType,
+		Body: &icmp.Echo{ID: t.echoID(p), Seq: p.seq & 0xffff, Data: data},
+	}
+	b, err := m.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if p4 := t.conn.IPv4PacketConn(); p4 != nil {
+		err = p4.SetTTL(p.ttl)
+	} else if p6 := t.conn.IPv6PacketConn(); p6 != nil {
+		err = p6.SetHopLimit(p.ttl)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteTo(b, &net.IPAddr{IP: t.dst})
+	return err
+}
+
+func (t *nativeTracer) sendUDP(p *traceProbe) error {
+	if t.flows > 0 {
+		return t.sendFlowUDP(p)
+	}
+	if err := t.setTTL(t.udp, p.ttl); err != nil {
+		return err
+	}
+	_, err := t.udp.WriteTo(t.payload(), &net.UDPAddr{IP: t.dst, Port: t.base + p.seq})
+	return err
+}
+
+// sendTCP starts a connection attempt with the TTL of the probe. A successful connect or
+// a reset means the destination has been reached, routers answer with ICMP time exceeded.
+func (t *nativeTracer) sendTCP(p *traceProbe) {
+	v6 := t.ipType.Type == IPType6.Type
+	d := net.Dialer{
+		Timeout:   t.timeout,
+		LocalAddr: &net.TCPAddr{Port: t.base + p.seq},
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setSocketTTL(fd, v6, p.ttl)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	addr := net.JoinHostPort(t.dst.String(), strconv.Itoa(t.port))
+	go func() {
+		conn, err := d.Dial("tcp", addr)
+		at := time.Now()
+		switch {
+		case err == nil:
+			_ = conn.Close()
+			t.answer(p.seq, t.dst.String(), at, true, true)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			t.answer(p.seq, t.dst.String(), at, true, true)
+		default:
+			log.Debugf("trace tcp ttl %d: %v", p.ttl, err)
+		}
+	}()
+}
+
+// receive reads ICMP messages until stop is closed and passes answers to pending probes
+func (t *nativeTracer) receive(stop <-chan struct{}) {
+	b := make([]byte, 1500)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		_ = t.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, peer, err := t.conn.ReadFrom(b)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			log.Debugf("trace ReadFrom failed: %v", err)
+			return
+		}
+		t.handle(b[:n], peer, time.Now())
+	}
+}
+
+// handle matches an ICMP message to the probe it answers
+func (t *nativeTracer) handle(b []byte, peer net.Addr, at time.Time) {
+	host := peerIP(peer)
+	v6 := t.ipType.Type == IPType6.Type
+	if t.proto == traceProtoICMP && len(b) >= 8 && int(b[0]) == typeNumber(t.ipType.ReplyMessageType) {
+		round := t.echoRound(int(binary.BigEndian.Uint16(b[4:6])))
+		if round < 0 || !sameIP(peer, t.dst) {
+			return
+		}
+		if seq := t.matchRound(t.matchSeq(int(binary.BigEndian.Uint16(b[6:8]))), round, 0xffff); seq >= 0 {
+			t.answer(seq, host, at, true, true)
+		}
+		return
+	}
+	ie, inner := decodeICMPError(t.ipType.ProtocolNumber, b, peer)
+	if ie == nil || ie.Status == icmpStatusRedirect {
+		return
+	}
+	qdst, proto, payload, ok := quotedPacket(inner, v6)
+	if !ok || !qdst.Equal(t.dst) {
+		return
+	}
+	seq := t.quotedSeq(proto, payload)
+	if seq < 0 {
+		return
+	}
+	reached := sameIP(peer, t.dst)
+	t.answer(seq, host, at, reached, ie.Status != icmpStatusTTLExceeded)
+}
+
+// quotedSeq returns the probe sequence number of a quoted probe header or -1 if it is no probe of this tracer
+func (t *nativeTracer) quotedSeq(proto int, payload []byte) int {
+	if len(payload) < 8 {
+		return -1
+	}
+	src := int(binary.BigEndian.Uint16(payload[0:2]))
+	dst := int(binary.BigEndian.Uint16(payload[2:4]))
+	switch {
+	case t.proto == traceProtoICMP && proto == t.ipType.ProtocolNumber:
+		round := t.echoRound(int(binary.BigEndian.Uint16(payload[4:6])))
+		if int(payload[0]) != typeNumber(t.ipType.RequestMessageType) || round < 0 {
+			return -1
+		}
+		return t.matchRound(t.matchSeq(int(binary.BigEndian.Uint16(payload[6:8]))), round, 0xffff)
+	case t.flows > 0 && t.proto == traceProtoUDP && proto == syscall.IPPROTO_UDP:
+		return t.quotedFlowUDP(src, dst, payload)
+	case t.proto == traceProtoUDP && proto == syscall.IPPROTO_UDP && src == t.udpPort:
+		return dst - t.base
+	case t.proto == traceProtoTCP && proto == syscall.IPPROTO_TCP && dst == t.port:
+		return src - t.base
+	}
+	return -1
+}
+
+// nextSeq returns the sequence number of the next probe. The udp destination and tcp source ports
+// are base+seq, so the numbers wrap within the span of ports above base.
+func (t *nativeTracer) nextSeq() int {
+	t.seq++
+	if t.span > 0 && t.seq > t.span {
+		t.seq = 1
+	}
+	return t.seq
+}
+
+// matchSeq maps a 16bit ICMP sequence number back to the pending probe sequence
+func (t *nativeTracer) matchSeq(seq16 int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for seq := range t.pending {
+		if seq&0xffff == seq16 {
+			return seq
+		}
+	}
+	return -1
+}
+
+// RunNative traces ip with the built-in engine and fills the MTR report
+func (mtr *MTR) RunNative(ip string, port string, proto string) (err error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return fmt.Errorf("invalid ip address %s", ip)
+	}
+	p, err := tracePort(port)
+	if err != nil {
+		return err
+	}
+	if err = checkTraceBasePort(proto, p, traceCount*traceMaxHops); err != nil {
+		return err
+	}
+	t, err := newNativeTracer(dst, proto, p)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	txt := ip
+	if proto == traceProtoTCP {
+		txt = net.JoinHostPort(ip, port)
+	}
+	if textOutput() {
+		fmt.Printf("Waiting for %s trace results to %s ...\n", strings.ToUpper(proto), txt)
+	}
+	mtr.Report = ReportMTR{
+		Desc: DescMTR{
+			Src:   common.GetHostname(),
+			Dst:   ip,
+			Tests: traceCount,
+			Psize: strconv.Itoa(tracePacketSize),
+		},
+	}
+	mtr.Report.Hops = t.Run(traceCount, traceMaxHops)
+	return nil
+}
+
+// tracePort converts the port flag of the mtr command, an empty value is returned as 0
+func tracePort(port string) (int, error) {
+	if port == "" {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %s", port)
+	}
+	return p, nil
+}
+
+// checkTraceBasePort rejects a udp base port without a distinct destination port for each of the probes
+func checkTraceBasePort(proto string, port, probes int) error {
+	if proto != traceProtoUDP || port == 0 {
+		return nil
+	}
+	if room := 65535 - port; room < probes {
+		return fmt.Errorf("udp base port %d leaves room for %d probes, count x max-hops needs %d", port, room, probes)
+	}
+	return nil
+}
+
+// traceHostName returns the reverse DNS name of ip unless numeric output is requested
+func traceHostName(ip string) string {
+	if traceNumeric {
+		return ip
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsConfig.Timeout)
+	defer cancel()
+	names, err := dnsConfig.Resolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ip
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// mostFrequent returns the key with the highest count, preferring the smaller key on ties
+func mostFrequent(m map[string]int) (key string) {
+	best := 0
+	for k, v := range m {
+		if v > best || (v == best && k < key) {
+			key, best = k, v
+		}
+	}
+	return
+}
+
+// durationMS converts a duration to milliseconds
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestNativeTrace(t *testing.T) {
+	skipIfNoRawICMP(t)
+	t.Cleanup(func() {
+		traceEngine = traceEngineNative
+		traceProto = traceProtoICMP
+		traceCount = 10
+		traceMaxHops = 30
+		traceNumeric = false
+		tcpFlag = false
+		queryPort = ""
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	tcpPort := fmt.Sprintf("%d", l.Addr().(*net.TCPAddr).Port)
+
+	for _, proto := range []string{traceProtoICMP, traceProtoUDP, traceProtoTCP} {
+		t.Run("session "+proto, func(t *testing.T) {
+			port := 0
+			if proto == traceProtoTCP {
+				port = l.Addr().(*net.TCPAddr).Port
+			}
+			tr, err := newNativeTracer(net.ParseIP("127.0.0.1"), proto, port)
+			require.NoError(t, err)
+			defer tr.Close()
+			tr.timeout = time.Second
+			traceNumeric = true
+			hops := tr.Run(2, 5)
+			require.Len(t, hops, 1, "loopback should be reached in one hop")
+			assert.Equal(t, "127.0.0.1", hops[0].IP)
+			assert.Equal(t, 2, hops[0].Snt)
+			assert.Zero(t, hops[0].Loss)
+		})
+	}
+
+	t.Run("CMD native tcp", func(t *testing.T) {
+		args := []string{
+			"mtr",
+			flagAddress, "127.0.0.1",
+			"--proto", "tcp",
+			"-p", tcpPort,
+			"-c", "2",
+			"-n",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Contains(t, out, "hop 1 127.0.0.1 loss 0.0")
+		assert.Contains(t, out, "MTR done")
+		t.Log(out)
+	})
+}
+
+func TestTraceFlags(t *testing.T) {
+	t.Cleanup(func() {
+		traceEngine = traceEngineNative
+		traceProto = traceProtoICMP
+	})
+	traceProto = "sctp"
+	assert.Error(t, checkTraceFlags())
+	traceProto = traceProtoUDP
+	traceEngine = "paris"
+	assert.Error(t, checkTraceFlags())
+	traceEngine = traceEngineNative
+	assert.NoError(t, checkTraceFlags())
+}
+
+func TestTraceEchoReplySeq(t *testing.T) {
+	dst := net.ParseIP("192.0.2.1")
+	tr := &nativeTracer{dst: dst, ipType: IPType4, proto: traceProtoICMP, id: 0x4242, pending: map[int]*traceProbe{}}
+	p := &traceProbe{ttl: 30, seq: 65537, sent: time.Now(), answered: make(chan struct{})}
+	tr.pending[p.seq] = p
+	reply := func(seq int) []byte {
+		b, err := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 0x4242, Seq: seq}}).Marshal(nil)
+		require.NoError(t, err)
+		return b
+	}
+	tr.handle(reply(2), &net.IPAddr{IP: dst}, time.Now())
+	assert.False(t, p.ok, "reply to another sequence number")
+	tr.handle(reply(1), &net.IPAddr{IP: dst}, time.Now())
+	assert.True(t, p.ok, "16 bit sequence number of the reply matches the wrapped probe")
+	assert.True(t, p.reached)
+}
+
+func TestTracePortSeq(t *testing.T) {
+	tr := &nativeTracer{proto: traceProtoUDP, base: 65530, span: 5, udpPort: 40000}
+	var ports []int
+	for range 7 {
+		ports = append(ports, tr.base+tr.nextSeq())
+	}
+	assert.Equal(t, []int{65531, 65532, 65533, 65534, 65535, 65531, 65532}, ports, "ports wrap above the base port")
+	quoted := make([]byte, 8)
+	binary.BigEndian.PutUint16(quoted[0:2], 40000)
+	binary.BigEndian.PutUint16(quoted[2:4], 65532)
+	assert.Equal(t, 2, tr.quotedSeq(syscall.IPPROTO_UDP, quoted))
+
+	assert.NoError(t, checkTraceBasePort(traceProtoUDP, 0, 100000), "the default base port wraps")
+	assert.NoError(t, checkTraceBasePort(traceProtoTCP, 65000, 1000), "tcp uses the port as destination")
+	assert.NoError(t, checkTraceBasePort(traceProtoUDP, 33434, 300))
+	assert.ErrorContains(t, checkTraceBasePort(traceProtoUDP, 65500, 300), "leaves room for 35 probes")
+}
+
+func TestMostFrequent(t *testing.T) {
+	assert.Equal(t, "", mostFrequent(map[string]int{}))
+	assert.Equal(t, "b", mostFrequent(map[string]int{"a": 1, "b": 3}))
+	assert.Equal(t, "a", mostFrequent(map[string]int{"a": 2, "b": 2}))
+}
@@ -16,12 +16,23 @@ var (
 		Short: "version print version string",
 		Long:  ``,
 		Run: func(_ *cobra.Command, _ []string) {
-			v := GetVersion(true)
+			v := GetVersion(false)
 			log.Debugf("Version: %s", v)
+			emit(newResult("version", Name, "OK", nil, VersionInfo{Name: Name, Version: Version, Commit: Commit, Date: Date}), func() {
+				fmt.Println(v)
+			})
 		},
 	}
 )
 
+// VersionInfo is the serializable version record
+type VersionInfo struct {
+	Name    string `json:"name" yaml:"name"`
+	Version string `json:"version" yaml:"version"`
+	Commit  string `json:"commit" yaml:"commit"`
+	Date    string `json:"date" yaml:"date"`
+}
+
 // Version, Build Commit and Date are filled in during build by the Makefile
 // noinspection GoUnusedGlobalVariable
 var (
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// wait target states
+const (
+	waitReady    = "READY"
+	waitNotReady = "NOT-READY"
+)
+
+var (
+	waitCmd = &cobra.Command{
+		Use:   "wait target ... [-- command args]",
+		Short: "Wait until services become reachable",
+		Long: `Retry the targets with exponential backoff until they are ready or the deadline expires.
+Targets are tcp://host:port, http(s)://url, tls://host[:port], echo://host:port, icmp://host or host:port for TCP.
+A command after -- is executed when the targets are ready.`,
+		Example:      `tcping2 wait tcp://db:5432 https://api/health tls://ldap:636 --timeout 2m -- ./start.sh`,
+		RunE:         runWait,
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+	}
+	waitDeadline     = 60 * time.Second
+	waitInterval     = time.Second
+	waitMaxInterval  = 30 * time.Second
+	waitProbeTimeout = 5 * time.Second
+	waitAny          bool
+	// execCommand starts the command after the targets are ready, tests replace it
+	execCommand = runCommand
+)
+
+// WaitTarget is the state of a target of the wait command
+type WaitTarget struct {
+	Target   string  `json:"target" yaml:"target"`
+	Type     string  `json:"type" yaml:"type"`
+	Ready    bool    `json:"ready" yaml:"ready"`
+	Attempts int     `json:"attempts" yaml:"attempts"`
+	Elapsed  float64 `json:"elapsed_s" yaml:"elapsed_s"`
+	Error    string  `json:"error,omitempty" yaml:"error,omitempty"`
+	probe    ProbeConfig
+}
+
+func init() {
+	waitCmd.Flags().DurationVarP(&waitDeadline, "timeout", "t", waitDeadline, "overall deadline, 0 waits forever")
+	waitCmd.Flags().DurationVarP(&waitInterval, "interval", "i", waitInterval, "delay before the first retry, doubled after each attempt")
+	waitCmd.Flags().DurationVar(&waitMaxInterval, "max-interval", waitMaxInterval, "maximum delay between retries")
+	waitCmd.Flags().DurationVar(&waitProbeTimeout, "probe-timeout", waitProbeTimeout, "timeout of a single attempt")
+	waitCmd.Flags().BoolVar(&waitAny, "any", false, "stop as soon as one target is ready")
+	RootCmd.AddCommand(waitCmd)
+}
+
+func runWait(cmd *cobra.Command, args []string) error {
+	var command []string
+	if n := cmd.ArgsLenAtDash(); n >= 0 {
+		args, command = args[:n], args[n:]
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("please specify a target to wait for")
+	}
+	if waitInterval <= 0 || waitMaxInterval < waitInterval {
+		return fmt.Errorf("--interval must be positive and not greater than --max-interval")
+	}
+	targets := make([]*WaitTarget, len(args))
+	for i, a := range args {
+		w, err := parseWaitTarget(a)
+		if err != nil {
+			return err
+		}
+		targets[i] = w
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if waitDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, waitDeadline)
+		defer cancel()
+	}
+	n := waitTargets(ctx, targets)
+
+	for _, w := range targets {
+		status := waitReady
+		var err error
+		if !w.Ready {
+			status = waitNotReady
+			err = fmt.Errorf("%s", w.Error)
+		}
+		emit(newResult("wait", w.Target, status, err, w), w.Log)
+	}
+	if n < len(targets) && (!waitAny || n == 0) {
+		return fmt.Errorf("%d of %d targets not ready", len(targets)-n, len(targets))
+	}
+	log.Debugf("wait done")
+	if len(command) == 0 {
+		return nil
+	}
+	// the command replaces the process, so the records are written before
+	if err := flushResults(cmd, nil); err != nil {
+		return err
+	}
+	return execCommand(command)
+}
+
+// parseWaitTarget returns the probe of a target URL, a target without scheme is a TCP target
+func parseWaitTarget(target string) (*WaitTarget, error) {
+	p := ProbeConfig{Type: probeTypeTCP, Target: target}
+	if scheme, rest, ok := strings.Cut(target, "://"); ok {
+		p.Type = strings.ToLower(scheme)
+		p.Target = strings.TrimSuffix(rest, "/")
+		switch p.Type {
+		case schemeHTTP, schemeHTTPS:
+			p.Type, p.Target = probeTypeHTTP, target
+		case probeTypeTCP, probeTypeTLS, probeTypeEcho, probeTypeICMP:
+		default:
+			return nil, fmt.Errorf("invalid target %s, use tcp, http, https, tls, echo or icmp", target)
+		}
+	}
+	if err := p.prepare(&ServeConfig{Interval: waitInterval, Timeout: waitProbeTimeout}); err != nil {
+		return nil, fmt.Errorf("invalid target %s: %w", target, err)
+	}
+	return &WaitTarget{Target: target, Type: p.Type, probe: p}, nil
+}
+
+// waitTargets retries every target until it is ready or ctx is done and returns the number of ready targets.
+// With --any the other targets are stopped when the first one is ready.
+func waitTargets(ctx context.Context, targets []*WaitTarget) int {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, w := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w.wait(ctx, start, &mu) && waitAny {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	n := 0
+	for _, w := range targets {
+		if w.Ready {
+			n++
+		}
+	}
+	return n
+}
+
+// wait runs the probe with exponential backoff until it succeeds or ctx is done
+func (w *WaitTarget) wait(ctx context.Context, start time.Time, mu *sync.Mutex) bool {
+	delay := waitInterval
+	for {
+		w.Attempts++
+		o := w.probe.run(ctx, w.Attempts)
+		if o.err == nil && o.status >= 400 {
+			o.err = fmt.Errorf("HTTP status %d", o.status)
+		}
+		w.Elapsed = time.Since(start).Seconds()
+		mu.Lock()
+		if o.err == nil {
+			w.Ready, w.Error = true, ""
+			w.progress(0)
+			mu.Unlock()
+			return true
+		}
+		if ctx.Err() == nil || w.Error == "" {
+			w.Error = o.err.Error()
+			w.progress(delay)
+		}
+		mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, waitMaxInterval)
+	}
+}
+
+// progress prints an attempt in text output, the structured output only contains the final state
+func (w *WaitTarget) progress(next time.Duration) {
+	if !textOutput() {
+		log.Debugf("wait %s attempt %d: %s", w.Target, w.Attempts, w.Error)
+		return
+	}
+	if w.Ready {
+		fmt.Printf("%s%-40s  attempt %d after %.1f s\n", green("%-10s", waitReady), w.Target, w.Attempts, w.Elapsed)
+		return
+	}
+	fmt.Printf("%s%-40s  attempt %d: %s, retry in %s\n", yellow("%-10s", "WAIT"), w.Target, w.Attempts, w.Error, next)
+}
+
+// Log prints the final state of a target
+func (w *WaitTarget) Log() {
+	if w.Ready {
+		return
+	}
+	fmt.Printf("%s%-40s  %d attempts in %.1f s, last error: %s\n", red("%-10s", "NOT READY"), w.Target, w.Attempts, w.Elapsed, w.Error)
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tommi2day/gomodules/common"
+)
+
+func resetWait(t *testing.T) {
+	t.Cleanup(func() {
+		waitDeadline = 60 * time.Second
+		waitInterval = time.Second
+		waitMaxInterval = 30 * time.Second
+		waitProbeTimeout = 5 * time.Second
+		waitAny = false
+		outputFormat = outputText
+		results = nil
+	})
+}
+
+func TestParseWaitTarget(t *testing.T) {
+	for _, c := range []struct {
+		target string
+		typ    string
+		probe  string
+		err    bool
+	}{
+		{"db:5432", probeTypeTCP, "db:5432", false},
+		{"tcp://db:5432", probeTypeTCP, "db:5432", false},
+		{"https://api/health", probeTypeHTTP, "https://api/health", false},
+		{"HTTP://api:8080/", probeTypeHTTP, "HTTP://api:8080/", false},
+		{"tls://ldap", probeTypeTLS, "ldap", false},
+		{"echo://echo:7/", probeTypeEcho, "echo:7", false},
+		{"icmp://gw", probeTypeICMP, "gw", false},
+		{"tcp://db", "", "", true},
+		{"udp://dns:53", "", "", true},
+	} {
+		w, err := parseWaitTarget(c.target)
+		if c.err {
+			assert.Error(t, err, c.target)
+			continue
+		}
+		require.NoError(t, err, c.target)
+		assert.Equal(t, c.typ, w.Type, c.target)
+		assert.Equal(t, c.probe, w.probe.Target, c.target)
+	}
+}
+
+func TestWait(t *testing.T) {
+	resetWait(t)
+	open, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = open.Close() }()
+	var calls int32
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+	closed := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	t.Run("CMD wait ready", func(t *testing.T) {
+		late := freePort(t)
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", late))
+			if err == nil {
+				time.Sleep(2 * time.Second)
+				_ = l.Close()
+			}
+		}()
+		args := []string{
+			"wait",
+			"tcp://" + open.Addr().String(),
+			fmt.Sprintf("127.0.0.1:%d", late),
+			web.URL + "/health",
+			"--interval", "100ms",
+			"--timeout", "5s",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		t.Log(out)
+		assert.Contains(t, out, "record wait tcp://"+open.Addr().String()+" READY")
+		assert.Contains(t, out, fmt.Sprintf("record wait 127.0.0.1:%d READY", late))
+		assert.Contains(t, out, "record wait "+web.URL+"/health READY")
+		assert.Contains(t, out, "HTTP status 503")
+		assert.Contains(t, out, "wait "+web.URL+"/health attempt 3")
+	})
+	t.Run("CMD wait timeout", func(t *testing.T) {
+		args := []string{
+			"wait",
+			closed,
+			open.Addr().String(),
+			"--interval", "100ms",
+			"--timeout", "500ms",
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "1 of 2 targets not ready")
+		t.Log(out)
+		assert.Contains(t, out, "record wait "+closed+" NOT-READY")
+	})
+	t.Run("CMD wait any", func(t *testing.T) {
+		args := []string{
+			"wait",
+			closed,
+			open.Addr().String(),
+			"--any",
+			"--interval", "100ms",
+			"--timeout", "5s",
+			"-o", "json",
+			flagUnitTest,
+		}
+		start := time.Now()
+		_, err := common.CmdRun(RootCmd, args)
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), 2*time.Second, "--any stops waiting for the closed port")
+	})
+	t.Run("CMD wait invalid target", func(t *testing.T) {
+		args := []string{
+			"wait",
+			"udp://127.0.0.1:53",
+			flagUnitTest,
+		}
+		_, err := common.CmdRun(RootCmd, args)
+		assert.ErrorContains(t, err, "invalid target")
+	})
+	// the position of -- is kept by the flag set, so this runs last
+	t.Run("CMD wait command", func(t *testing.T) {
+		var started []string
+		pending := -1
+		execCommand = func(command []string) error {
+			started, pending = command, len(results)
+			return nil
+		}
+		t.Cleanup(func() { execCommand = runCommand })
+		args := []string{
+			"wait",
+			open.Addr().String(),
+			"-o", "json",
+			flagUnitTest,
+			flagDebug,
+			"--", "false", "-x",
+		}
+		out, err := common.CmdRun(RootCmd, args)
+		require.NoError(t, err)
+		assert.Contains(t, out, "record wait "+open.Addr().String()+" READY")
+		assert.Equal(t, []string{"false", "-x"}, started)
+		assert.Equal(t, 0, pending, "records are written before the command starts")
+		waitCmd.Flags().Init(waitCmd.Name(), pflag.ContinueOnError)
+	})
+}
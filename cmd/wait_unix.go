@@ -0,0 +1,21 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand replaces the process with the command, so it receives the signals of a container runtime
+func runCommand(command []string) error {
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+	log.Debugf("exec %s %v", path, command[1:])
+	return syscall.Exec(path, command, os.Environ())
+}
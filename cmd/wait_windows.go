@@ -0,0 +1,28 @@
+//go:build windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand runs the command and exits with its exit code, Windows can not replace the process
+func runCommand(command []string) error {
+	log.Debugf("run %v", command)
+	c := exec.Command(command[0], command[1:]...) //nolint:gosec // command given by the user
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := c.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}